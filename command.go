@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kiririmode/grpc-sandbox/common"
+	"github.com/kiririmode/grpc-sandbox/common/conf"
+	"github.com/pkg/errors"
+)
+
+// defaultKeyEnv は鍵を読み込む環境変数のデフォルト値 (conf/development.yaml の config.secret.key_env と同じ)
+const defaultKeyEnv = "STUBSERVER_SECRET_KEY"
+
+// secretFlags は encrypt, decrypt サブコマンドに共通するオプション
+type secretFlags struct {
+	config    string
+	keyEnv    string
+	keyFile   string
+	algorithm string
+	encoding  string
+	iv        string
+}
+
+// newSecretFlagSet は name サブコマンドのオプションを定義した FlagSet を返却する
+func newSecretFlagSet(name, usage string) (*flag.FlagSet, *secretFlags) {
+	f := &secretFlags{}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&f.config, "config", "", "config file whose config.secret (including keys for rotation) is used instead of the key options")
+	fs.StringVar(&f.keyEnv, "key-env", defaultKeyEnv, "environment variable holding the hex encoded key")
+	fs.StringVar(&f.keyFile, "key-file", "", "file holding the hex encoded key (used when the environment variable is empty)")
+	fs.StringVar(&f.algorithm, "algorithm", conf.AlgorithmAesGcm, "aes-gcm or aes-cbc")
+	fs.StringVar(&f.encoding, "encoding", "base64", "base64 or hex")
+	fs.StringVar(&f.iv, "iv", "", "hex encoded fixed initial vector for aes-cbc (openssl compatible, not accepted as ENC(...) value)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [options] [value]\n%s\n", os.Args[0], name, usage)
+		fs.PrintDefaults()
+	}
+	return fs, f
+}
+
+// cipher はオプションに従い、鍵を読み込んでブロック暗号を作成する
+func (f *secretFlags) cipher() (common.BlockCipher, error) {
+	if f.config != "" {
+		if f.iv != "" {
+			return nil, errors.New("-iv cannot be used with -config")
+		}
+		return loadSecretCipher(f.config)
+	}
+
+	key, err := conf.LoadSecretKey(f.keyEnv, f.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, errors.Errorf("secret key is not specified (set %s or -key-file)", f.keyEnv)
+	}
+
+	if f.iv == "" {
+		return conf.NewSecretCipher(f.algorithm, key)
+	}
+	if f.algorithm != conf.AlgorithmAesCbc {
+		return nil, errors.Errorf("-iv is only available with %s", conf.AlgorithmAesCbc)
+	}
+	iv, err := hex.DecodeString(f.iv)
+	if err != nil {
+		return nil, errors.New("-iv must be hex encoded")
+	}
+	return common.NewAesCbcPkcs7Cipher(key, iv)
+}
+
+// loadSecretCipher は設定ファイル path の config.secret に従うブロック暗号を返却する
+func loadSecretCipher(path string) (common.BlockCipher, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open config file %s", path)
+	}
+	defer file.Close()
+
+	c, err := conf.NewConfigurationFromReader(strings.TrimPrefix(filepath.Ext(path), "."), file)
+	if err != nil {
+		return nil, err
+	}
+	bc := c.SecretCipher()
+	if bc == nil {
+		return nil, errors.Errorf("secret key is not configured in %s", path)
+	}
+	return bc, nil
+}
+
+// parseEncoding は base64 または hex を conf.Encoding に変換する
+func parseEncoding(s string) (conf.Encoding, error) {
+	switch strings.ToLower(s) {
+	case conf.BASE64.String():
+		return conf.BASE64, nil
+	case conf.HEX.String():
+		return conf.HEX, nil
+	}
+	return 0, errors.Errorf("unsupported encoding [%s]", s)
+}
+
+// input は、引数が指定された場合はその値を、それ以外の場合は標準入力の 1 行目を返却する。
+// シェルの履歴に平文を残さないよう、標準入力からの入力を推奨する
+func input(args []string, stdin io.Reader) (string, error) {
+	if len(args) > 1 {
+		return "", errors.New("too many arguments")
+	}
+	if len(args) == 1 {
+		return args[0], nil
+	}
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", errors.Wrap(err, "failed to read stdin")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// encrypt は平文を暗号化し、設定ファイルに記述できる ENC(...) の形式で出力する
+func encrypt(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs, f := newSecretFlagSet("encrypt", "Encrypt the value (or the first line of stdin) into ENC(...) format.")
+	fs.Parse(args)
+
+	enc, err := parseEncoding(f.encoding)
+	if err != nil {
+		return err
+	}
+	bc, err := f.cipher()
+	if err != nil {
+		return err
+	}
+	plain, err := input(fs.Args(), stdin)
+	if err != nil {
+		return err
+	}
+	encrypted, err := bc.Encrypt([]byte(plain))
+	if err != nil {
+		return errors.Wrap(err, "failed to encrypt")
+	}
+
+	// 固定の初期ベクトルによる暗号文は設定ファイルでは復号できないため、ENC(...) の形式にしない
+	var out string
+	if f.iv != "" {
+		out = encodeToString(encrypted, enc)
+	} else if out, err = conf.FormatEncrypted(encrypted, enc); err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, out)
+	return nil
+}
+
+// decrypt は ENC(...) の形式の値を復号化し、平文を出力する
+func decrypt(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs, f := newSecretFlagSet("decrypt", "Decrypt the ENC(...) value (or the first line of stdin).")
+	fs.Parse(args)
+
+	bc, err := f.cipher()
+	if err != nil {
+		return err
+	}
+	v, err := input(fs.Args(), stdin)
+	if err != nil {
+		return err
+	}
+
+	var plain []byte
+	if f.iv != "" {
+		plain, err = decryptEncoded(v, f.encoding, bc)
+	} else if conf.IsEncrypted(v) {
+		plain, err = conf.DecryptValue(v, bc)
+	} else {
+		return errors.New("value must be in ENC(...) format")
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to decrypt")
+	}
+	fmt.Fprintln(stdout, string(plain))
+	return nil
+}
+
+// reencrypt は、ENC(...) の形式の値を設定ファイルの Keyring のプライマリの鍵で暗号化し直し、同じエンコーディングで出力する
+func reencrypt(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	config := fs.String("config", "", "config file whose config.secret.keys is used")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s reencrypt -config file [value]\nRe-encrypt the ENC(...) value (or the first line of stdin) with the primary key.\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *config == "" {
+		return errors.New("-config is required")
+	}
+	bc, err := loadSecretCipher(*config)
+	if err != nil {
+		return err
+	}
+	keyring, ok := bc.(*common.Keyring)
+	if !ok {
+		return errors.Errorf("config.secret.keys is not configured in %s", *config)
+	}
+
+	v, err := input(fs.Args(), stdin)
+	if err != nil {
+		return err
+	}
+	encrypted, enc, err := conf.ParseEncrypted(v)
+	if err != nil {
+		return err
+	}
+	reencrypted, err := keyring.Reencrypt(encrypted)
+	if err != nil {
+		return errors.Wrap(err, "failed to re-encrypt")
+	}
+	out, err := conf.FormatEncrypted(reencrypted, enc)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, out)
+	return nil
+}
+
+// decryptEncoded は、固定の初期ベクトルによる暗号文のように ENC(...) の形式でなく、
+// encoding でエンコードされた値 v を bc で復号化する
+func decryptEncoded(v, encoding string, bc common.BlockCipher) ([]byte, error) {
+	enc, err := parseEncoding(encoding)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := decodeString(strings.TrimSpace(v), enc)
+	if err != nil {
+		return nil, errors.Errorf("value must be %s encoded", enc)
+	}
+	return bc.Decrypt(encrypted)
+}
+
+// genkey はランダムな鍵を生成し、hex encoding で出力する
+func genkey(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("genkey", flag.ExitOnError)
+	size := fs.Int("size", 32, "key size in bytes (16, 24 or 32)")
+	out := fs.String("out", "", "file to write the key to (default: stdout)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s genkey [options]\nGenerate a random hex encoded key.\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	switch *size {
+	case 16, 24, 32:
+	default:
+		return errors.Errorf("key size must be 16, 24 or 32, but got [%d]", *size)
+	}
+	key := make([]byte, *size)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return errors.Wrap(err, "failed to generate key")
+	}
+
+	encoded := hex.EncodeToString(key)
+	if *out == "" {
+		fmt.Fprintln(stdout, encoded)
+		return nil
+	}
+	// 鍵ファイルは所有者のみが読み書きできるようにする
+	if err := ioutil.WriteFile(*out, []byte(encoded+"\n"), 0600); err != nil {
+		return errors.Wrapf(err, "failed to write key file %s", *out)
+	}
+	return nil
+}
+
+// encodeToString は b を enc でエンコードする
+func encodeToString(b []byte, enc conf.Encoding) string {
+	if enc == conf.HEX {
+		return hex.EncodeToString(b)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// decodeString は enc でエンコードされた s をデコードする
+func decodeString(s string, enc conf.Encoding) ([]byte, error) {
+	if enc == conf.HEX {
+		return hex.DecodeString(s)
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// テストでは環境変数の鍵を用いず、-key-file の鍵を用いる
+const undefinedKeyEnv = "COMMAND_TEST_UNDEFINED_KEY"
+
+// newKeyFile は、genkey で生成した鍵を dir/name に書き込み、そのパスを返却する
+func newKeyFile(t *testing.T, dir, name string) string {
+	path := filepath.Join(dir, name)
+	if err := genkey([]string{"-out", path}, ioutil.Discard); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	return path
+}
+
+func TestGenkey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "command")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("鍵を hex encoding で出力する", func(t *testing.T) {
+		for size, expected := range map[string]int{"16": 32, "24": 48, "32": 64} {
+			var stdout bytes.Buffer
+			if err := genkey([]string{"-size", size}, &stdout); err != nil {
+				t.Fatalf("err must be nil, but got %s", err)
+			}
+			if actual := strings.TrimSpace(stdout.String()); len(actual) != expected {
+				t.Errorf("size %s: expected %d characters, but got %s", size, expected, actual)
+			}
+		}
+	})
+
+	t.Run("鍵ファイルを所有者のみが読み書きできるように作成する", func(t *testing.T) {
+		var stdout bytes.Buffer
+		path := filepath.Join(dir, "secret.key")
+		if err := genkey([]string{"-out", path}, &stdout); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if stdout.Len() != 0 {
+			t.Errorf("key must not be written to stdout, but got %s", stdout.String())
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("expected 0600, but got %o", info.Mode().Perm())
+		}
+		if b, _ := ioutil.ReadFile(path); len(strings.TrimSpace(string(b))) != 64 {
+			t.Errorf("expected 64 characters, but got %s", b)
+		}
+	})
+
+	t.Run("不正な鍵長を拒否する", func(t *testing.T) {
+		if err := genkey([]string{"-size", "20"}, ioutil.Discard); err == nil {
+			t.Error("illegal key size must be rejected")
+		}
+	})
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "command")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	defer os.RemoveAll(dir)
+	key, wrong := newKeyFile(t, dir, "secret.key"), newKeyFile(t, dir, "wrong.key")
+
+	for _, options := range [][]string{
+		{},
+		{"-algorithm", "aes-cbc", "-encoding", "hex"},
+		{"-algorithm", "aes-cbc", "-iv", "000102030405060708090a0b0c0d0e0f"},
+	} {
+		t.Run(fmt.Sprintf("暗号化した値を復号化できる %s", options), func(t *testing.T) {
+			args := append([]string{"-key-env", undefinedKeyEnv, "-key-file", key}, options...)
+			var encrypted bytes.Buffer
+			if err := encrypt(args, strings.NewReader("p@ssw0rd\n"), &encrypted); err != nil {
+				t.Fatalf("err must be nil, but got %s", err)
+			}
+			if strings.Contains(encrypted.String(), "p@ssw0rd") {
+				t.Errorf("plain text must not be written, but got %s", encrypted.String())
+			}
+
+			var plain bytes.Buffer
+			if err := decrypt(args, &encrypted, &plain); err != nil {
+				t.Fatalf("err must be nil, but got %s", err)
+			}
+			if plain.String() != "p@ssw0rd\n" {
+				t.Errorf("expected p@ssw0rd, but got %s", plain.String())
+			}
+		})
+	}
+
+	t.Run("異なる鍵では復号化できない", func(t *testing.T) {
+		var encrypted bytes.Buffer
+		if err := encrypt([]string{"-key-env", undefinedKeyEnv, "-key-file", key, "p@ssw0rd"}, nil, &encrypted); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		var plain bytes.Buffer
+		if err := decrypt([]string{"-key-env", undefinedKeyEnv, "-key-file", wrong}, &encrypted, &plain); err == nil {
+			t.Errorf("wrong key must be rejected, but got %s", plain.String())
+		}
+	})
+
+	t.Run("鍵がなければエラーとする", func(t *testing.T) {
+		if err := encrypt([]string{"-key-env", undefinedKeyEnv, "p@ssw0rd"}, nil, ioutil.Discard); err == nil {
+			t.Error("error should be occured, but got success")
+		}
+	})
+
+	t.Run("ENC(...) の形式でない値は復号化しない", func(t *testing.T) {
+		if err := decrypt([]string{"-key-env", undefinedKeyEnv, "-key-file", key, "p@ssw0rd"}, nil, ioutil.Discard); err == nil {
+			t.Error("error should be occured, but got success")
+		}
+	})
+}
+
+func TestReencrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "command")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	defer os.RemoveAll(dir)
+	old, key := newKeyFile(t, dir, "secret-1.key"), newKeyFile(t, dir, "secret-2.key")
+
+	// 鍵 1 をプライマリとする設定と、鍵 2 へローテーションした設定
+	keys := "config:\n  secret:\n    primary: \"%s\"\n    keys:\n      - id: \"1\"\n        key_file: %s\n      - id: \"2\"\n        key_file: %s\n"
+	before, after, only := filepath.Join(dir, "before.yaml"), filepath.Join(dir, "after.yaml"), filepath.Join(dir, "only.yaml")
+	if err := ioutil.WriteFile(before, []byte(fmt.Sprintf(keys, "1", old, key)), 0600); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	if err := ioutil.WriteFile(after, []byte(fmt.Sprintf(keys, "2", old, key)), 0600); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	if err := ioutil.WriteFile(only, []byte(fmt.Sprintf("config:\n  secret:\n    keys:\n      - id: \"2\"\n        key_file: %s\n", key)), 0600); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+
+	var encrypted, reencrypted, plain bytes.Buffer
+	if err := encrypt([]string{"-config", before, "p@ssw0rd"}, nil, &encrypted); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	if err := reencrypt([]string{"-config", after}, &encrypted, &reencrypted); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	if reencrypted.String() == encrypted.String() {
+		t.Errorf("value must be re-encrypted, but got %s", reencrypted.String())
+	}
+
+	// 鍵 1 を含まない設定でも復号化できる
+	if err := decrypt([]string{"-config", only}, &reencrypted, &plain); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	if plain.String() != "p@ssw0rd\n" {
+		t.Errorf("expected p@ssw0rd, but got %s", plain.String())
+	}
+
+	t.Run("-config は必須とする", func(t *testing.T) {
+		if err := reencrypt(nil, strings.NewReader(""), ioutil.Discard); err == nil {
+			t.Error("error should be occured, but got success")
+		}
+	})
+}
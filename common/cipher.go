@@ -4,10 +4,21 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"io"
 
 	"github.com/pkg/errors"
 )
 
+var (
+	// ErrInvalidLength は、復号しようとした暗号文の長さが不正であることを表現する
+	ErrInvalidLength = errors.New("invalid ciphertext length")
+	// ErrInvalidPadding は、復号した平文のパディングが不正であることを表現する。
+	// 暗号文の破損や鍵の誤りにより発生する
+	ErrInvalidPadding = errors.New("invalid padding")
+)
+
 // BlockCipher はブロック暗号を表現する
 type BlockCipher interface {
 	Encrypt(plain []byte) ([]byte, error)
@@ -16,18 +27,20 @@ type BlockCipher interface {
 
 // AesCbcPkcs7Cipher はAES/CBC/PKCS7 のブロック暗号を表現する
 type AesCbcPkcs7Cipher struct {
-	// 初期ベクトル
+	// 初期ベクトル。nil の場合は暗号化の度にランダムに生成し、暗号文の先頭に付与する
 	initialVector []byte
+	// 初期ベクトルの生成に用いる乱数源
+	random io.Reader
 	// ブロック暗号
 	block cipher.Block
 }
 
-// NewAesCbcPkcs7Cipher は AES/CBC/PKCS#7 のブロック暗号を作成し、返却する
+// NewAesCbcPkcs7Cipher は、初期ベクトルとして常に iv を用いる AES/CBC/PKCS#7 のブロック暗号を作成し、返却する。
+// 暗号文には初期ベクトルを含まないため、openssl aes-256-cbc -iv 等と互換性がある
 func NewAesCbcPkcs7Cipher(key, iv []byte) (*AesCbcPkcs7Cipher, error) {
 	// 鍵長チェック
-	keyLen := len(key)
-	if (keyLen != 16) && (keyLen != 24) && (keyLen != 32) {
-		return nil, errors.Errorf("illegal key length [%d]. key length for AES must be 128, 192, 256 bit", keyLen)
+	if err := checkKeyLength(key); err != nil {
+		return nil, err
 	}
 	// 初期ベクトル長チェック
 	if len(iv) != aes.BlockSize {
@@ -44,6 +57,34 @@ func NewAesCbcPkcs7Cipher(key, iv []byte) (*AesCbcPkcs7Cipher, error) {
 	}, nil
 }
 
+// NewAesCbcPkcs7CipherWithRandomIV は、暗号化の度にランダムな初期ベクトルを生成する AES/CBC/PKCS#7 のブロック暗号を作成し、返却する。
+// 初期ベクトルは暗号文の先頭に付与され、復号時には暗号文の先頭から読み取る。
+// 同じ平文から同じ暗号文が生成されないため、NewAesCbcPkcs7Cipher より優先して利用する
+func NewAesCbcPkcs7CipherWithRandomIV(key []byte) (*AesCbcPkcs7Cipher, error) {
+	// 鍵長チェック
+	if err := checkKeyLength(key); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create AES cipher block")
+	}
+	return &AesCbcPkcs7Cipher{
+		random: rand.Reader,
+		block:  block,
+	}, nil
+}
+
+// checkKeyLength は key が AES の鍵として利用できる長さであるかを検証する
+func checkKeyLength(key []byte) error {
+	keyLen := len(key)
+	if (keyLen != 16) && (keyLen != 24) && (keyLen != 32) {
+		return errors.Errorf("illegal key length [%d]. key length for AES must be 128, 192, 256 bit", keyLen)
+	}
+	return nil
+}
+
 // pad は RFC 5652 6.3. Content-encryption Process に記述された通りに
 // b にパディングとしてのバイトを追加する (PKCS#7 Padding)
 func (c *AesCbcPkcs7Cipher) pad(b []byte) []byte {
@@ -52,30 +93,71 @@ func (c *AesCbcPkcs7Cipher) pad(b []byte) []byte {
 	return append(b, pad...)
 }
 
-// unpad は PKCS#7 Padding に従って付与されたパディングを削除する
-func (c *AesCbcPkcs7Cipher) unpad(b []byte) []byte {
+// unpad は PKCS#7 Padding に従って付与されたパディングを検証・削除する。
+// パディングの内容が推測されないよう、検証は不正な箇所によらず一定時間で行う。
+// パディングが不正な場合は ErrInvalidPadding を返却する
+func (c *AesCbcPkcs7Cipher) unpad(b []byte) ([]byte, error) {
+	if len(b) == 0 || len(b)%aes.BlockSize != 0 {
+		return nil, ErrInvalidLength
+	}
+
 	padSize := int(b[len(b)-1])
-	return b[:len(b)-padSize]
+	// パディング長は 1 以上、ブロック長以下
+	good := subtle.ConstantTimeLessOrEq(1, padSize) & subtle.ConstantTimeLessOrEq(padSize, aes.BlockSize)
+	// 末尾のブロックのうち、パディングの範囲はすべてパディング長と等しい
+	for i := 1; i <= aes.BlockSize; i++ {
+		inPad := subtle.ConstantTimeLessOrEq(i, padSize)
+		match := subtle.ConstantTimeByteEq(b[len(b)-i], byte(padSize))
+		good &= subtle.ConstantTimeSelect(inPad, match, 1)
+	}
+	if good != 1 {
+		return nil, ErrInvalidPadding
+	}
+	return b[:len(b)-padSize], nil
 }
 
 // Encrypt は plain を AES/CBC/PKCS#7 で暗号化する。
+// 初期ベクトルをランダムに生成する場合は、初期ベクトルと暗号文を連結して返却する
 func (c *AesCbcPkcs7Cipher) Encrypt(plain []byte) ([]byte, error) {
-	encrypter := cipher.NewCBCEncrypter(c.block, c.initialVector)
+	iv := c.initialVector
+	var prefix []byte
+	if iv == nil {
+		iv = make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(c.random, iv); err != nil {
+			return nil, errors.Wrap(err, "failed to generate initial vector")
+		}
+		prefix = iv
+	}
+	encrypter := cipher.NewCBCEncrypter(c.block, iv)
 
 	// PKCS#7 に沿ってパディングを付与
 	padded := c.pad(plain)
 	// 暗号化
 	encrypted := make([]byte, len(padded))
 	encrypter.CryptBlocks(encrypted, padded)
-	return encrypted, nil
+	return append(prefix, encrypted...), nil
 }
 
-// Decrypt は encrypted を AES/CBC/PKCS#7 で復号化する
+// Decrypt は encrypted を AES/CBC/PKCS#7 で復号化する。
+// 暗号文の長さがブロック長の倍数でない場合は ErrInvalidLength を、パディングが不正な場合は ErrInvalidPadding を返却する
 func (c *AesCbcPkcs7Cipher) Decrypt(encrypted []byte) ([]byte, error) {
-	mode := cipher.NewCBCDecrypter(c.block, c.initialVector)
+	// 初期ベクトルをランダムに生成する場合は、暗号文の先頭から読み取る
+	iv := c.initialVector
+	if iv == nil {
+		if len(encrypted) < aes.BlockSize {
+			return nil, ErrInvalidLength
+		}
+		iv, encrypted = encrypted[:aes.BlockSize], encrypted[aes.BlockSize:]
+	}
+
+	// CryptBlocks はブロック長の倍数でない入力に対して panic するため、事前に検証する
+	if len(encrypted) == 0 || len(encrypted)%aes.BlockSize != 0 {
+		return nil, ErrInvalidLength
+	}
+	mode := cipher.NewCBCDecrypter(c.block, iv)
 
 	plain := make([]byte, len(encrypted))
 	mode.CryptBlocks(plain, encrypted)
 	// パディングを除去
-	return c.unpad(plain), nil
+	return c.unpad(plain)
 }
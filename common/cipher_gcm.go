@@ -0,0 +1,85 @@
+package common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// AuthenticationError は、認証付き暗号の復号時に暗号文または追加認証データの改竄を検知したことを表現する。
+// 鍵が誤っている場合も同様に検知される
+type AuthenticationError struct{}
+
+// Error はエラーメッセージを返却する
+func (e *AuthenticationError) Error() string {
+	return "message authentication failed"
+}
+
+// AesGcmCipher は AES/GCM の認証付き暗号を表現する。
+// 暗号化の度にランダムな nonce を生成し、暗号文の先頭に付与する
+type AesGcmCipher struct {
+	aead cipher.AEAD
+	// nonce の生成に用いる乱数源
+	random io.Reader
+}
+
+// NewAesGcmCipher は key を鍵とする AES/GCM の認証付き暗号を作成し、返却する
+func NewAesGcmCipher(key []byte) (*AesGcmCipher, error) {
+	// 鍵長チェック
+	if err := checkKeyLength(key); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create AES cipher block")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create GCM")
+	}
+	return &AesGcmCipher{
+		aead:   aead,
+		random: rand.Reader,
+	}, nil
+}
+
+// Encrypt は plain を AES/GCM で暗号化し、nonce、暗号文、認証タグを連結して返却する
+func (c *AesGcmCipher) Encrypt(plain []byte) ([]byte, error) {
+	return c.EncryptWithAdditionalData(plain, nil)
+}
+
+// Decrypt は Encrypt で暗号化された encrypted を復号化する。
+// 暗号文が短すぎる場合は ErrInvalidLength を、改竄を検知した場合は *AuthenticationError を返却する
+func (c *AesGcmCipher) Decrypt(encrypted []byte) ([]byte, error) {
+	return c.DecryptWithAdditionalData(encrypted, nil)
+}
+
+// EncryptWithAdditionalData は plain を AES/GCM で暗号化する。
+// additionalData は暗号化されないが、復号時に同じ値であることが検証される (ex. 設定項目のキー)
+func (c *AesGcmCipher) EncryptWithAdditionalData(plain, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plain)+c.aead.Overhead())
+	if _, err := io.ReadFull(c.random, nonce); err != nil {
+		return nil, errors.Wrap(err, "failed to generate nonce")
+	}
+	// nonce の後ろに暗号文と認証タグを付与
+	return c.aead.Seal(nonce, nonce, plain, additionalData), nil
+}
+
+// DecryptWithAdditionalData は EncryptWithAdditionalData で暗号化された encrypted を復号化する。
+// 改竄を検知した場合、または additionalData が暗号化時と異なる場合は *AuthenticationError を返却する
+func (c *AesGcmCipher) DecryptWithAdditionalData(encrypted, additionalData []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(encrypted) < nonceSize+c.aead.Overhead() {
+		return nil, ErrInvalidLength
+	}
+
+	plain, err := c.aead.Open(nil, encrypted[:nonceSize], encrypted[nonceSize:], additionalData)
+	if err != nil {
+		return nil, &AuthenticationError{}
+	}
+	return plain, nil
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestAesGcmCipherImplementsBlockCipher(t *testing.T) {
+	var _ BlockCipher = &AesGcmCipher{}
+}
+
+func newAesGcmCipher(t *testing.T) *AesGcmCipher {
+	key, _ := hex.DecodeString("1234567890123456789012345678901234567890123456789012345678901234")
+	sut, err := NewAesGcmCipher(key)
+	if err != nil {
+		t.Fatalf("error must be nil, but [%s]", err)
+	}
+	return sut
+}
+
+func TestAesGcmCipher(t *testing.T) {
+	sut := newAesGcmCipher(t)
+
+	t.Run("暗号化した値を復号できる", func(t *testing.T) {
+		for _, plain := range []string{"", "a", "aaaaaaaaaaaaaaaa", "aaaaaaaaaaaaaaaaa"} {
+			encrypted, err := sut.Encrypt([]byte(plain))
+			if err != nil {
+				t.Fatalf("error must be nil, but [%s]", err)
+			}
+			decrypted, err := sut.Decrypt(encrypted)
+			if err != nil {
+				t.Fatalf("error must be nil, but [%s]", err)
+			}
+			if string(decrypted) != plain {
+				t.Errorf("expected [%s], but got [%s]", plain, decrypted)
+			}
+		}
+	})
+
+	t.Run("同じ平文でも暗号文は毎回異なる", func(t *testing.T) {
+		first, _ := sut.Encrypt([]byte("plain"))
+		second, _ := sut.Encrypt([]byte("plain"))
+		if bytes.Equal(first, second) {
+			t.Errorf("ciphertexts must differ, but both are [%x]", first)
+		}
+	})
+
+	t.Run("改竄を検知する", func(t *testing.T) {
+		encrypted, _ := sut.Encrypt([]byte("plain"))
+		for i := range encrypted {
+			tampered := append([]byte{}, encrypted...)
+			tampered[i] ^= 0x01
+			if _, err := sut.Decrypt(tampered); err == nil {
+				t.Errorf("tampering at [%d] must be detected", i)
+			} else if _, ok := err.(*AuthenticationError); !ok {
+				t.Errorf("expected *AuthenticationError, but got %T", err)
+			}
+		}
+	})
+
+	t.Run("追加認証データが異なる場合は復号できない", func(t *testing.T) {
+		encrypted, err := sut.EncryptWithAdditionalData([]byte("plain"), []byte("db.password"))
+		if err != nil {
+			t.Fatalf("error must be nil, but [%s]", err)
+		}
+		if _, err := sut.DecryptWithAdditionalData(encrypted, []byte("db.password")); err != nil {
+			t.Errorf("error must be nil, but [%s]", err)
+		}
+		if _, err := sut.DecryptWithAdditionalData(encrypted, []byte("db.user")); err == nil {
+			t.Error("different additional data must be rejected")
+		}
+		if _, err := sut.Decrypt(encrypted); err == nil {
+			t.Error("missing additional data must be rejected")
+		}
+	})
+
+	t.Run("短すぎる暗号文はエラーとなる", func(t *testing.T) {
+		if _, err := sut.Decrypt(make([]byte, 27)); err == nil {
+			t.Error("too short ciphertext must be rejected")
+		}
+	})
+}
@@ -1,7 +1,9 @@
 package common
 
 import (
+	"bytes"
 	"crypto/aes"
+	"crypto/cipher"
 	"encoding/base64"
 	"encoding/hex"
 	"strings"
@@ -141,3 +143,99 @@ func TestIllegalLength(t *testing.T) {
 		}
 	})
 }
+
+func TestAesCbcPkcs7DecryptIllegalCiphertext(t *testing.T) {
+	key, _ := hex.DecodeString("1234567890123456789012345678901234567890123456789012345678901234")
+	iv, _ := hex.DecodeString("1234567890ABCDEF1234567890ABCDEF")
+	sut, err := NewAesCbcPkcs7Cipher(key, iv)
+	if err != nil {
+		t.Fatalf("error must be nil, but [%s]", err)
+	}
+
+	t.Run("ブロック長の倍数でない暗号文", func(t *testing.T) {
+		for _, l := range []int{0, 1, 15, 17, 31} {
+			if _, err := sut.Decrypt(make([]byte, l)); err != ErrInvalidLength {
+				t.Errorf("expected ErrInvalidLength with length [%d], but got %v", l, err)
+			}
+		}
+	})
+
+	t.Run("不正なパディング", func(t *testing.T) {
+		// パディングを付与せずに暗号化することで、不正なパディングを持つ暗号文を作成する
+		testCases := []struct {
+			name   string
+			padded []byte
+		}{
+			{name: "パディング長が 0", padded: append(bytes.Repeat([]byte("a"), 15), 0x00)},
+			{name: "パディング長がブロック長を超える", padded: append(bytes.Repeat([]byte("a"), 15), 0x11)},
+			{name: "パディングの値が一致しない", padded: append(bytes.Repeat([]byte("a"), 13), 0x02, 0x03, 0x03)},
+			{name: "パディングの先頭のみ一致しない", padded: append([]byte{0x0f}, bytes.Repeat([]byte{0x10}, 15)...)},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				block, _ := aes.NewCipher(key)
+				encrypted := make([]byte, len(tc.padded))
+				cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, tc.padded)
+
+				if _, err := sut.Decrypt(encrypted); err != ErrInvalidPadding {
+					t.Errorf("expected ErrInvalidPadding, but got %v", err)
+				}
+			})
+		}
+	})
+
+	t.Run("誤った鍵で復号しても panic しない", func(t *testing.T) {
+		other, _ := NewAesCbcPkcs7Cipher(bytes.Repeat([]byte{0x01}, 32), iv)
+		for i := 0; i < 256; i++ {
+			encrypted, _ := sut.Encrypt(bytes.Repeat([]byte("a"), i))
+			if plain, err := other.Decrypt(encrypted); err == nil && len(plain) > len(encrypted) {
+				t.Errorf("plaintext must not be longer than ciphertext")
+			}
+		}
+	})
+}
+
+func TestAesCbcPkcs7CipherWithRandomIV(t *testing.T) {
+	key, _ := hex.DecodeString("1234567890123456789012345678901234567890123456789012345678901234")
+	sut, err := NewAesCbcPkcs7CipherWithRandomIV(key)
+	if err != nil {
+		t.Fatalf("error must be nil, but [%s]", err)
+	}
+
+	t.Run("初期ベクトルを先頭に付与した暗号文を復号できる", func(t *testing.T) {
+		for i := 0; i < 64; i++ {
+			plain := bytes.Repeat([]byte("a"), i)
+			encrypted, err := sut.Encrypt(plain)
+			if err != nil {
+				t.Fatalf("error must be nil, but [%s]", err)
+			}
+			if expected := aes.BlockSize + (i/aes.BlockSize+1)*aes.BlockSize; len(encrypted) != expected {
+				t.Errorf("expected length [%d], but got [%d]", expected, len(encrypted))
+			}
+			// 先頭の初期ベクトルを用いれば、固定の初期ベクトルによる暗号化と同じ結果となる
+			fixed, _ := NewAesCbcPkcs7Cipher(key, encrypted[:aes.BlockSize])
+			if actual, err := fixed.Decrypt(encrypted[aes.BlockSize:]); err != nil || !bytes.Equal(actual, plain) {
+				t.Errorf("expected [%s], but got [%s] (err: %v)", plain, actual, err)
+			}
+			if actual, err := sut.Decrypt(encrypted); err != nil || !bytes.Equal(actual, plain) {
+				t.Errorf("expected [%s], but got [%s] (err: %v)", plain, actual, err)
+			}
+		}
+	})
+
+	t.Run("同じ平文から異なる暗号文を生成する", func(t *testing.T) {
+		first, _ := sut.Encrypt([]byte("plain"))
+		second, _ := sut.Encrypt([]byte("plain"))
+		if bytes.Equal(first, second) {
+			t.Errorf("ciphertexts of the same plaintext must differ, but got [%x]", first)
+		}
+	})
+
+	t.Run("初期ベクトルのみ、もしくは初期ベクトルに満たない暗号文", func(t *testing.T) {
+		for _, l := range []int{0, 1, 15, 16, 17, 31} {
+			if _, err := sut.Decrypt(make([]byte, l)); err != ErrInvalidLength {
+				t.Errorf("expected ErrInvalidLength with length [%d], but got %v", l, err)
+			}
+		}
+	})
+}
@@ -1,11 +1,14 @@
 package conf
 
 import (
+	"encoding/base64"
 	"encoding/hex"
 	"io"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/kiririmode/grpc-sandbox/common"
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 )
@@ -18,8 +21,18 @@ type Configuration struct {
 	EnvironmentName string
 	// 設定ファイルの探索パス
 	paths []string
-	// Viper のインスタンス
+	// Viper のインスタンス。設定の再読み込み時に、新たに読み込んだインスタンスに置き換える
 	viper *viper.Viper
+	// 暗号化された設定値 (ENC(...)) の復号に用いるブロック暗号。鍵が設定されていない場合は nil
+	secretCipher common.BlockCipher
+	mu           sync.RWMutex
+
+	// 設定の再読み込みの購読
+	subscriptions []*Subscription
+	// 設定ファイルの監視
+	watcher *watcher
+	// 再読み込みを逐次的に行うためのロック
+	reloading sync.Mutex
 }
 
 // Encoding は設定ファイルの文字列をバイト化するときのエンコーディングを表現する
@@ -30,6 +43,8 @@ const (
 	UTF8 Encoding = iota
 	// HEX は hex encoding を表現する
 	HEX
+	// BASE64 は base64 encoding (RFC 4648 の標準形式) を表現する
+	BASE64
 )
 
 // String は Encoding の名称を返却する
@@ -39,6 +54,8 @@ func (e Encoding) String() string {
 		return "utf-8"
 	case HEX:
 		return "hex"
+	case BASE64:
+		return "base64"
 	}
 	return "unknown"
 }
@@ -62,7 +79,11 @@ func NewConfigurationFromReader(format string, in io.Reader) (*Configuration, er
 	if err := v.ReadConfig(in); err != nil {
 		return nil, errors.Wrapf(err, "failed to init Configuration with %s", in)
 	}
-	return &Configuration{viper: v}, nil
+	bc, err := loadSecrets(v)
+	if err != nil {
+		return nil, err
+	}
+	return &Configuration{viper: v, secretCipher: bc}, nil
 }
 
 // Name は初期化対象である "configuration" を返却する
@@ -76,83 +97,157 @@ func (c *Configuration) Initialize() error {
 		return errors.Errorf("environment name is missing")
 	}
 
-	// 設定ファイルを探索するパスを設定する
-	c.viper.SetConfigName(c.EnvironmentName)
-	for _, path := range c.paths {
-		c.viper.AddConfigPath(path)
-	}
+	c.configure(c.viper)
 
 	// 設定ファイルを読み込み
 	err := c.viper.ReadInConfig()
 	if err != nil {
 		return errors.Wrapf(err, "failed to read config file: [%s] (suffix ommitted)", c.EnvironmentName)
 	}
+	// 暗号化された設定値が復号できることを確認する
+	if c.secretCipher, err = loadSecrets(c.viper); err != nil {
+		return err
+	}
+
+	// config.watch が true の場合、設定ファイルの変更を監視して再読み込みする
+	if c.viper.GetBool("config.watch") {
+		w, err := newWatcher(c, c.viper.ConfigFileUsed())
+		if err != nil {
+			return err
+		}
+		c.watcher = w
+	}
+	return nil
+}
+
+// configure は v に設定ファイルの探索パスと、環境変数による上書きの設定を行う
+func (c *Configuration) configure(v *viper.Viper) {
+	// 設定ファイルを探索するパスを設定する
+	v.SetConfigName(c.EnvironmentName)
+	for _, path := range c.paths {
+		v.AddConfigPath(path)
+	}
 
 	// アプリケーション名を接頭語として付与した環境変数を設定することで設定を上書きできるようにする
-	c.viper.SetEnvPrefix(c.AppName)
-	c.viper.AutomaticEnv()
+	v.SetEnvPrefix(c.AppName)
+	v.AutomaticEnv()
 	// ネストした設定項目も環境変数で上書きできるようにする
 	// ex.) database.host => AUTHORIZER_DATABASE_HOST
-	c.viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-
-	return nil
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 }
 
-// Finalize は何も実行しない
+// Finalize は終了処理として、設定ファイルの監視を停止する
 func (c *Configuration) Finalize() error {
-	return nil
+	if c.watcher == nil {
+		return nil
+	}
+	return c.watcher.close()
+}
+
+// current は現在の設定を保持する Viper のインスタンスを返却する
+func (c *Configuration) current() *viper.Viper {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.viper
 }
 
 // GetInt は、key に対応する設定値を int で返却する
 func (c *Configuration) GetInt(key string) int {
-	return c.viper.GetInt(key)
+	return c.current().GetInt(key)
 }
 
-// GetString は、key に対応する設定値を string で返却する
+// GetString は、key に対応する設定値を string で返却する。
+// 設定値が ENC(...) の形式の場合は復号化した値を返却する。読み込み時に復号化できることを確認しているが、
+// 復号化できない場合は空文字列を返却する。ログ等に出力しない秘密の値は GetSecret で参照する
 func (c *Configuration) GetString(key string) string {
-	return c.viper.GetString(key)
+	v, bc := c.secrets()
+	return decryptString(v.GetString(key), bc)
 }
 
-// GetStringSlice は、key に対応する設定値を string のスライスで返却する
+// GetStringSlice は、key に対応する設定値を string のスライスで返却する。
+// ENC(...) の形式の要素は GetString と同様に復号化する
 func (c *Configuration) GetStringSlice(key string) []string {
-	return c.viper.GetStringSlice(key)
+	v, bc := c.secrets()
+	values := v.GetStringSlice(key)
+	for i := range values {
+		values[i] = decryptString(values[i], bc)
+	}
+	return values
+}
+
+// decryptString は、設定値 v が ENC(...) の形式の場合は bc で復号化し、それ以外の場合は v をそのまま返却する。
+// 復号化できない場合は空文字列を返却する
+func decryptString(v string, bc common.BlockCipher) string {
+	plain, err := DecryptValue(v, bc)
+	if err != nil {
+		return ""
+	}
+	return string(plain)
 }
 
 // GetBool は、key に対応する設定値を bool で返却する
 func (c *Configuration) GetBool(key string) bool {
-	return c.viper.GetBool(key)
+	return c.current().GetBool(key)
 }
 
 // GetByte は、key に対応する設定値(string) を enc で
 // 表現されるエンコーディングでデコードし、その結果としての byte スライスを返却する。
+// 設定値が ENC(...) の形式の場合は、復号化した値をデコードする。
 func (c *Configuration) GetByte(key string, enc Encoding) (b []byte, err error) {
-	v := c.viper.GetString(key)
+	v, bc := c.secrets()
+	plain, err := DecryptValue(v.GetString(key), bc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decrypt [%s]", key)
+	}
+	return decode(string(plain), enc)
+}
 
+// decode は v を enc で表現されるエンコーディングでデコードする
+func decode(v string, enc Encoding) ([]byte, error) {
 	switch enc {
 	case UTF8:
 		return []byte(v), nil
 	case HEX:
-		b, err = hex.DecodeString(v)
-	default:
-		return nil, errors.Errorf("unsupported encoding [%s]", enc)
+		return hex.DecodeString(v)
+	case BASE64:
+		return base64.StdEncoding.DecodeString(v)
 	}
+	return nil, errors.Errorf("unsupported encoding [%s]", enc)
+}
 
-	return b, err
+// encode は b を enc で表現されるエンコーディングでエンコードする
+func encode(b []byte, enc Encoding) string {
+	switch enc {
+	case HEX:
+		return hex.EncodeToString(b)
+	case BASE64:
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	return string(b)
 }
 
 // GetDuration は、key に対応する設定値を Duration として返却する
 func (c *Configuration) GetDuration(key string) time.Duration {
-	return c.viper.GetDuration(key)
+	return c.current().GetDuration(key)
+}
+
+// UnmarshalKey は、key に対応する設定値を rawVal で指定した構造体等にデコードする。
+// 構造体のフィールドと設定項目の対応は mapstructure タグで指定する。
+func (c *Configuration) UnmarshalKey(key string, rawVal interface{}) error {
+	if err := c.current().UnmarshalKey(key, rawVal); err != nil {
+		return errors.Wrapf(err, "failed to unmarshal [%s]", key)
+	}
+	return nil
 }
 
 // SetFormat は設定ファイルのフォーマットを指定する。
 // 設定に使用しているライブラリである viper は自動的にフォーマットを検知してくれるので、
 // 本メソッドは主としてテスト用である。
 func (c *Configuration) SetFormat(formatType string) {
-	c.viper.SetConfigType(formatType)
+	c.current().SetConfigType(formatType)
 }
 
 // ReadConfig は reader から設定を読み込む。
 func (c *Configuration) ReadConfig(in io.Reader) error {
-	return c.viper.ReadConfig(in)
+	return c.current().ReadConfig(in)
 }
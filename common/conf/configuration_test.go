@@ -1,6 +1,8 @@
 package conf
 
 import (
+	"errors"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -18,6 +20,7 @@ func TestEncoding_String(t *testing.T) {
 	}{
 		{enc: UTF8, expected: "utf-8"},
 		{enc: HEX, expected: "hex"},
+		{enc: BASE64, expected: "base64"},
 	}
 
 	for _, tc := range testCases {
@@ -113,3 +116,114 @@ func TestConfiguration_ReadConfig(t *testing.T) {
 		t.Errorf("expected fuga, but got %s", actual)
 	}
 }
+
+// writeConfig は dir に name.yaml として content を書き込む
+func writeConfig(t *testing.T, dir, name, content string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".yaml"), []byte(content), 0644); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+}
+
+func TestConfiguration_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConfig(t, dir, "reload", "log:\n  level: info\n  format: json\nserver:\n  port: 10000\n")
+	c := NewConfiguration("reloadtest", "reload", []string{dir})
+	if err := c.Initialize(); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	defer c.Finalize()
+
+	var events []*ChangeEvent
+	c.Subscribe("log", func(e *ChangeEvent) {
+		events = append(events, e)
+	})
+	c.AddValidator("log.level", func(next *Configuration) error {
+		if next.GetString("log.level") == "illegal" {
+			return errors.New("illegal level")
+		}
+		return nil
+	})
+	var reloadErrors []error
+	c.OnReloadError(func(err error) {
+		reloadErrors = append(reloadErrors, err)
+	})
+
+	t.Run("購読した設定項目の変更のみが通知される", func(t *testing.T) {
+		writeConfig(t, dir, "reload", "log:\n  level: debug\n  format: json\nserver:\n  port: 10001\n")
+		if err := c.Reload(); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if len(events) != 1 {
+			t.Fatalf("expected 1 event, but got %d", len(events))
+		}
+		expected := []Change{{Key: "log.level", Old: "info", New: "debug"}}
+		if !reflect.DeepEqual(events[0].Changes, expected) {
+			t.Errorf("expected %v, but got %v", expected, events[0].Changes)
+		}
+		if c.GetInt("server.port") != 10001 {
+			t.Errorf("expected 10001, but got %d", c.GetInt("server.port"))
+		}
+	})
+
+	t.Run("検証に失敗した場合は変更前の設定を維持する", func(t *testing.T) {
+		events, reloadErrors = nil, nil
+		writeConfig(t, dir, "reload", "log:\n  level: illegal\n  format: json\nserver:\n  port: 10002\n")
+		if err := c.Reload(); err == nil {
+			t.Error("illegal config must be rejected")
+		}
+		if len(events) != 0 || len(reloadErrors) != 1 {
+			t.Errorf("expected 0 event and 1 error, but got %d event and %d error", len(events), len(reloadErrors))
+		}
+		if c.GetString("log.level") != "debug" || c.GetInt("server.port") != 10001 {
+			t.Errorf("previous config must be kept, but got level %s, port %d", c.GetString("log.level"), c.GetInt("server.port"))
+		}
+	})
+
+	t.Run("読み込めない場合は変更前の設定を維持する", func(t *testing.T) {
+		writeConfig(t, dir, "reload", "log: [\n")
+		if err := c.Reload(); err == nil {
+			t.Error("broken config must be rejected")
+		}
+		if c.GetString("log.level") != "debug" {
+			t.Errorf("previous config must be kept, but got level %s", c.GetString("log.level"))
+		}
+	})
+}
+
+func TestConfiguration_watch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConfig(t, dir, "watch", "config:\n  watch: true\nlog:\n  level: info\n")
+	c := NewConfiguration("watchtest", "watch", []string{dir})
+	if err := c.Initialize(); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	defer c.Finalize()
+
+	changed := make(chan *ChangeEvent, 1)
+	c.Subscribe("log.level", func(e *ChangeEvent) {
+		changed <- e
+	})
+
+	writeConfig(t, dir, "watch", "config:\n  watch: true\nlog:\n  level: debug\n")
+	select {
+	case e := <-changed:
+		if !e.Changed("log.level") {
+			t.Errorf("expected change of log.level, but got %v", e.Keys())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("change of config file must be detected")
+	}
+	if c.GetString("log.level") != "debug" {
+		t.Errorf("expected debug, but got %s", c.GetString("log.level"))
+	}
+}
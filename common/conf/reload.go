@@ -0,0 +1,281 @@
+package conf
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// reloadDelay は、設定ファイルの変更を検知してから再読み込みするまでの待ち時間。
+// エディタによる保存等で連続して発生する変更を 1 度の再読み込みにまとめる
+const reloadDelay = 100 * time.Millisecond
+
+// Change は 1 つの設定項目の変更を表現する
+type Change struct {
+	// 設定項目のキー (ex. log.level)
+	Key string
+	// 変更前と変更後の値。追加・削除された設定項目の場合は nil となる
+	Old interface{}
+	New interface{}
+}
+
+// ChangeEvent は設定の再読み込みによる変更を表現する
+type ChangeEvent struct {
+	// キーの昇順に並んだ、変更された設定項目
+	Changes []Change
+}
+
+// Changed は key またはその配下の設定項目が変更されたかを返却する
+func (e *ChangeEvent) Changed(key string) bool {
+	for _, c := range e.Changes {
+		if under(c.Key, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Keys は変更された設定項目のキーを返却する
+func (e *ChangeEvent) Keys() []string {
+	keys := make([]string, 0, len(e.Changes))
+	for _, c := range e.Changes {
+		keys = append(keys, c.Key)
+	}
+	return keys
+}
+
+// filter は prefix 配下の設定項目の変更のみを含む ChangeEvent を返却する
+func (e *ChangeEvent) filter(prefix string) *ChangeEvent {
+	filtered := &ChangeEvent{}
+	for _, c := range e.Changes {
+		if under(c.Key, prefix) {
+			filtered.Changes = append(filtered.Changes, c)
+		}
+	}
+	return filtered
+}
+
+// under は key が prefix そのものか、その配下の設定項目であるかを返却する。prefix が空の場合は常に true を返却する
+func under(key, prefix string) bool {
+	prefix = strings.ToLower(prefix)
+	return prefix == "" || key == prefix || strings.HasPrefix(key, prefix+".")
+}
+
+// Subscription は設定の再読み込みの購読を表現する。
+// 変更の通知、変更後の設定の検証、再読み込みの失敗の通知のいずれか 1 つを受け取る
+type Subscription struct {
+	config *Configuration
+	prefix string
+	// 変更を通知する関数
+	handler func(e *ChangeEvent)
+	// 変更後の設定を検証する関数
+	validate func(next *Configuration) error
+	// 再読み込みの失敗を通知する関数
+	onError func(err error)
+}
+
+// Unsubscribe は購読を解除する
+func (s *Subscription) Unsubscribe() {
+	c := s.config
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, sub := range c.subscriptions {
+		if sub == s {
+			c.subscriptions = append(c.subscriptions[:i:i], c.subscriptions[i+1:]...)
+			return
+		}
+	}
+}
+
+// Subscribe は、再読み込みにより prefix 配下 (ex. "log" の場合は log.level 等) の設定項目が変更された場合に
+// 呼び出される handler を登録する。prefix が空の場合は、すべての変更に対して呼び出される。
+// handler には prefix 配下の変更のみが渡され、呼び出された時点で Get 系のメソッドは変更後の値を返却する
+func (c *Configuration) Subscribe(prefix string, handler func(e *ChangeEvent)) *Subscription {
+	return c.subscribe(&Subscription{prefix: prefix, handler: handler})
+}
+
+// AddValidator は、再読み込みにより prefix 配下の設定項目が変更された場合に、変更後の設定 next を検証する validate を登録する。
+// validate がエラーを返却した場合、再読み込みした設定は破棄され、変更前の設定が引き続き利用される
+func (c *Configuration) AddValidator(prefix string, validate func(next *Configuration) error) *Subscription {
+	return c.subscribe(&Subscription{prefix: prefix, validate: validate})
+}
+
+// OnReloadError は、設定の再読み込みに失敗した場合に、その理由を引数として呼び出される handler を登録する
+func (c *Configuration) OnReloadError(handler func(err error)) *Subscription {
+	return c.subscribe(&Subscription{onError: handler})
+}
+
+// subscribe は購読 s を登録する
+func (c *Configuration) subscribe(s *Subscription) *Subscription {
+	s.config = c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscriptions = append(c.subscriptions, s)
+	return s
+}
+
+// snapshot は登録されている購読の複製を返却する
+func (c *Configuration) snapshot() []*Subscription {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]*Subscription{}, c.subscriptions...)
+}
+
+// Reload は設定ファイルを再読み込みし、変更があれば購読者に通知する。
+// 設定ファイルが読み込めない場合や、変更後の設定が検証に失敗した場合はエラーを返却し、変更前の設定を維持する
+func (c *Configuration) Reload() error {
+	err := c.reload()
+	if err != nil {
+		c.notifyError(err)
+	}
+	return err
+}
+
+// reload は設定ファイルを再読み込みし、変更があれば購読者に通知する
+func (c *Configuration) reload() error {
+	c.reloading.Lock()
+	defer c.reloading.Unlock()
+
+	v := viper.New()
+	c.configure(v)
+	if err := v.ReadInConfig(); err != nil {
+		return errors.Wrapf(err, "failed to reload config file: [%s] (suffix ommitted)", c.EnvironmentName)
+	}
+
+	event := diff(c.current(), v)
+	if len(event.Changes) == 0 {
+		return nil
+	}
+	bc, err := loadSecrets(v)
+	if err != nil {
+		return errors.Wrap(err, "reloaded config is rejected")
+	}
+
+	subscriptions := c.snapshot()
+	next := &Configuration{AppName: c.AppName, EnvironmentName: c.EnvironmentName, viper: v, secretCipher: bc}
+	for _, s := range subscriptions {
+		if s.validate == nil || !event.Changed(s.prefix) {
+			continue
+		}
+		if err := s.validate(next); err != nil {
+			return errors.Wrap(err, "reloaded config is rejected")
+		}
+	}
+
+	c.mu.Lock()
+	c.viper, c.secretCipher = v, bc
+	c.mu.Unlock()
+
+	for _, s := range subscriptions {
+		if s.handler == nil {
+			continue
+		}
+		if filtered := event.filter(s.prefix); len(filtered.Changes) > 0 {
+			s.handler(filtered)
+		}
+	}
+	return nil
+}
+
+// diff は old から new への設定項目の変更を返却する
+func diff(old, new *viper.Viper) *ChangeEvent {
+	keys := make(map[string]bool)
+	for _, k := range old.AllKeys() {
+		keys[k] = true
+	}
+	for _, k := range new.AllKeys() {
+		keys[k] = true
+	}
+
+	event := &ChangeEvent{}
+	for k := range keys {
+		o, n := old.Get(k), new.Get(k)
+		if !reflect.DeepEqual(o, n) {
+			event.Changes = append(event.Changes, Change{Key: k, Old: o, New: n})
+		}
+	}
+	sort.Slice(event.Changes, func(i, j int) bool { return event.Changes[i].Key < event.Changes[j].Key })
+	return event
+}
+
+// watcher は設定ファイルの変更を監視し、変更された場合に設定を再読み込みする
+type watcher struct {
+	fsw  *fsnotify.Watcher
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newWatcher は、c の設定ファイル file の監視を開始する。
+// 一時ファイルを rename して保存するエディタによる更新も検知できるよう、ファイルを含むディレクトリを監視する
+func newWatcher(c *Configuration, file string) (*watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to watch config file")
+	}
+	file = filepath.Clean(file)
+	if err := fsw.Add(filepath.Dir(file)); err != nil {
+		fsw.Close()
+		return nil, errors.Wrapf(err, "failed to watch config file %s", file)
+	}
+
+	w := &watcher{fsw: fsw, done: make(chan struct{})}
+	w.wg.Add(1)
+	go w.run(c, file)
+	return w, nil
+}
+
+// run は監視を終了するまで、file の変更を検知する度に、reloadDelay だけ待ってから c を再読み込みする
+func (w *watcher) run(c *Configuration, file string) {
+	defer w.wg.Done()
+
+	timer := time.NewTimer(reloadDelay)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case e, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(e.Name) == file && e.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+				timer.Reset(reloadDelay)
+			}
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			c.notifyError(errors.Wrap(err, "failed to watch config file"))
+		case <-timer.C:
+			c.Reload()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// notifyError は、再読み込みの失敗を購読している関数に err を渡す
+func (c *Configuration) notifyError(err error) {
+	for _, s := range c.snapshot() {
+		if s.onError != nil {
+			s.onError(err)
+		}
+	}
+}
+
+// close は監視を終了する
+func (w *watcher) close() error {
+	close(w.done)
+	err := w.fsw.Close()
+	w.wg.Wait()
+	if err != nil {
+		return errors.Wrap(err, "failed to stop watching config file")
+	}
+	return nil
+}
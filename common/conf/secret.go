@@ -0,0 +1,372 @@
+package conf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/kiririmode/grpc-sandbox/common"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// 暗号化された設定値の復号に用いるアルゴリズム
+const (
+	// AlgorithmAesGcm は AES/GCM を表現する
+	AlgorithmAesGcm = "aes-gcm"
+	// AlgorithmAesCbc は、暗号化の度にランダムな初期ベクトルを生成する AES/CBC/PKCS#7 を表現する
+	AlgorithmAesCbc = "aes-cbc"
+)
+
+// redacted は Secret を書式化した場合に出力する文字列
+const redacted = "******"
+
+// encryptedPattern は暗号化された設定値の書式。
+// ENC(暗号文) または ENC(エンコーディング:暗号文) の形式で記述し、エンコーディングを省略した場合は base64 として扱う
+var encryptedPattern = regexp.MustCompile(`^ENC\((?:(base64|hex):)?([^)]*)\)$`)
+
+// Secret は復号化された秘密の設定値を表現する。
+// ログ等に誤って出力されないよう、fmt による書式化では値を伏せる
+type Secret struct {
+	value []byte
+}
+
+// Bytes は秘密の設定値を返却する
+func (s Secret) Bytes() []byte {
+	return s.value
+}
+
+// String は値を伏せた文字列を返却する
+func (s Secret) String() string {
+	return redacted
+}
+
+// Format は書式によらず、値を伏せた文字列を出力する
+func (s Secret) Format(f fmt.State, verb rune) {
+	io.WriteString(f, redacted)
+}
+
+// GetSecret は、key に対応する設定値を Secret で返却する。
+// 設定値が ENC(...) の形式の場合は config.secret.* で設定した鍵で復号化し、それ以外の場合は設定値をそのまま返却する。
+// エラーには設定値を含めない
+func (c *Configuration) GetSecret(key string) (Secret, error) {
+	v, bc := c.secrets()
+	plain, err := DecryptValue(v.GetString(key), bc)
+	if err != nil {
+		return Secret{}, errors.Wrapf(err, "failed to decrypt [%s]", key)
+	}
+	return Secret{value: plain}, nil
+}
+
+// IsEncrypted は v が暗号化された設定値の書式 ENC(...) であるかを返却する
+func IsEncrypted(v string) bool {
+	return encryptedPattern.MatchString(strings.TrimSpace(v))
+}
+
+// FormatEncrypted は暗号文 encrypted を enc でエンコードし、暗号化された設定値の書式 ENC(...) で返却する
+func FormatEncrypted(encrypted []byte, enc Encoding) (string, error) {
+	switch enc {
+	case BASE64:
+		return fmt.Sprintf("ENC(%s)", encode(encrypted, enc)), nil
+	case HEX:
+		return fmt.Sprintf("ENC(hex:%s)", encode(encrypted, enc)), nil
+	}
+	return "", errors.Errorf("unsupported encoding [%s]", enc)
+}
+
+// DecryptValue は、設定値 v が ENC(...) の形式の場合は bc で復号化し、それ以外の場合は v をそのまま返却する
+func DecryptValue(v string, bc common.BlockCipher) ([]byte, error) {
+	if !IsEncrypted(v) {
+		return []byte(v), nil
+	}
+	if bc == nil {
+		return nil, errors.New("secret key is not configured (config.secret.key_env or config.secret.key_file)")
+	}
+
+	encrypted, _, err := ParseEncrypted(v)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := bc.Decrypt(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	return plain, nil
+}
+
+// ParseEncrypted は ENC(...) の形式の設定値 v をデコードし、暗号文とそのエンコーディングを返却する
+func ParseEncrypted(v string) ([]byte, Encoding, error) {
+	m := encryptedPattern.FindStringSubmatch(strings.TrimSpace(v))
+	if m == nil {
+		return nil, 0, errors.New("value must be in ENC(...) format")
+	}
+
+	enc := BASE64
+	if m[1] == HEX.String() {
+		enc = HEX
+	}
+	encrypted, err := decode(m[2], enc)
+	if err != nil {
+		return nil, 0, errors.Errorf("illegal %s encoding", enc)
+	}
+	return encrypted, enc, nil
+}
+
+// NewSecretCipher は、algorithm で表現されるアルゴリズムで key を鍵とする、設定値の暗号化・復号化に用いるブロック暗号を返却する
+func NewSecretCipher(algorithm string, key []byte) (common.BlockCipher, error) {
+	a, err := common.ParseAlgorithm(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return a.NewCipher(key)
+}
+
+// KeyConfig は鍵のローテーションのために config.secret.keys に記述する鍵の設定を表現する
+type KeyConfig struct {
+	// 暗号文に付与する鍵 ID
+	ID string `mapstructure:"id"`
+	// アルゴリズム (aes-gcm or aes-cbc)
+	Algorithm string `mapstructure:"algorithm"`
+	// 鍵 (hex) を読み込む環境変数とファイル
+	KeyEnv  string `mapstructure:"key_env"`
+	KeyFile string `mapstructure:"key_file"`
+	// 退役済みの鍵は復号にのみ用いる
+	Retired bool `mapstructure:"retired"`
+}
+
+// LoadKeyring は、key 配下の keys に記述された鍵を持ち、primary に記述された鍵 ID の鍵をプライマリとする Keyring を返却する。
+// primary を省略した場合は、最初の退役済みでない鍵をプライマリとする
+func (c *Configuration) LoadKeyring(key string) (*common.Keyring, error) {
+	return loadKeyring(c.current(), key)
+}
+
+// loadKeyring は v の key 配下の設定から Keyring を作成する
+func loadKeyring(v *viper.Viper, key string) (*common.Keyring, error) {
+	var configs []KeyConfig
+	if err := v.UnmarshalKey(key+".keys", &configs); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal [%s.keys]", key)
+	}
+
+	keyring := common.NewKeyring()
+	for _, kc := range configs {
+		algorithm, err := common.ParseAlgorithm(kc.Algorithm)
+		if err != nil {
+			return nil, errors.Wrapf(err, "illegal key [%s]", kc.ID)
+		}
+		b, err := LoadSecretKey(kc.KeyEnv, kc.KeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "illegal key [%s]", kc.ID)
+		}
+		if b == nil {
+			return nil, errors.Errorf("key [%s] is not configured (key_env or key_file)", kc.ID)
+		}
+		if err := keyring.AddKey(kc.ID, algorithm, b, kc.Retired); err != nil {
+			return nil, err
+		}
+	}
+
+	if primary := v.GetString(key + ".primary"); primary != "" {
+		if err := keyring.SetPrimary(primary); err != nil {
+			return nil, err
+		}
+	}
+	if keyring.Primary() == "" {
+		return nil, errors.Errorf("[%s.keys] must contain an active key", key)
+	}
+	return keyring, nil
+}
+
+// secrets は、現在の設定を保持する Viper のインスタンスと、その設定値の復号に用いるブロック暗号を返却する
+func (c *Configuration) secrets() (*viper.Viper, common.BlockCipher) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.viper, c.secretCipher
+}
+
+// SecretCipher は暗号化された設定値の復号に用いるブロック暗号を返却する。鍵が設定されていない場合は nil を返却する
+func (c *Configuration) SecretCipher() common.BlockCipher {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.secretCipher
+}
+
+// LoadSecretKey は、環境変数 env、または env が空の場合はファイル file から、hex encoding された鍵を読み込む。
+// いずれも設定されていない場合は nil を返却する
+func LoadSecretKey(env, file string) ([]byte, error) {
+	v, err := readSecret(env, file)
+	if v == nil || err != nil {
+		return nil, err
+	}
+	key, err := decode(strings.TrimSpace(string(v)), HEX)
+	if err != nil {
+		return nil, errors.New("secret key must be hex encoded")
+	}
+	return key, nil
+}
+
+// LoadPassphrase は、環境変数 env、または env が空の場合はファイル file から、パスフレーズを読み込む。
+// ファイルの末尾の改行は取り除き、いずれも設定されていない場合は nil を返却する
+func LoadPassphrase(env, file string) ([]byte, error) {
+	v, err := readSecret(env, file)
+	if v == nil || err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(v, "\r\n"), nil
+}
+
+// readSecret は環境変数 env、または env が空の場合はファイル file の内容を返却する
+func readSecret(env, file string) ([]byte, error) {
+	if env != "" && os.Getenv(env) != "" {
+		return []byte(os.Getenv(env)), nil
+	}
+	if file == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read secret file %s", file)
+	}
+	return b, nil
+}
+
+// KDFConfig はパスフレーズから鍵を導出するために config.secret.kdf に記述する設定を表現する。
+// 省略したパラメータには KDF 毎の推奨値を用いる
+type KDFConfig struct {
+	// KDF (pbkdf2, scrypt or argon2id)
+	Algorithm   string `mapstructure:"algorithm"`
+	Iterations  uint32 `mapstructure:"iterations"`
+	Memory      uint32 `mapstructure:"memory"`
+	BlockSize   uint32 `mapstructure:"block_size"`
+	Parallelism uint32 `mapstructure:"parallelism"`
+}
+
+// Params は設定に従う KDF のパラメータを返却する
+func (k KDFConfig) Params() (common.KDFParams, error) {
+	name := k.Algorithm
+	if name == "" {
+		name = common.Argon2id.String()
+	}
+	kdf, err := common.ParseKDF(name)
+	if err != nil {
+		return common.KDFParams{}, err
+	}
+
+	params := common.DefaultKDFParams(kdf)
+	if k.Iterations != 0 {
+		params.Iterations = k.Iterations
+	}
+	if k.Memory != 0 {
+		params.Memory = k.Memory
+	}
+	if k.BlockSize != 0 {
+		params.BlockSize = k.BlockSize
+	}
+	if k.Parallelism != 0 {
+		params.Parallelism = k.Parallelism
+	}
+	return params, nil
+}
+
+// loadPassphraseCipher は v の config.secret.passphrase_env または passphrase_file のパスフレーズから鍵を導出する暗号を返却する。
+// パスフレーズが設定されていない場合は nil を返却する
+func loadPassphraseCipher(v *viper.Viper) (common.BlockCipher, error) {
+	passphrase, err := LoadPassphrase(v.GetString("config.secret.passphrase_env"), v.GetString("config.secret.passphrase_file"))
+	if passphrase == nil || err != nil {
+		return nil, err
+	}
+	var kc KDFConfig
+	if err := v.UnmarshalKey("config.secret.kdf", &kc); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal [config.secret.kdf]")
+	}
+	params, err := kc.Params()
+	if err != nil {
+		return nil, err
+	}
+	c, err := common.NewPassphraseCipher(passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadSecrets は v の config.secret.* に従って設定値の復号に用いるブロック暗号を作成し、
+// v に含まれる暗号化された設定値がすべて復号できることを確認する。
+// config.secret.keys が記述されている場合は Keyring を、パスフレーズが設定されている場合はパスフレーズから導出した鍵を、
+// それ以外の場合は key_env または key_file の鍵を用いる。鍵が設定されていない場合のブロック暗号は nil となる
+func loadSecrets(v *viper.Viper) (common.BlockCipher, error) {
+	var bc common.BlockCipher
+	if v.IsSet("config.secret.keys") {
+		keyring, err := loadKeyring(v, "config.secret")
+		if err != nil {
+			return nil, err
+		}
+		bc = keyring
+	} else {
+		// パスフレーズが設定されていない場合は、鍵を用いる
+		var err error
+		if bc, err = loadPassphraseCipher(v); err != nil {
+			return nil, err
+		}
+	}
+	if bc == nil {
+		key, err := LoadSecretKey(v.GetString("config.secret.key_env"), v.GetString("config.secret.key_file"))
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			if bc, err = NewSecretCipher(v.GetString("config.secret.algorithm"), key); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, k := range v.AllKeys() {
+		if err := checkEncrypted(k, v.Get(k), bc); err != nil {
+			return nil, err
+		}
+	}
+	return bc, nil
+}
+
+// checkEncrypted は、key の設定値 value と、value に含まれるリストやマップの要素のうち、
+// ENC(...) の形式の値が bc で復号化できることを確認する
+func checkEncrypted(key string, value interface{}, bc common.BlockCipher) error {
+	switch v := value.(type) {
+	case string:
+		if !IsEncrypted(v) {
+			return nil
+		}
+		if _, err := DecryptValue(v, bc); err != nil {
+			return errors.Wrapf(err, "failed to decrypt [%s]", key)
+		}
+	case []string:
+		for i, e := range v {
+			if err := checkEncrypted(fmt.Sprintf("%s[%d]", key, i), e, bc); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			if err := checkEncrypted(fmt.Sprintf("%s[%d]", key, i), e, bc); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			if err := checkEncrypted(key+"."+k, e, bc); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		for k, e := range v {
+			if err := checkEncrypted(fmt.Sprintf("%s.%v", key, k), e, bc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package conf
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const secretTestKey = "1234567890123456789012345678901234567890123456789012345678901234"
+
+// encryptValue は、algorithm と secretTestKey で plain を暗号化し、ENC(...) の形式で返却する
+func encryptValue(t *testing.T, algorithm, plain string, enc Encoding) string {
+	key, _ := decode(secretTestKey, HEX)
+	bc, err := NewSecretCipher(algorithm, key)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	encrypted, err := bc.Encrypt([]byte(plain))
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	v, err := FormatEncrypted(encrypted, enc)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	return v
+}
+
+func TestConfiguration_GetSecret(t *testing.T) {
+	os.Setenv("CONF_TEST_SECRET_KEY", secretTestKey)
+	defer os.Unsetenv("CONF_TEST_SECRET_KEY")
+
+	for _, algorithm := range []string{AlgorithmAesGcm, AlgorithmAesCbc} {
+		t.Run(algorithm+" で暗号化された設定値を復号化できること", func(t *testing.T) {
+			config := fmt.Sprintf("config:\n  secret:\n    algorithm: %s\n    key_env: CONF_TEST_SECRET_KEY\ndb:\n  password: %s\n  token: %s\n  user: plain\n",
+				algorithm, encryptValue(t, algorithm, "p@ssw0rd", BASE64), encryptValue(t, algorithm, "t0ken", HEX))
+			c, err := NewConfigurationFromReader("yaml", strings.NewReader(config))
+			if err != nil {
+				t.Fatalf("err must be nil, but got %s", err)
+			}
+
+			for key, expected := range map[string]string{"db.password": "p@ssw0rd", "db.token": "t0ken", "db.user": "plain"} {
+				actual, err := c.GetSecret(key)
+				if err != nil {
+					t.Fatalf("err must be nil, but got %s", err)
+				}
+				if string(actual.Bytes()) != expected {
+					t.Errorf("expected %s, but got %s", expected, actual.Bytes())
+				}
+			}
+		})
+	}
+
+	t.Run("GetString, GetByte, GetStringSlice も復号化した値を返却すること", func(t *testing.T) {
+		config := fmt.Sprintf("config:\n  secret:\n    key_env: CONF_TEST_SECRET_KEY\ndb:\n  password: %s\n  key: %s\n  hosts: [%s, plain]\n",
+			encryptValue(t, AlgorithmAesGcm, "p@ssw0rd", BASE64), encryptValue(t, AlgorithmAesGcm, "cafe", HEX), encryptValue(t, AlgorithmAesGcm, "secret.example.com", BASE64))
+		c, err := NewConfigurationFromReader("yaml", strings.NewReader(config))
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+
+		if actual := c.GetString("db.password"); actual != "p@ssw0rd" {
+			t.Errorf("expected p@ssw0rd, but got %s", actual)
+		}
+		if actual, err := c.GetByte("db.key", HEX); err != nil || !bytes.Equal(actual, []byte{0xca, 0xfe}) {
+			t.Errorf("expected cafe, but got %x (err: %v)", actual, err)
+		}
+		if actual := c.GetStringSlice("db.hosts"); len(actual) != 2 || actual[0] != "secret.example.com" || actual[1] != "plain" {
+			t.Errorf("expected [secret.example.com plain], but got %s", actual)
+		}
+	})
+
+	t.Run("鍵ファイルから鍵を読み込めること", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "secret")
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "secret.key")
+		if err := ioutil.WriteFile(file, []byte(secretTestKey+"\n"), 0600); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+
+		config := fmt.Sprintf("config:\n  secret:\n    key_file: %s\npassword: %s\n", file, encryptValue(t, AlgorithmAesGcm, "p@ssw0rd", BASE64))
+		c, err := NewConfigurationFromReader("yaml", strings.NewReader(config))
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if actual, err := c.GetSecret("password"); err != nil || string(actual.Bytes()) != "p@ssw0rd" {
+			t.Errorf("expected p@ssw0rd, but got %s (err: %v)", actual.Bytes(), err)
+		}
+	})
+
+	t.Run("復号化できない設定値は読み込み時にエラーとなること", func(t *testing.T) {
+		for _, config := range []string{
+			// 鍵が設定されていない
+			"password: " + encryptValue(t, AlgorithmAesGcm, "p@ssw0rd", BASE64),
+			// アルゴリズムが異なる
+			"config:\n  secret:\n    algorithm: aes-cbc\n    key_env: CONF_TEST_SECRET_KEY\npassword: " + encryptValue(t, AlgorithmAesGcm, "p@ssw0rd", BASE64),
+			// エンコーディングが不正
+			"config:\n  secret:\n    key_env: CONF_TEST_SECRET_KEY\npassword: ENC(hex:zz)",
+			// 未対応のアルゴリズム
+			"config:\n  secret:\n    algorithm: des\n    key_env: CONF_TEST_SECRET_KEY\n",
+			// リストの要素
+			"config:\n  secret:\n    key_env: CONF_TEST_SECRET_KEY\nhosts:\n  - plain\n  - ENC(hex:zz)\n",
+			// リストに含まれるマップの要素
+			"config:\n  secret:\n    key_env: CONF_TEST_SECRET_KEY\nusers:\n  - name: admin\n    password: " + encryptValue(t, AlgorithmAesCbc, "p@ssw0rd", BASE64) + "\n",
+		} {
+			if _, err := NewConfigurationFromReader("yaml", strings.NewReader(config)); err == nil {
+				t.Errorf("illegal config must be rejected: %s", config)
+			}
+		}
+	})
+}
+
+func TestSecret_Format(t *testing.T) {
+	sut := Secret{value: []byte("p@ssw0rd")}
+	for _, format := range []string{"%s", "%v", "%+v", "%#v", "%x", "%q"} {
+		if actual := fmt.Sprintf(format, sut); strings.Contains(actual, "p@ssw0rd") || actual != redacted {
+			t.Errorf("expected %s with format %s, but got %s", redacted, format, actual)
+		}
+	}
+	if !bytes.Equal(sut.Bytes(), []byte("p@ssw0rd")) {
+		t.Errorf("expected p@ssw0rd, but got %s", sut.Bytes())
+	}
+}
+
+func TestConfiguration_LoadKeyring(t *testing.T) {
+	os.Setenv("CONF_TEST_SECRET_KEY", secretTestKey)
+	defer os.Unsetenv("CONF_TEST_SECRET_KEY")
+	os.Setenv("CONF_TEST_OLD_SECRET_KEY", "00112233445566778899aabbccddeeff")
+	defer os.Unsetenv("CONF_TEST_OLD_SECRET_KEY")
+
+	keys := `
+config:
+  secret:
+    primary: "2"
+    keys:
+      - id: "1"
+        algorithm: aes-cbc
+        key_env: CONF_TEST_OLD_SECRET_KEY
+        retired: true
+      - id: "2"
+        key_env: CONF_TEST_SECRET_KEY
+`
+	c, err := NewConfigurationFromReader("yaml", strings.NewReader(keys))
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	keyring, err := c.LoadKeyring("config.secret")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	if keyring.Primary() != "2" || len(keyring.KeyIDs()) != 2 {
+		t.Errorf("expected primary 2 of 2 keys, but got primary %s of %s", keyring.Primary(), keyring.KeyIDs())
+	}
+
+	t.Run("Keyring で暗号化された設定値を復号化できること", func(t *testing.T) {
+		if _, err := NewConfigurationFromReader("yaml", strings.NewReader(strings.Replace(keys, `primary: "2"`, `primary: "1"`, 1))); err == nil {
+			t.Error("retired key must not be primary")
+		}
+
+		encrypted, _ := keyring.Encrypt([]byte("p@ssw0rd"))
+		v, _ := FormatEncrypted(encrypted, BASE64)
+		c, err := NewConfigurationFromReader("yaml", strings.NewReader(keys+"password: "+v+"\n"))
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if actual, err := c.GetSecret("password"); err != nil || string(actual.Bytes()) != "p@ssw0rd" {
+			t.Errorf("expected p@ssw0rd, but got %s (err: %v)", actual.Bytes(), err)
+		}
+	})
+
+	t.Run("鍵が読み込めない場合はエラーとなること", func(t *testing.T) {
+		config := "config:\n  secret:\n    keys:\n      - id: \"1\"\n        key_env: CONF_TEST_UNDEFINED_KEY\n"
+		if _, err := NewConfigurationFromReader("yaml", strings.NewReader(config)); err == nil {
+			t.Error("key without key material must be rejected")
+		}
+	})
+}
+
+func TestConfiguration_passphrase(t *testing.T) {
+	os.Setenv("CONF_TEST_PASSPHRASE", "correct horse battery staple")
+	defer os.Unsetenv("CONF_TEST_PASSPHRASE")
+
+	config := "config:\n  secret:\n    passphrase_env: CONF_TEST_PASSPHRASE\n    kdf:\n      algorithm: scrypt\n      memory: 1024\n"
+	c, err := NewConfigurationFromReader("yaml", strings.NewReader(config))
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	encrypted, err := c.SecretCipher().Encrypt([]byte("p@ssw0rd"))
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	v, _ := FormatEncrypted(encrypted, BASE64)
+
+	// ソルトは設定の読み込み毎に異なるが、暗号文に付与されたソルトで復号できる
+	c, err = NewConfigurationFromReader("yaml", strings.NewReader(config+"password: "+v+"\n"))
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	if actual, err := c.GetSecret("password"); err != nil || string(actual.Bytes()) != "p@ssw0rd" {
+		t.Errorf("expected p@ssw0rd, but got %s (err: %v)", actual.Bytes(), err)
+	}
+
+	if _, err := NewConfigurationFromReader("yaml", strings.NewReader(strings.Replace(config, "scrypt", "bcrypt", 1))); err == nil {
+		t.Error("unsupported kdf must be rejected")
+	}
+}
@@ -0,0 +1,168 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// phaseCheckHealth は状態の確認が制限時間を超過した場合の TimeoutError の Phase
+const phaseCheckHealth = "check health of"
+
+// HealthChecker は、初期化後に利用できなくなっていないか (ログファイルに書き込めなくなった等) を確認できる Resource が実装する Interface
+type HealthChecker interface {
+	// ctx の期限までに状態を確認し、正常に利用できない場合はその理由をエラーとして返却する
+	CheckHealth(ctx context.Context) error
+}
+
+// HealthListener は、ResourceManager が集約したリソースの状態の変化を通知される Resource が実装する Interface
+type HealthListener interface {
+	// 最初の確認の後と、いずれかのリソースの状態が変化した後に、変化前の状態 prev と現在の状態 current を通知する
+	OnHealthChanged(prev, current Health)
+}
+
+// ResourceHealth は HealthChecker を実装するリソースの状態を表現する
+type ResourceHealth struct {
+	// リソースの名前
+	Name string `json:"name"`
+	// 正常に利用できるか
+	Healthy bool `json:"healthy"`
+	// 正常に利用できない理由
+	Error string `json:"error,omitempty"`
+}
+
+// Health は ResourceManager が集約したリソースの状態を表現する
+type Health struct {
+	// すべてのリソースが正常に利用できるか
+	Healthy bool `json:"healthy"`
+	// HealthChecker を実装するリソースの状態
+	Resources []ResourceHealth `json:"resources"`
+	// 状態を確認した時刻。一度も確認していない場合はゼロ値となる
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Changed は prev から状態が変化したリソースを返却する。prev に含まれないリソースは、正常であったものとして扱う
+func (h Health) Changed(prev Health) []ResourceHealth {
+	before := make(map[string]bool, len(prev.Resources))
+	for _, r := range prev.Resources {
+		before[r.Name] = r.Healthy
+	}
+	changed := make([]ResourceHealth, 0)
+	for _, r := range h.Resources {
+		healthy, ok := before[r.Name]
+		if !ok {
+			healthy = true
+		}
+		if healthy != r.Healthy {
+			changed = append(changed, r)
+		}
+	}
+	return changed
+}
+
+// healthMonitor は ResourceManager による状態の定期確認を管理する
+type healthMonitor struct {
+	mu      sync.RWMutex
+	current Health
+	// 定期確認の停止を指示する。定期確認を行っていない場合は nil
+	stop chan struct{}
+	// 定期確認の停止の完了時に close される
+	done chan struct{}
+	// 定期確認の間隔と、各リソースの確認の制限時間
+	interval, timeout time.Duration
+}
+
+// StartHealthCheck は、初期化済みのリソースのうち HealthChecker を実装するものの状態を、直ちに、その後は interval 毎に確認する。
+// 各リソースの確認は timeout (0 以下の場合は interval) で打ち切り、制限時間を超過したリソースは利用できないものとする。
+// 最初の確認の後と状態の変化時には、HealthListener を実装する初期化済みのリソースに通知する。
+// interval が 0 以下の場合は確認しない。Initialize の完了後に呼び出す必要があり、FinalizeContext の開始時に停止する
+func (m *ResourceManager) StartHealthCheck(interval, timeout time.Duration) {
+	if interval <= 0 || m.health.stop != nil {
+		return
+	}
+	if timeout <= 0 {
+		timeout = interval
+	}
+
+	checkers := make([]int, 0)
+	listeners := make([]HealthListener, 0)
+	for i, r := range m.resources {
+		if !m.initialized[i] {
+			continue
+		}
+		if _, ok := r.(HealthChecker); ok {
+			checkers = append(checkers, i)
+		}
+		if l, ok := r.(HealthListener); ok {
+			listeners = append(listeners, l)
+		}
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	m.health.stop, m.health.done = stop, done
+	m.health.interval, m.health.timeout = interval, timeout
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for first := true; ; first = false {
+			current := m.checkHealth(checkers, timeout)
+			m.health.mu.Lock()
+			prev := m.health.current
+			m.health.current = current
+			m.health.mu.Unlock()
+
+			if first || len(current.Changed(prev)) > 0 {
+				for _, l := range listeners {
+					l.OnHealthChanged(prev, current)
+				}
+			}
+
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Health は最後に確認したリソースの状態を返却する。一度も確認していない場合は Health のゼロ値を返却する
+func (m *ResourceManager) Health() Health {
+	m.health.mu.RLock()
+	defer m.health.mu.RUnlock()
+	return m.health.current
+}
+
+// checkHealth は、添字が indices であるリソースの状態を並行して確認し、集約した状態を返却する
+func (m *ResourceManager) checkHealth(indices []int, timeout time.Duration) Health {
+	errs := m.parallel(indices, func(i int, r Resource) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return runContext(ctx, r, phaseCheckHealth, func(ctx context.Context, r Resource) error {
+			return r.(HealthChecker).CheckHealth(ctx)
+		}, nil)
+	})
+
+	h := Health{Healthy: true, Resources: make([]ResourceHealth, 0, len(indices)), CheckedAt: time.Now()}
+	for i, j := range indices {
+		rh := ResourceHealth{Name: m.resources[j].Name(), Healthy: errs[i] == nil}
+		if errs[i] != nil {
+			rh.Error = errs[i].Error()
+			h.Healthy = false
+		}
+		h.Resources = append(h.Resources, rh)
+	}
+	return h
+}
+
+// stopHealthCheck は状態の定期確認を停止し、実行中の確認の完了を待つ
+func (m *ResourceManager) stopHealthCheck() {
+	if m.health.stop == nil {
+		return
+	}
+	close(m.health.stop)
+	<-m.health.done
+	m.health.stop, m.health.done = nil, nil
+}
@@ -0,0 +1,159 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 状態を err で切り替えられる HealthChecker
+type checkerResource struct {
+	name string
+	mu   sync.Mutex
+	err  error
+	// true の場合、ctx の期限まで確認を完了しない
+	hang bool
+}
+
+func (r *checkerResource) Initialize() error {
+	return nil
+}
+func (r *checkerResource) Finalize() error {
+	return nil
+}
+func (r *checkerResource) Name() string {
+	return r.name
+}
+func (r *checkerResource) CheckHealth(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return r.err
+}
+func (r *checkerResource) setErr(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+}
+
+// 状態の変化を記録する HealthListener
+type healthListenerResource struct {
+	successResouce
+	notified chan Health
+}
+
+func (r *healthListenerResource) OnHealthChanged(prev, current Health) {
+	r.notified <- current
+}
+
+// waitHealth は l に通知された状態を返却する
+func waitHealth(t *testing.T, l *healthListenerResource) Health {
+	select {
+	case h := <-l.notified:
+		return h
+	case <-time.After(time.Second):
+		t.Fatal("health must be notified")
+	}
+	return Health{}
+}
+
+func TestHealth_Changed(t *testing.T) {
+	prev := Health{Resources: []ResourceHealth{{Name: "log", Healthy: true}, {Name: "stub", Healthy: false}}}
+	current := Health{Resources: []ResourceHealth{
+		{Name: "log", Healthy: false},
+		{Name: "stub", Healthy: false},
+		{Name: "new", Healthy: false},
+		{Name: "recorder", Healthy: true},
+	}}
+	expected := []ResourceHealth{{Name: "log", Healthy: false}, {Name: "new", Healthy: false}}
+	if actual := current.Changed(prev); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, but got %v", expected, actual)
+	}
+}
+
+func TestResourceManager_StartHealthCheck(t *testing.T) {
+	t.Run("状態を定期的に確認し、変化を通知する", func(t *testing.T) {
+		checker := &checkerResource{name: "checker"}
+		listener := &healthListenerResource{notified: make(chan Health, 10)}
+		sut := NewResourceManager([]Resource{checker, listener})
+		if err := sut.Initialize(); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		sut.StartHealthCheck(10*time.Millisecond, time.Second)
+		defer sut.Finalize()
+
+		// 最初の確認は状態によらず通知する
+		if h := waitHealth(t, listener); !h.Healthy || len(h.Resources) != 1 {
+			t.Errorf("checker must be healthy, but got %v", h)
+		}
+
+		checker.setErr(errors.New("broken"))
+		h := waitHealth(t, listener)
+		expected := []ResourceHealth{{Name: "checker", Healthy: false, Error: "broken"}}
+		if h.Healthy || !reflect.DeepEqual(h.Resources, expected) {
+			t.Errorf("expected %v, but got %v", expected, h)
+		}
+		if actual := sut.Health(); actual.Healthy {
+			t.Errorf("aggregated health must be unhealthy, but got %v", actual)
+		}
+
+		checker.setErr(nil)
+		if h := waitHealth(t, listener); !h.Healthy {
+			t.Errorf("checker must recover, but got %v", h)
+		}
+	})
+
+	t.Run("制限時間内に確認できないリソースは利用できないものとする", func(t *testing.T) {
+		checker := &checkerResource{name: "checker", hang: true}
+		listener := &healthListenerResource{notified: make(chan Health, 10)}
+		sut := NewResourceManager([]Resource{checker, listener})
+		if err := sut.Initialize(); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		sut.StartHealthCheck(time.Hour, 10*time.Millisecond)
+		defer sut.Finalize()
+
+		h := waitHealth(t, listener)
+		if h.Healthy || h.Resources[0].Error != "failed to check health of checker: timed out" {
+			t.Errorf("checker must time out, but got %v", h)
+		}
+	})
+
+	t.Run("終了処理の開始時に確認を停止する", func(t *testing.T) {
+		listener := &healthListenerResource{notified: make(chan Health, 10)}
+		sut := NewResourceManager([]Resource{&checkerResource{name: "checker"}, listener})
+		if err := sut.Initialize(); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		sut.StartHealthCheck(5*time.Millisecond, time.Second)
+		waitHealth(t, listener)
+		sut.Finalize()
+
+		// 停止前に送られた通知を読み捨てた後は、通知されない
+		for len(listener.notified) > 0 {
+			<-listener.notified
+		}
+		time.Sleep(20 * time.Millisecond)
+		if len(listener.notified) != 0 {
+			t.Error("health must not be notified after finalize")
+		}
+	})
+
+	t.Run("interval が 0 の場合は確認しない", func(t *testing.T) {
+		sut := NewResourceManager([]Resource{&checkerResource{name: "checker"}})
+		if err := sut.Initialize(); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		sut.StartHealthCheck(0, 0)
+		defer sut.Finalize()
+		if h := sut.Health(); !h.CheckedAt.IsZero() {
+			t.Errorf("health must not be checked, but got %v", h)
+		}
+	})
+}
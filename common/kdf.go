@@ -0,0 +1,322 @@
+package common
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// KDF はパスフレーズから鍵を導出する関数を表現する
+type KDF byte
+
+const (
+	// Pbkdf2 は HMAC-SHA256 による PBKDF2 を表現する
+	Pbkdf2 KDF = iota + 1
+	// Scrypt は scrypt を表現する
+	Scrypt
+	// Argon2id は Argon2id を表現する
+	Argon2id
+)
+
+const (
+	// kdfSaltSize はソルトの長さ
+	kdfSaltSize = 16
+	// kdfKeySize は導出する AES の鍵の長さ (AES-256)
+	kdfKeySize = 32
+	// kdfHeaderSize は暗号文の先頭に付与する、KDF (1 byte)、パラメータ (4 byte * 4)、ソルトの長さ
+	kdfHeaderSize = 1 + 4*4 + kdfSaltSize
+	// kdfCacheSize は、復号のために導出した鍵による暗号を保持する件数
+	kdfCacheSize = 64
+)
+
+// 受け付けるパラメータの上限。復号時は認証タグの検証より前に鍵を導出するため、
+// 暗号文に記録されたパラメータによって、過大な計算資源を消費しないようにする
+const (
+	maxPbkdf2Iterations   = 10000000
+	maxScryptMemory       = 1 << 30 // byte (128 * N * r と 128 * r * p のそれぞれ)
+	maxScryptParallelism  = 16
+	maxArgon2idIterations = 100
+	maxArgon2idMemory     = 256 << 10 // KiB
+)
+
+// String は KDF の名称を返却する
+func (k KDF) String() string {
+	switch k {
+	case Pbkdf2:
+		return "pbkdf2"
+	case Scrypt:
+		return "scrypt"
+	case Argon2id:
+		return "argon2id"
+	}
+	return "unknown"
+}
+
+// ParseKDF は名称 name (pbkdf2, scrypt, argon2id) に対応する KDF を返却する
+func ParseKDF(name string) (KDF, error) {
+	for _, k := range []KDF{Pbkdf2, Scrypt, Argon2id} {
+		if strings.ToLower(name) == k.String() {
+			return k, nil
+		}
+	}
+	return 0, errors.Errorf("unsupported kdf [%s]", name)
+}
+
+// KDFParams は鍵の導出に用いる KDF とそのコストを表現する。利用しないパラメータは 0 とする
+type KDFParams struct {
+	KDF KDF
+	// PBKDF2 の反復回数、または Argon2id の反復回数 (time)
+	Iterations uint32
+	// scrypt の N (CPU/メモリコスト、2 のべき乗)、または Argon2id のメモリサイズ (KiB)
+	Memory uint32
+	// scrypt の r (ブロックサイズ)
+	BlockSize uint32
+	// scrypt の p、または Argon2id の並列度
+	Parallelism uint32
+}
+
+// DefaultKDFParams は kdf の推奨パラメータを返却する
+func DefaultKDFParams(kdf KDF) KDFParams {
+	switch kdf {
+	case Pbkdf2:
+		return DefaultPbkdf2Params
+	case Scrypt:
+		return DefaultScryptParams
+	}
+	return DefaultArgon2idParams
+}
+
+var (
+	// DefaultPbkdf2Params は PBKDF2 の推奨パラメータ (OWASP 2023, HMAC-SHA256)
+	DefaultPbkdf2Params = KDFParams{KDF: Pbkdf2, Iterations: 600000}
+	// DefaultScryptParams は scrypt の推奨パラメータ
+	DefaultScryptParams = KDFParams{KDF: Scrypt, Memory: 1 << 15, BlockSize: 8, Parallelism: 1}
+	// DefaultArgon2idParams は Argon2id の推奨パラメータ (RFC 9106 の 2 つ目の推奨値)
+	DefaultArgon2idParams = KDFParams{KDF: Argon2id, Iterations: 3, Memory: 64 * 1024, Parallelism: 4}
+)
+
+// validate は p が鍵の導出に利用でき、受け付けるパラメータの上限を超えていないかを検証する。
+// 暗号化したパラメータで必ず復号できるよう、暗号化時と復号時で同じ上限とする
+func (p KDFParams) validate() error {
+	switch p.KDF {
+	case Pbkdf2:
+		if p.Iterations == 0 || p.Iterations > maxPbkdf2Iterations {
+			return errors.Errorf("illegal pbkdf2 iterations [%d]", p.Iterations)
+		}
+	case Scrypt:
+		if p.Memory < 2 || p.Memory&(p.Memory-1) != 0 || p.BlockSize == 0 || p.Parallelism == 0 {
+			return errors.Errorf("illegal scrypt parameters N=%d, r=%d, p=%d", p.Memory, p.BlockSize, p.Parallelism)
+		}
+		if p.Parallelism > maxScryptParallelism ||
+			uint64(p.Memory)*uint64(p.BlockSize)*128 > maxScryptMemory ||
+			uint64(p.BlockSize)*uint64(p.Parallelism)*128 > maxScryptMemory {
+			return errors.Errorf("scrypt parameters N=%d, r=%d, p=%d exceed the limit", p.Memory, p.BlockSize, p.Parallelism)
+		}
+	case Argon2id:
+		if p.Iterations == 0 || p.Parallelism == 0 || p.Parallelism > 255 || p.Memory < 8*p.Parallelism {
+			return errors.Errorf("illegal argon2id parameters time=%d, memory=%d, threads=%d", p.Iterations, p.Memory, p.Parallelism)
+		}
+		if p.Iterations > maxArgon2idIterations || p.Memory > maxArgon2idMemory {
+			return errors.Errorf("argon2id parameters time=%d, memory=%d exceed the limit", p.Iterations, p.Memory)
+		}
+	default:
+		return errors.Errorf("unsupported kdf [%d]", p.KDF)
+	}
+	return nil
+}
+
+// deriveKey は passphrase と salt から AES-256 の鍵を導出する
+func (p KDFParams) deriveKey(passphrase, salt []byte) ([]byte, error) {
+	switch p.KDF {
+	case Pbkdf2:
+		return pbkdf2.Key(passphrase, salt, int(p.Iterations), kdfKeySize, sha256.New), nil
+	case Scrypt:
+		key, err := scrypt.Key(passphrase, salt, int(p.Memory), int(p.BlockSize), int(p.Parallelism), kdfKeySize)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to derive key with scrypt")
+		}
+		return key, nil
+	case Argon2id:
+		return argon2.IDKey(passphrase, salt, p.Iterations, p.Memory, uint8(p.Parallelism), kdfKeySize), nil
+	}
+	return nil, errors.Errorf("unsupported kdf [%d]", p.KDF)
+}
+
+// header は p と salt を暗号文の先頭に付与する形式で返却する
+func (p KDFParams) header(salt []byte) []byte {
+	h := make([]byte, kdfHeaderSize)
+	h[0] = byte(p.KDF)
+	binary.BigEndian.PutUint32(h[1:], p.Iterations)
+	binary.BigEndian.PutUint32(h[5:], p.Memory)
+	binary.BigEndian.PutUint32(h[9:], p.BlockSize)
+	binary.BigEndian.PutUint32(h[13:], p.Parallelism)
+	copy(h[17:], salt)
+	return h
+}
+
+// parseKDFHeader は暗号文の先頭からパラメータとソルトを読み取る
+func parseKDFHeader(h []byte) (KDFParams, []byte) {
+	return KDFParams{
+		KDF:         KDF(h[0]),
+		Iterations:  binary.BigEndian.Uint32(h[1:]),
+		Memory:      binary.BigEndian.Uint32(h[5:]),
+		BlockSize:   binary.BigEndian.Uint32(h[9:]),
+		Parallelism: binary.BigEndian.Uint32(h[13:]),
+	}, h[17:kdfHeaderSize]
+}
+
+// PassphraseCipher は、パスフレーズから導出した鍵による AES/GCM の認証付き暗号を表現する。
+// 暗号文の先頭に KDF のパラメータとソルトを付与するため、同じパスフレーズがあれば、パラメータを変更した後も復号できる。
+// パラメータとソルトは追加認証データとして改竄を検知する
+type PassphraseCipher struct {
+	passphrase []byte
+	params     KDFParams
+	// 暗号化に用いるソルトと、導出した鍵による暗号
+	header []byte
+	cipher *AesGcmCipher
+
+	mu sync.Mutex
+	// 復号に用いた暗号を、最近使用した順に kdfCacheSize 件まで保持する。
+	// 暗号文毎にソルトが異なるため、同じ暗号文を繰り返し復号する場合に鍵の導出を省略する
+	ciphers map[string]*list.Element
+	recents *list.List
+}
+
+// cachedCipher は、ヘッダ header のパラメータとソルトで導出した鍵による暗号を表現する
+type cachedCipher struct {
+	header string
+	cipher *AesGcmCipher
+}
+
+// NewPassphraseCipher は、passphrase から params に従って鍵を導出する PassphraseCipher を作成し、返却する。
+// ソルトは作成時にランダムに生成し、以降の暗号化で共有する
+func NewPassphraseCipher(passphrase []byte, params KDFParams) (*PassphraseCipher, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase must not be empty")
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	salt := make([]byte, kdfSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, errors.Wrap(err, "failed to generate salt")
+	}
+
+	c := &PassphraseCipher{passphrase: passphrase, params: params, header: params.header(salt)}
+	var err error
+	if c.cipher, err = c.newCipher(params, salt); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewPbkdf2Cipher は、passphrase から PBKDF2 (HMAC-SHA256, 反復回数 iterations) で鍵を導出する PassphraseCipher を返却する
+func NewPbkdf2Cipher(passphrase []byte, iterations uint32) (*PassphraseCipher, error) {
+	return NewPassphraseCipher(passphrase, KDFParams{KDF: Pbkdf2, Iterations: iterations})
+}
+
+// NewScryptCipher は、passphrase から scrypt (コストパラメータ n, r, p) で鍵を導出する PassphraseCipher を返却する
+func NewScryptCipher(passphrase []byte, n, r, p uint32) (*PassphraseCipher, error) {
+	return NewPassphraseCipher(passphrase, KDFParams{KDF: Scrypt, Memory: n, BlockSize: r, Parallelism: p})
+}
+
+// NewArgon2idCipher は、passphrase から Argon2id (反復回数 time, メモリサイズ memory KiB, 並列度 threads) で鍵を導出する PassphraseCipher を返却する
+func NewArgon2idCipher(passphrase []byte, time, memory uint32, threads uint8) (*PassphraseCipher, error) {
+	return NewPassphraseCipher(passphrase, KDFParams{KDF: Argon2id, Iterations: time, Memory: memory, Parallelism: uint32(threads)})
+}
+
+// newCipher は params と salt でパスフレーズから導出した鍵による AES/GCM の暗号を返却する
+func (c *PassphraseCipher) newCipher(params KDFParams, salt []byte) (*AesGcmCipher, error) {
+	key, err := params.deriveKey(c.passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	return NewAesGcmCipher(key)
+}
+
+// Encrypt は plain を暗号化し、KDF のパラメータとソルト、nonce、暗号文、認証タグを連結して返却する
+func (c *PassphraseCipher) Encrypt(plain []byte) ([]byte, error) {
+	encrypted, err := c.cipher.EncryptWithAdditionalData(plain, c.header)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, c.header...), encrypted...), nil
+}
+
+// Decrypt は、encrypted に付与されたパラメータとソルトでパスフレーズから鍵を導出し、復号化する。
+// 改竄を検知した場合、またはパスフレーズが異なる場合は *AuthenticationError を返却する
+func (c *PassphraseCipher) Decrypt(encrypted []byte) ([]byte, error) {
+	if len(encrypted) < kdfHeaderSize {
+		return nil, ErrInvalidLength
+	}
+	header := encrypted[:kdfHeaderSize]
+
+	gcm, err := c.cipherFor(header)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.DecryptWithAdditionalData(encrypted[kdfHeaderSize:], header)
+}
+
+// cipherFor は、ヘッダ header のパラメータとソルトで導出した鍵による暗号を返却する。
+// 鍵の導出は時間を要するため、導出中も他のヘッダの暗号を参照できるよう、ロックを解放して行う
+func (c *PassphraseCipher) cipherFor(header []byte) (*AesGcmCipher, error) {
+	if bytes.Equal(header, c.header) {
+		return c.cipher, nil
+	}
+	if gcm, ok := c.cached(string(header)); ok {
+		return gcm, nil
+	}
+
+	params, salt := parseKDFHeader(header)
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	gcm, err := c.newCipher(params, salt)
+	if err != nil {
+		return nil, err
+	}
+	c.store(string(header), gcm)
+	return gcm, nil
+}
+
+// cached は、ヘッダ header に対して保持している暗号を返却する
+func (c *PassphraseCipher) cached(header string) (*AesGcmCipher, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.ciphers[header]
+	if !ok {
+		return nil, false
+	}
+	c.recents.MoveToFront(e)
+	return e.Value.(*cachedCipher).cipher, true
+}
+
+// store は、ヘッダ header に対する暗号 gcm を保持する。保持する件数が kdfCacheSize を超える場合は、最も使用されていない暗号を破棄する
+func (c *PassphraseCipher) store(header string, gcm *AesGcmCipher) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ciphers == nil {
+		c.ciphers, c.recents = make(map[string]*list.Element), list.New()
+	}
+	if e, ok := c.ciphers[header]; ok {
+		c.recents.MoveToFront(e)
+		return
+	}
+	c.ciphers[header] = c.recents.PushFront(&cachedCipher{header: header, cipher: gcm})
+	if c.recents.Len() > kdfCacheSize {
+		oldest := c.recents.Back()
+		c.recents.Remove(oldest)
+		delete(c.ciphers, oldest.Value.(*cachedCipher).header)
+	}
+}
@@ -0,0 +1,141 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPassphraseCipherImplementsBlockCipher(t *testing.T) {
+	var _ BlockCipher = &PassphraseCipher{}
+}
+
+// テストでは計算量を抑えたパラメータを用いる
+var testKDFParams = []KDFParams{
+	{KDF: Pbkdf2, Iterations: 1000},
+	{KDF: Scrypt, Memory: 1 << 10, BlockSize: 8, Parallelism: 1},
+	{KDF: Argon2id, Iterations: 1, Memory: 1024, Parallelism: 1},
+}
+
+func TestPassphraseCipher(t *testing.T) {
+	for _, params := range testKDFParams {
+		t.Run(params.KDF.String(), func(t *testing.T) {
+			sut, err := NewPassphraseCipher([]byte("passphrase"), params)
+			if err != nil {
+				t.Fatalf("err must be nil, but got %s", err)
+			}
+			encrypted, err := sut.Encrypt([]byte("plain"))
+			if err != nil {
+				t.Fatalf("err must be nil, but got %s", err)
+			}
+			if actual, _ := parseKDFHeader(encrypted[:kdfHeaderSize]); actual != params {
+				t.Errorf("expected %v, but got %v", params, actual)
+			}
+
+			// 同じパスフレーズであれば、ソルトやパラメータが異なっても復号できる
+			other, err := NewPassphraseCipher([]byte("passphrase"), testKDFParams[(int(params.KDF))%len(testKDFParams)])
+			if err != nil {
+				t.Fatalf("err must be nil, but got %s", err)
+			}
+			for _, c := range []*PassphraseCipher{sut, other} {
+				if plain, err := c.Decrypt(encrypted); err != nil || string(plain) != "plain" {
+					t.Errorf("expected plain, but got %s (err: %v)", plain, err)
+				}
+			}
+
+			wrong, _ := NewPassphraseCipher([]byte("wrong"), params)
+			if _, err := wrong.Decrypt(encrypted); err == nil {
+				t.Error("wrong passphrase must be rejected")
+			}
+			// パラメータの改竄
+			tampered := append([]byte{}, encrypted...)
+			tampered[4]++
+			if _, err := other.Decrypt(tampered); err == nil {
+				t.Error("tampered parameters must be rejected")
+			}
+		})
+	}
+}
+
+func TestNewPassphraseCipherIllegalParams(t *testing.T) {
+	for _, params := range []KDFParams{
+		{KDF: Pbkdf2},
+		{KDF: Scrypt, Memory: 1000, BlockSize: 8, Parallelism: 1},
+		{KDF: Scrypt, Memory: 1024, Parallelism: 1},
+		{KDF: Argon2id, Iterations: 1, Memory: 4, Parallelism: 1},
+		{KDF: Argon2id, Iterations: 1, Memory: 1024, Parallelism: 256},
+		{KDF: 0, Iterations: 1},
+	} {
+		if _, err := NewPassphraseCipher([]byte("passphrase"), params); err == nil {
+			t.Errorf("illegal params must be rejected: %v", params)
+		}
+	}
+	if _, err := NewPbkdf2Cipher(nil, 1000); err == nil {
+		t.Error("empty passphrase must be rejected")
+	}
+
+	// 上限を超えるパラメータの暗号文は、鍵を導出せずに拒否する
+	sut, _ := NewArgon2idCipher([]byte("passphrase"), 1, 1024, 1)
+	for _, huge := range []KDFParams{
+		{KDF: Pbkdf2, Iterations: maxPbkdf2Iterations + 1},
+		// x/crypto/scrypt の r*p < 2^30 の検証は通過し、p*128*r byte (64 GiB) を確保するパラメータ
+		{KDF: Scrypt, Memory: 1 << 15, BlockSize: 8, Parallelism: 1 << 26},
+		{KDF: Scrypt, Memory: 1 << 15, BlockSize: 8, Parallelism: maxScryptParallelism + 1},
+		{KDF: Scrypt, Memory: 1 << 20, BlockSize: 16, Parallelism: 1},
+		{KDF: Argon2id, Iterations: 1, Memory: 4 << 20, Parallelism: 1},
+		{KDF: Argon2id, Iterations: 1, Memory: maxArgon2idMemory + 1, Parallelism: 1},
+		{KDF: Argon2id, Iterations: maxArgon2idIterations + 1, Memory: 1024, Parallelism: 1},
+	} {
+		_, err := sut.Decrypt(append(huge.header(make([]byte, kdfSaltSize)), make([]byte, 32)...))
+		if err == nil || !strings.Contains(err.Error(), "exceed the limit") && !strings.Contains(err.Error(), "illegal") {
+			t.Errorf("params exceeding the limit must be rejected before deriving key: %v, but got %v", huge, err)
+		}
+		// 復号できない暗号文を作成しないよう、暗号化時も同じ上限とする
+		if _, err := NewPassphraseCipher([]byte("passphrase"), huge); err == nil {
+			t.Errorf("params exceeding the limit must be rejected: %v", huge)
+		}
+	}
+	if _, err := sut.Decrypt(make([]byte, kdfHeaderSize-1)); err != ErrInvalidLength {
+		t.Errorf("expected ErrInvalidLength, but got %v", err)
+	}
+}
+
+func TestPassphraseCipherCache(t *testing.T) {
+	params := KDFParams{KDF: Pbkdf2, Iterations: 1}
+	sut, err := NewPassphraseCipher([]byte("passphrase"), params)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	// ソルトの異なる暗号文を kdfCacheSize + 2 件作成する
+	encrypted := make([][]byte, kdfCacheSize+2)
+	for i := range encrypted {
+		c, err := NewPassphraseCipher([]byte("passphrase"), params)
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if encrypted[i], err = c.Encrypt([]byte("plain")); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+	}
+	decrypt := func(i int) {
+		if plain, err := sut.Decrypt(encrypted[i]); err != nil || string(plain) != "plain" {
+			t.Errorf("expected plain, but got %s (err: %v)", plain, err)
+		}
+	}
+	cached := func(i int) bool {
+		_, ok := sut.ciphers[string(encrypted[i][:kdfHeaderSize])]
+		return ok
+	}
+
+	for i := 0; i < kdfCacheSize; i++ {
+		decrypt(i)
+	}
+	// 最初の暗号文を使用したため、次に破棄されるのは 2 件目の暗号文となる
+	decrypt(0)
+	decrypt(kdfCacheSize)
+	if len(sut.ciphers) != kdfCacheSize || sut.recents.Len() != kdfCacheSize {
+		t.Errorf("expected %d ciphers, but got %d", kdfCacheSize, len(sut.ciphers))
+	}
+	if !cached(0) || cached(1) || !cached(kdfCacheSize) {
+		t.Error("least recently used cipher must be evicted")
+	}
+}
@@ -0,0 +1,203 @@
+package common
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Algorithm は Keyring が暗号文に付与する、暗号化アルゴリズムの版数を表現する
+type Algorithm byte
+
+const (
+	// AesGcm はランダムな nonce による AES/GCM を表現する
+	AesGcm Algorithm = iota + 1
+	// AesCbcPkcs7 はランダムな初期ベクトルによる AES/CBC/PKCS#7 を表現する
+	AesCbcPkcs7
+)
+
+// String は Algorithm の名称を返却する
+func (a Algorithm) String() string {
+	switch a {
+	case AesGcm:
+		return "aes-gcm"
+	case AesCbcPkcs7:
+		return "aes-cbc"
+	}
+	return "unknown"
+}
+
+// ParseAlgorithm は名称 name (aes-gcm, aes-cbc) に対応する Algorithm を返却する。name が空の場合は AesGcm を返却する
+func ParseAlgorithm(name string) (Algorithm, error) {
+	switch strings.ToLower(name) {
+	case "", AesGcm.String():
+		return AesGcm, nil
+	case AesCbcPkcs7.String():
+		return AesCbcPkcs7, nil
+	}
+	return 0, errors.Errorf("unsupported algorithm [%s]", name)
+}
+
+// NewCipher は key を鍵とする、アルゴリズム a のブロック暗号を返却する
+func (a Algorithm) NewCipher(key []byte) (BlockCipher, error) {
+	switch a {
+	case AesGcm:
+		c, err := NewAesGcmCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case AesCbcPkcs7:
+		c, err := NewAesCbcPkcs7CipherWithRandomIV(key)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	return nil, errors.Errorf("unsupported algorithm [%d]", a)
+}
+
+// keyringKey は Keyring に登録された鍵を表現する
+type keyringKey struct {
+	id        string
+	algorithm Algorithm
+	cipher    BlockCipher
+	// 退役済みの鍵は復号にのみ用いる
+	retired bool
+}
+
+// Keyring は複数の鍵を保持し、鍵の更新 (ローテーション) を可能にする BlockCipher。
+// 暗号化には常にプライマリの鍵を用い、暗号文の先頭にアルゴリズムの版数と鍵 ID を付与する。
+// 復号時は暗号文の鍵 ID に対応する鍵を用いるため、退役済みの鍵で暗号化された暗号文も復号できる。
+//
+// 暗号文の形式は、アルゴリズムの版数 (1 byte)、鍵 ID の長さ (1 byte)、鍵 ID、鍵による暗号文を連結したものとなる
+type Keyring struct {
+	keys    map[string]*keyringKey
+	primary *keyringKey
+}
+
+// NewKeyring は鍵を持たない Keyring を返却する
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string]*keyringKey)}
+}
+
+// AddKey は、id を鍵 ID とし、key を鍵とするアルゴリズム algorithm の鍵を登録する。
+// retired が true の場合、その鍵は退役済みとして復号にのみ用いる。
+// 最初に登録した退役済みでない鍵がプライマリとなる
+func (k *Keyring) AddKey(id string, algorithm Algorithm, key []byte, retired bool) error {
+	if id == "" || len(id) > 255 {
+		return errors.Errorf("key id must be 1 to 255 bytes, but got [%s]", id)
+	}
+	if _, ok := k.keys[id]; ok {
+		return errors.Errorf("key [%s] is already registered", id)
+	}
+	c, err := algorithm.NewCipher(key)
+	if err != nil {
+		return errors.Wrapf(err, "illegal key [%s]", id)
+	}
+
+	entry := &keyringKey{id: id, algorithm: algorithm, cipher: c, retired: retired}
+	k.keys[id] = entry
+	if k.primary == nil && !retired {
+		k.primary = entry
+	}
+	return nil
+}
+
+// SetPrimary は鍵 ID が id の鍵を、暗号化に用いるプライマリの鍵とする
+func (k *Keyring) SetPrimary(id string) error {
+	entry, ok := k.keys[id]
+	if !ok {
+		return errors.Errorf("key [%s] is not registered", id)
+	}
+	if entry.retired {
+		return errors.Errorf("retired key [%s] cannot be primary", id)
+	}
+	k.primary = entry
+	return nil
+}
+
+// Primary はプライマリの鍵の鍵 ID を返却する。プライマリの鍵がない場合は空文字列を返却する
+func (k *Keyring) Primary() string {
+	if k.primary == nil {
+		return ""
+	}
+	return k.primary.id
+}
+
+// KeyIDs は登録されている鍵の鍵 ID を昇順で返却する
+func (k *Keyring) KeyIDs() []string {
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Encrypt は plain をプライマリの鍵で暗号化し、アルゴリズムの版数と鍵 ID を付与して返却する
+func (k *Keyring) Encrypt(plain []byte) ([]byte, error) {
+	if k.primary == nil {
+		return nil, errors.New("keyring has no primary key")
+	}
+	encrypted, err := k.primary.cipher.Encrypt(plain)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte{byte(k.primary.algorithm), byte(len(k.primary.id))}, k.primary.id...)
+	return append(header, encrypted...), nil
+}
+
+// Decrypt は、Encrypt で暗号化された encrypted を、付与された鍵 ID に対応する鍵で復号化する
+func (k *Keyring) Decrypt(encrypted []byte) ([]byte, error) {
+	entry, body, err := k.parse(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	return entry.cipher.Decrypt(body)
+}
+
+// KeyID は、Encrypt で暗号化された encrypted に付与された鍵 ID を返却する
+func (k *Keyring) KeyID(encrypted []byte) (string, error) {
+	entry, _, err := k.parse(encrypted)
+	if err != nil {
+		return "", err
+	}
+	return entry.id, nil
+}
+
+// Reencrypt は、encrypted を復号化し、プライマリの鍵で暗号化し直す。
+// 保存済みの暗号文を新しい鍵に移行するために用い、既にプライマリの鍵で暗号化されている場合は encrypted をそのまま返却する
+func (k *Keyring) Reencrypt(encrypted []byte) ([]byte, error) {
+	entry, body, err := k.parse(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if entry == k.primary {
+		return encrypted, nil
+	}
+	plain, err := entry.cipher.Decrypt(body)
+	if err != nil {
+		return nil, err
+	}
+	return k.Encrypt(plain)
+}
+
+// parse は encrypted からアルゴリズムの版数と鍵 ID を読み取り、対応する鍵と、鍵による暗号文を返却する
+func (k *Keyring) parse(encrypted []byte) (*keyringKey, []byte, error) {
+	if len(encrypted) < 2 || len(encrypted) < 2+int(encrypted[1]) {
+		return nil, nil, ErrInvalidLength
+	}
+	algorithm, id := Algorithm(encrypted[0]), string(encrypted[2:2+int(encrypted[1])])
+
+	entry, ok := k.keys[id]
+	if !ok {
+		return nil, nil, errors.Errorf("unknown key [%s]", id)
+	}
+	if entry.algorithm != algorithm {
+		return nil, nil, errors.Errorf("algorithm [%s] does not match key [%s]", algorithm, id)
+	}
+	return entry, encrypted[2+len(id):], nil
+}
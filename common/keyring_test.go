@@ -0,0 +1,130 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyringImplementsBlockCipher(t *testing.T) {
+	var _ BlockCipher = &Keyring{}
+}
+
+func TestParseAlgorithm(t *testing.T) {
+	for _, a := range []Algorithm{AesGcm, AesCbcPkcs7} {
+		actual, err := ParseAlgorithm(a.String())
+		if err != nil || actual != a {
+			t.Errorf("expected %s, but got %s (err: %v)", a, actual, err)
+		}
+	}
+	if _, err := ParseAlgorithm("des"); err == nil {
+		t.Error("unsupported algorithm must be rejected")
+	}
+}
+
+// newKeyring は、退役済みの鍵 old (AES/CBC) とプライマリの鍵 new (AES/GCM) を持つ Keyring を返却する
+func newKeyring(t *testing.T) *Keyring {
+	sut := NewKeyring()
+	if err := sut.AddKey("new", AesGcm, bytes.Repeat([]byte{0x01}, 32), false); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	if err := sut.AddKey("old", AesCbcPkcs7, bytes.Repeat([]byte{0x02}, 16), true); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	return sut
+}
+
+func TestKeyring(t *testing.T) {
+	sut := newKeyring(t)
+
+	t.Run("プライマリの鍵で暗号化し、鍵 ID とアルゴリズムを付与する", func(t *testing.T) {
+		encrypted, err := sut.Encrypt([]byte("plain"))
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if encrypted[0] != byte(AesGcm) || !bytes.Equal(encrypted[1:5], []byte("\x03new")) {
+			t.Errorf("unexpected header [%x]", encrypted[:5])
+		}
+		if id, err := sut.KeyID(encrypted); err != nil || id != "new" {
+			t.Errorf("expected new, but got %s (err: %v)", id, err)
+		}
+		if plain, err := sut.Decrypt(encrypted); err != nil || string(plain) != "plain" {
+			t.Errorf("expected plain, but got %s (err: %v)", plain, err)
+		}
+	})
+
+	t.Run("退役済みの鍵で暗号化された暗号文を復号し、プライマリの鍵で暗号化し直す", func(t *testing.T) {
+		old := NewKeyring()
+		old.AddKey("old", AesCbcPkcs7, bytes.Repeat([]byte{0x02}, 16), false)
+		encrypted, err := old.Encrypt([]byte("plain"))
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+
+		if plain, err := sut.Decrypt(encrypted); err != nil || string(plain) != "plain" {
+			t.Errorf("expected plain, but got %s (err: %v)", plain, err)
+		}
+		reencrypted, err := sut.Reencrypt(encrypted)
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if id, _ := sut.KeyID(reencrypted); id != "new" {
+			t.Errorf("expected new, but got %s", id)
+		}
+		if plain, err := sut.Decrypt(reencrypted); err != nil || string(plain) != "plain" {
+			t.Errorf("expected plain, but got %s (err: %v)", plain, err)
+		}
+		// プライマリの鍵で暗号化済みの場合はそのまま返却する
+		if again, err := sut.Reencrypt(reencrypted); err != nil || !bytes.Equal(again, reencrypted) {
+			t.Errorf("ciphertext of primary key must be returned as is (err: %v)", err)
+		}
+	})
+
+	t.Run("プライマリの鍵を切り替える", func(t *testing.T) {
+		sut := newKeyring(t)
+		if err := sut.SetPrimary("old"); err == nil {
+			t.Error("retired key must not be primary")
+		}
+		if err := sut.AddKey("newer", AesGcm, bytes.Repeat([]byte{0x03}, 32), false); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if err := sut.SetPrimary("newer"); err != nil || sut.Primary() != "newer" {
+			t.Errorf("expected newer, but got %s (err: %v)", sut.Primary(), err)
+		}
+		if expected, actual := []string{"new", "newer", "old"}, sut.KeyIDs(); len(actual) != 3 || actual[0] != expected[0] || actual[2] != expected[2] {
+			t.Errorf("expected %s, but got %s", expected, actual)
+		}
+	})
+
+	t.Run("不正な暗号文", func(t *testing.T) {
+		encrypted, _ := sut.Encrypt([]byte("plain"))
+		unknown := append([]byte{byte(AesGcm), 3}, []byte("foo")...)
+		algorithm := append([]byte{byte(AesCbcPkcs7)}, encrypted[1:]...)
+		for name, b := range map[string][]byte{
+			"空":          {},
+			"鍵 ID が途中まで": encrypted[:3],
+			"未知の鍵":       append(unknown, encrypted[5:]...),
+			"アルゴリズムが不一致": algorithm,
+		} {
+			if _, err := sut.Decrypt(b); err == nil {
+				t.Errorf("%s: illegal ciphertext must be rejected", name)
+			}
+		}
+	})
+
+	t.Run("不正な鍵の登録", func(t *testing.T) {
+		sut := NewKeyring()
+		if _, err := sut.Encrypt([]byte("plain")); err == nil {
+			t.Error("keyring without primary key must fail to encrypt")
+		}
+		if err := sut.AddKey("", AesGcm, bytes.Repeat([]byte{0x01}, 32), false); err == nil {
+			t.Error("empty key id must be rejected")
+		}
+		if err := sut.AddKey("short", AesGcm, []byte{0x01}, false); err == nil {
+			t.Error("illegal key length must be rejected")
+		}
+		sut.AddKey("dup", AesGcm, bytes.Repeat([]byte{0x01}, 32), false)
+		if err := sut.AddKey("dup", AesGcm, bytes.Repeat([]byte{0x01}, 32), false); err == nil {
+			t.Error("duplicated key id must be rejected")
+		}
+	})
+}
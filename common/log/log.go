@@ -1,9 +1,12 @@
 package log
 
 import (
+	"context"
 	"io"
 	"os"
+	"strings"
 
+	"github.com/kiririmode/grpc-sandbox/common"
 	"github.com/kiririmode/grpc-sandbox/common/conf"
 	rotatelogs "github.com/lestrrat/go-file-rotatelogs"
 	"github.com/pkg/errors"
@@ -15,6 +18,8 @@ type Log struct {
 	config *conf.Configuration
 	rl     *rotatelogs.RotateLogs
 	Logger *logrus.Logger
+	// 設定の再読み込みの購読
+	subscriptions []*conf.Subscription
 }
 
 // NewLog は、設定 c に基いた新しい Log オブジェクトを返却する
@@ -29,6 +34,11 @@ func (l *Log) Name() string {
 	return "log"
 }
 
+// Dependencies は、ログの設定を読み込む configuration に依存することを返却する
+func (l *Log) Dependencies() []string {
+	return []string{l.config.Name()}
+}
+
 // Initialize はログの初期化を行う
 func (l *Log) Initialize() error {
 
@@ -45,6 +55,7 @@ func (l *Log) Initialize() error {
 	}
 
 	l.rl, l.Logger = rl, logger
+	l.subscribe()
 	return nil
 }
 
@@ -73,31 +84,103 @@ func (l *Log) initializeLogrus(writer io.Writer) (*logrus.Logger, error) {
 	logger.SetOutput(writer)
 
 	// ログフォーマット
-	var formatter logrus.Formatter
-	f := l.config.GetString("log.format")
-	switch f {
-	case "json":
-		formatter = &logrus.JSONFormatter{}
-	case "text":
-		formatter = &logrus.TextFormatter{FullTimestamp: true, QuoteEmptyFields: true}
-	default:
-		return nil, errors.Errorf("illegal log format [%s], specify \"text\" or \"json\" with \"log.format\" key", f)
+	formatter, err := newFormatter(l.config.GetString("log.format"))
+	if err != nil {
+		return nil, err
 	}
 	logger.SetFormatter(formatter)
 
 	// ログレベル
-	v := l.config.GetString("log.level")
-	level, err := logrus.ParseLevel(v)
+	level, err := parseLevel(l.config.GetString("log.level"))
 	if err != nil {
-		return nil, errors.Errorf("illegal log level [%s]", v)
+		return nil, err
 	}
 	logger.SetLevel(level)
 
 	return logger, nil
 }
 
-// Finalize は終了処理として、開いていたリソースを close する
+// newFormatter は log.format の設定値 f に対応する logrus.Formatter を返却する
+func newFormatter(f string) (logrus.Formatter, error) {
+	switch f {
+	case "json":
+		return &logrus.JSONFormatter{}, nil
+	case "text":
+		return &logrus.TextFormatter{FullTimestamp: true, QuoteEmptyFields: true}, nil
+	}
+	return nil, errors.Errorf("illegal log format [%s], specify \"text\" or \"json\" with \"log.format\" key", f)
+}
+
+// parseLevel は log.level の設定値 v をログレベルに変換する
+func parseLevel(v string) (logrus.Level, error) {
+	level, err := logrus.ParseLevel(v)
+	if err != nil {
+		return level, errors.Errorf("illegal log level [%s]", v)
+	}
+	return level, nil
+}
+
+// subscribe は設定の再読み込みを購読し、log.level と log.format の変更を Logger に反映する。
+// 不正な値への変更は再読み込みごと破棄され、再読み込みの失敗と変更された設定項目はログに出力する
+func (l *Log) subscribe() {
+	validator := l.config.AddValidator("log", func(next *conf.Configuration) error {
+		if _, err := newFormatter(next.GetString("log.format")); err != nil {
+			return err
+		}
+		_, err := parseLevel(next.GetString("log.level"))
+		return err
+	})
+	onError := l.config.OnReloadError(func(err error) {
+		l.Logger.Errorf("failed to reload configuration, keeping current configuration: %s", err)
+	})
+	onReload := l.config.Subscribe("", func(e *conf.ChangeEvent) {
+		l.Logger.Infof("configuration reloaded: %s", strings.Join(e.Keys(), ", "))
+	})
+	onChange := l.config.Subscribe("log", func(e *conf.ChangeEvent) {
+		if e.Changed("log.format") {
+			formatter, _ := newFormatter(l.config.GetString("log.format"))
+			l.Logger.SetFormatter(formatter)
+		}
+		if e.Changed("log.level") {
+			level, _ := parseLevel(l.config.GetString("log.level"))
+			l.Logger.SetLevel(level)
+		}
+		if e.Changed("log.basename") || e.Changed("log.rotation_interval") || e.Changed("log.rotation_counts") || e.Changed("log.output_stdout") {
+			l.Logger.Warn("changes of log output are applied after restart")
+		}
+	})
+	l.subscriptions = []*conf.Subscription{validator, onError, onReload, onChange}
+}
+
+// CheckHealth は、現在のログファイルに書き込めるかを確認する。ログファイルがまだ作成されていない場合は確認しない
+func (l *Log) CheckHealth(ctx context.Context) error {
+	name := l.rl.CurrentFileName()
+	if name == "" {
+		return nil
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return errors.Wrap(err, "log file is not writable")
+	}
+	return f.Close()
+}
+
+// OnHealthChanged は、状態が変化したリソースをログに出力する
+func (l *Log) OnHealthChanged(prev, current common.Health) {
+	for _, r := range current.Changed(prev) {
+		if r.Healthy {
+			l.Logger.Infof("resource %s recovered", r.Name)
+		} else {
+			l.Logger.Warnf("resource %s is unhealthy: %s", r.Name, r.Error)
+		}
+	}
+}
+
+// Finalize は終了処理として、設定の再読み込みの購読を解除し、開いていたリソースを close する
 func (l *Log) Finalize() error {
+	for _, s := range l.subscriptions {
+		s.Unsubscribe()
+	}
 	err := l.rl.Close()
 	if err != nil {
 		return errors.Wrap(err, "failed to close rotatelog")
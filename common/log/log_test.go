@@ -1,7 +1,9 @@
 package log
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -98,3 +100,54 @@ func TestLog_initializeLogrus(t *testing.T) {
 		}
 	})
 }
+
+func TestLog_reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(level, format string) {
+		config := fmt.Sprintf("log:\n  basename: %s\n  level: %s\n  format: %s\n", filepath.Join(dir, "test.log"), level, format)
+		if err := ioutil.WriteFile(filepath.Join(dir, "reload.yaml"), []byte(config), 0644); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+	}
+	write("info", "json")
+	c := conf.NewConfiguration("logtest", "reload", []string{dir})
+	if err := c.Initialize(); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	log := NewLog(c)
+	if err := log.Initialize(); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	defer log.Finalize()
+
+	t.Run("ログレベルとフォーマットの変更を反映する", func(t *testing.T) {
+		write("warn", "text")
+		if err := c.Reload(); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if log.Logger.GetLevel() != logrus.WarnLevel {
+			t.Errorf("expected %s, but got %s", logrus.WarnLevel, log.Logger.GetLevel())
+		}
+		if _, ok := log.Logger.Formatter.(*logrus.TextFormatter); !ok {
+			t.Errorf("expected text formatter, but got %T", log.Logger.Formatter)
+		}
+	})
+
+	t.Run("不正なログレベルへの変更は破棄する", func(t *testing.T) {
+		write("hoge", "json")
+		if err := c.Reload(); err == nil {
+			t.Error("log level hoge is not supported, but no error occured")
+		}
+		if log.Logger.GetLevel() != logrus.WarnLevel {
+			t.Errorf("expected %s, but got %s", logrus.WarnLevel, log.Logger.GetLevel())
+		}
+		if c.GetString("log.format") != "text" {
+			t.Errorf("previous config must be kept, but got format %s", c.GetString("log.format"))
+		}
+	})
+}
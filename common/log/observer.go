@@ -0,0 +1,70 @@
+package log
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/kiririmode/grpc-sandbox/common"
+)
+
+// LifecycleObserver は、ResourceManager による各リソースの初期化処理・終了処理をログに出力する common.LifecycleObserver。
+// ログ自身が初期化されてから終了処理を開始するまでの間のみ出力する
+type LifecycleObserver struct {
+	log *Log
+	// ログに出力できる状態の場合は 1
+	available int32
+}
+
+// NewLifecycleObserver は l にログを出力する LifecycleObserver を返却する
+func NewLifecycleObserver(l *Log) *LifecycleObserver {
+	return &LifecycleObserver{log: l}
+}
+
+// BeforeInitialize は r の初期化処理の開始をデバッグログに出力する
+func (o *LifecycleObserver) BeforeInitialize(r common.Resource) {
+	if o.enabled() {
+		o.log.Logger.Debugf("initializing %s", r.Name())
+	}
+}
+
+// AfterInitialize は r の初期化処理に要した時間と、失敗した場合はそのエラーを出力する
+func (o *LifecycleObserver) AfterInitialize(r common.Resource, d time.Duration, err error) {
+	if r == common.Resource(o.log) && err == nil {
+		atomic.StoreInt32(&o.available, 1)
+	}
+	if !o.enabled() {
+		return
+	}
+	if err != nil {
+		o.log.Logger.Errorf("failed to initialize %s in %s: %s", r.Name(), d, err)
+		return
+	}
+	o.log.Logger.Infof("%s initialized in %s", r.Name(), d)
+}
+
+// BeforeFinalize は r の終了処理の開始をデバッグログに出力する
+func (o *LifecycleObserver) BeforeFinalize(r common.Resource) {
+	if o.enabled() {
+		o.log.Logger.Debugf("finalizing %s", r.Name())
+	}
+	if r == common.Resource(o.log) {
+		atomic.StoreInt32(&o.available, 0)
+	}
+}
+
+// AfterFinalize は r の終了処理に要した時間と、失敗した場合はそのエラーを出力する
+func (o *LifecycleObserver) AfterFinalize(r common.Resource, d time.Duration, err error) {
+	if !o.enabled() {
+		return
+	}
+	if err != nil {
+		o.log.Logger.Errorf("failed to finalize %s in %s: %s", r.Name(), d, err)
+		return
+	}
+	o.log.Logger.Infof("%s finalized in %s", r.Name(), d)
+}
+
+// enabled はログに出力できる状態であるかを返却する
+func (o *LifecycleObserver) enabled() bool {
+	return atomic.LoadInt32(&o.available) == 1
+}
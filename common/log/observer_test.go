@@ -0,0 +1,55 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// namedResource は名前のみを持つ common.Resource
+type namedResource string
+
+func (r namedResource) Name() string {
+	return string(r)
+}
+func (r namedResource) Initialize() error {
+	return nil
+}
+func (r namedResource) Finalize() error {
+	return nil
+}
+
+func TestLifecycleObserver(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := &Log{Logger: logrus.New()}
+	l.Logger.SetOutput(buf)
+	l.Logger.SetFormatter(&logrus.TextFormatter{DisableTimestamp: true})
+	sut := NewLifecycleObserver(l)
+
+	// ログの初期化前と終了処理の開始後は出力しない
+	sut.AfterInitialize(namedResource("configuration"), time.Millisecond, nil)
+	sut.AfterInitialize(l, time.Millisecond, nil)
+	sut.AfterInitialize(namedResource("stub"), 2*time.Second, nil)
+	sut.AfterFinalize(namedResource("stub"), time.Second, errors.New("failed to close"))
+	sut.BeforeFinalize(l)
+	sut.AfterFinalize(l, time.Millisecond, nil)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	expected := []string{
+		`level=info msg="log initialized in 1ms"`,
+		`level=info msg="stub initialized in 2s"`,
+		`level=error msg="failed to finalize stub in 1s: failed to close"`,
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %s, but got %s", expected, lines)
+	}
+	for i, e := range expected {
+		if lines[i] != e {
+			t.Errorf("expected %s, but got %s", e, lines[i])
+		}
+	}
+}
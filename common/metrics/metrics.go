@@ -0,0 +1,298 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiririmode/grpc-sandbox/common"
+	"github.com/kiririmode/grpc-sandbox/common/conf"
+	"github.com/kiririmode/grpc-sandbox/common/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// shutdownTimeout は HTTP サーバの停止を待つ時間
+const shutdownTimeout = 5 * time.Second
+
+// Metrics は gRPC の RPC に関するメトリクスを収集し、Prometheus 形式で HTTP により公開する
+type Metrics struct {
+	config   *conf.Configuration
+	log      *log.Log
+	registry *prometheus.Registry
+	server   *http.Server
+
+	// RPC の完了数 (ステータスコード別)
+	handled *prometheus.CounterVec
+	// RPC の処理時間
+	handlingSeconds *prometheus.HistogramVec
+	// 受信・送信したメッセージ数
+	received *prometheus.CounterVec
+	sent     *prometheus.CounterVec
+	// ストリーム 1 本あたりに受信・送信したメッセージ数
+	streamReceived *prometheus.HistogramVec
+	streamSent     *prometheus.HistogramVec
+	// リソースの状態 (1: 正常, 0: 異常)
+	resourceHealthy *prometheus.GaugeVec
+	// リソースの直近の初期化処理・終了処理に要した時間と、その失敗数
+	lifecycleSeconds  *prometheus.GaugeVec
+	lifecycleFailures *prometheus.CounterVec
+
+	// ResourceManager から通知された最新のリソースの状態
+	healthMu sync.RWMutex
+	health   common.Health
+}
+
+// NewMetrics は、設定 c に基いた新しい Metrics オブジェクトを返却する
+func NewMetrics(c *conf.Configuration, logger *log.Log) *Metrics {
+	labels := []string{"grpc_type", "grpc_service", "grpc_method"}
+	m := &Metrics{
+		config:   c,
+		log:      logger,
+		registry: prometheus.NewRegistry(),
+		handled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_server_handled_total",
+			Help: "Total number of RPCs completed on the server, regardless of success or failure.",
+		}, append(labels, "grpc_code")),
+		handlingSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "grpc_server_handling_seconds",
+			Help:    "Histogram of response latency (seconds) of gRPC that had been application-level handled by the server.",
+			Buckets: prometheus.DefBuckets,
+		}, labels),
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_server_msg_received_total",
+			Help: "Total number of RPC messages received on the server.",
+		}, labels),
+		sent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_server_msg_sent_total",
+			Help: "Total number of gRPC messages sent by the server.",
+		}, labels),
+		streamReceived: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "grpc_server_stream_msg_received",
+			Help:    "Histogram of the number of messages received per stream.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		}, labels),
+		streamSent: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "grpc_server_stream_msg_sent",
+			Help:    "Histogram of the number of messages sent per stream.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		}, labels),
+		resourceHealthy: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "resource_healthy",
+			Help: "Whether the resource is healthy (1) or not (0) at the last health check.",
+		}, []string{"resource"}),
+		lifecycleSeconds: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "resource_lifecycle_seconds",
+			Help: "Seconds taken by the last initialization or finalization of the resource.",
+		}, []string{"resource", "phase"}),
+		lifecycleFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "resource_lifecycle_failures_total",
+			Help: "Total number of failed initializations or finalizations of the resource.",
+		}, []string{"resource", "phase"}),
+		// 状態を確認していない間は正常とする
+		health: common.Health{Healthy: true, Resources: []common.ResourceHealth{}},
+	}
+	m.registry.MustRegister(m.handled, m.handlingSeconds, m.received, m.sent, m.streamReceived, m.streamSent, m.resourceHealthy,
+		m.lifecycleSeconds, m.lifecycleFailures)
+	return m
+}
+
+// Name は初期化対象である "metrics" を返却する
+func (m *Metrics) Name() string {
+	return "metrics"
+}
+
+// Dependencies は configuration と log に依存することを返却する
+func (m *Metrics) Dependencies() []string {
+	return []string{m.config.Name(), m.log.Name()}
+}
+
+// Initialize は metrics.port で指定されたポートを Listen し、/metrics でメトリクスを、/health でリソースの状態を公開する。
+// metrics.port が設定されていない場合、メトリクスの収集のみを行う
+func (m *Metrics) Initialize() error {
+	port := m.config.GetInt("metrics.port")
+	if port == 0 {
+		m.log.Logger.Info("metrics.port is not specified, metrics endpoint is disabled")
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen port %d", port)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	mux.Handle("/health", m.HealthHandler())
+	m.server = &http.Server{Handler: mux}
+
+	m.log.Logger.Infof("serving metrics on tcp port %d", port)
+	go func() {
+		if err := m.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			m.log.Logger.Errorf("failed to serve metrics: %s", err)
+		}
+	}()
+	return nil
+}
+
+// InitializeContext は Initialize を呼び出す。HTTP サーバの起動は待ち合わせを伴わないため、ctx は用いない
+func (m *Metrics) InitializeContext(ctx context.Context) error {
+	return m.Initialize()
+}
+
+// Finalize は終了処理として、メトリクスを公開する HTTP サーバを停止する
+func (m *Metrics) Finalize() error {
+	return m.FinalizeContext(context.Background())
+}
+
+// FinalizeContext は、メトリクスを公開する HTTP サーバを、ctx の期限と shutdownTimeout のうち早い方まで待って停止する
+func (m *Metrics) FinalizeContext(ctx context.Context) error {
+	if m.server == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+	if err := m.server.Shutdown(ctx); err != nil {
+		return errors.Wrap(err, "failed to shutdown metrics server")
+	}
+	return nil
+}
+
+// Handler は収集したメトリクスを Prometheus 形式で返却する http.Handler を返却する
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// OnHealthChanged は、ResourceManager が確認したリソースの状態を /health とメトリクスに反映する
+func (m *Metrics) OnHealthChanged(prev, current common.Health) {
+	m.healthMu.Lock()
+	m.health = current
+	m.healthMu.Unlock()
+
+	for _, r := range current.Resources {
+		v := 0.0
+		if r.Healthy {
+			v = 1
+		}
+		m.resourceHealthy.WithLabelValues(r.Name).Set(v)
+	}
+}
+
+// HealthHandler は最新のリソースの状態を JSON で返却する http.Handler を返却する。
+// いずれかのリソースが利用できない場合のステータスコードは 503 Service Unavailable となる
+func (m *Metrics) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.healthMu.RLock()
+		h := m.health
+		m.healthMu.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !h.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(h); err != nil {
+			m.log.Logger.Errorf("failed to write health: %s", err)
+		}
+	})
+}
+
+// UnaryServerInterceptor は Unary RPC のメトリクスを収集する Interceptor を返却する
+func (m *Metrics) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		labels := newLabels("unary", info.FullMethod)
+		m.received.WithLabelValues(labels...).Inc()
+
+		start := time.Now()
+		res, err := handler(ctx, req)
+
+		m.observe(labels, start, err)
+		if err == nil {
+			m.sent.WithLabelValues(labels...).Inc()
+		}
+		return res, err
+	}
+}
+
+// StreamServerInterceptor は Streaming RPC のメトリクスを収集する Interceptor を返却する
+func (m *Metrics) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		labels := newLabels(streamType(info), info.FullMethod)
+		stream := &monitoredServerStream{
+			ServerStream: ss,
+			received:     m.received.WithLabelValues(labels...),
+			sent:         m.sent.WithLabelValues(labels...),
+		}
+
+		start := time.Now()
+		err := handler(srv, stream)
+
+		m.observe(labels, start, err)
+		m.streamReceived.WithLabelValues(labels...).Observe(float64(stream.receivedCount))
+		m.streamSent.WithLabelValues(labels...).Observe(float64(stream.sentCount))
+		return err
+	}
+}
+
+// observe は RPC の完了数と処理時間を記録する
+func (m *Metrics) observe(labels []string, start time.Time, err error) {
+	m.handled.WithLabelValues(append(labels, status.Code(err).String())...).Inc()
+	m.handlingSeconds.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+}
+
+// newLabels は RPC の種類とメソッド名 (/package.Service/Method) からラベルの値を返却する
+func newLabels(rpcType, fullMethod string) []string {
+	service, method := "unknown", "unknown"
+	if parts := strings.SplitN(strings.TrimPrefix(fullMethod, "/"), "/", 2); len(parts) == 2 {
+		service, method = parts[0], parts[1]
+	}
+	return []string{rpcType, service, method}
+}
+
+// streamType は Streaming RPC の種類を返却する
+func streamType(info *grpc.StreamServerInfo) string {
+	switch {
+	case info.IsClientStream && info.IsServerStream:
+		return "bidi_stream"
+	case info.IsClientStream:
+		return "client_stream"
+	}
+	return "server_stream"
+}
+
+// monitoredServerStream は送受信したメッセージを数える grpc.ServerStream
+type monitoredServerStream struct {
+	grpc.ServerStream
+	received      prometheus.Counter
+	sent          prometheus.Counter
+	receivedCount int
+	sentCount     int
+}
+
+// SendMsg は m を送信し、送信したメッセージを数える
+func (s *monitoredServerStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.sent.Inc()
+		s.sentCount++
+	}
+	return err
+}
+
+// RecvMsg は m にメッセージを受信し、受信したメッセージを数える
+func (s *monitoredServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.received.Inc()
+		s.receivedCount++
+	}
+	return err
+}
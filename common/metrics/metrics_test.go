@@ -0,0 +1,178 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiririmode/grpc-sandbox/common"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// scrape は m のメトリクスを Prometheus 形式で取得する
+func scrape(t *testing.T, m *Metrics) string {
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := ioutil.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	return string(body)
+}
+
+func TestNewLabels(t *testing.T) {
+	testCases := []struct {
+		fullMethod string
+		expected   []string
+	}{
+		{fullMethod: "/helloworld.Greeter/SayHello", expected: []string{"unary", "helloworld.Greeter", "SayHello"}},
+		{fullMethod: "illegal", expected: []string{"unary", "unknown", "unknown"}},
+	}
+	for _, tc := range testCases {
+		actual := newLabels("unary", tc.fullMethod)
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("expected %s, but got %s", tc.expected, actual)
+		}
+	}
+}
+
+func TestMetrics_UnaryServerInterceptor(t *testing.T) {
+	sut := NewMetrics(nil, nil)
+	info := &grpc.UnaryServerInfo{FullMethod: "/helloworld.Greeter/SayHello"}
+	success := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return req, nil
+	}
+	failure := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.Internal, "Internal Error")
+	}
+
+	for _, h := range []grpc.UnaryHandler{success, failure, failure} {
+		sut.UnaryServerInterceptor()(context.Background(), nil, info, h)
+	}
+
+	body := scrape(t, sut)
+	expected := []string{
+		`grpc_server_handled_total{grpc_code="OK",grpc_method="SayHello",grpc_service="helloworld.Greeter",grpc_type="unary"} 1`,
+		`grpc_server_handled_total{grpc_code="Internal",grpc_method="SayHello",grpc_service="helloworld.Greeter",grpc_type="unary"} 2`,
+		`grpc_server_handling_seconds_count{grpc_method="SayHello",grpc_service="helloworld.Greeter",grpc_type="unary"} 3`,
+		`grpc_server_msg_received_total{grpc_method="SayHello",grpc_service="helloworld.Greeter",grpc_type="unary"} 3`,
+		`grpc_server_msg_sent_total{grpc_method="SayHello",grpc_service="helloworld.Greeter",grpc_type="unary"} 1`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(body, e) {
+			t.Errorf("metrics must contain [%s], but got\n%s", e, body)
+		}
+	}
+}
+
+// fakeServerStream は送受信を常に成功させる grpc.ServerStream
+type fakeServerStream struct {
+	grpc.ServerStream
+}
+
+func (s *fakeServerStream) SendMsg(m interface{}) error {
+	return nil
+}
+func (s *fakeServerStream) RecvMsg(m interface{}) error {
+	return nil
+}
+
+func TestMetrics_StreamServerInterceptor(t *testing.T) {
+	sut := NewMetrics(nil, nil)
+	info := &grpc.StreamServerInfo{FullMethod: "/helloworld.Greeter/SayHelloToMany", IsClientStream: true, IsServerStream: true}
+	handler := func(srv interface{}, ss grpc.ServerStream) error {
+		for i := 0; i < 3; i++ {
+			ss.RecvMsg(nil)
+			ss.SendMsg(nil)
+		}
+		ss.RecvMsg(nil)
+		return nil
+	}
+
+	if err := sut.StreamServerInterceptor()(nil, &fakeServerStream{}, info, handler); err != nil {
+		t.Errorf("err must be nil, but got %s", err)
+	}
+
+	body := scrape(t, sut)
+	expected := []string{
+		`grpc_server_handled_total{grpc_code="OK",grpc_method="SayHelloToMany",grpc_service="helloworld.Greeter",grpc_type="bidi_stream"} 1`,
+		`grpc_server_msg_received_total{grpc_method="SayHelloToMany",grpc_service="helloworld.Greeter",grpc_type="bidi_stream"} 4`,
+		`grpc_server_msg_sent_total{grpc_method="SayHelloToMany",grpc_service="helloworld.Greeter",grpc_type="bidi_stream"} 3`,
+		`grpc_server_stream_msg_received_sum{grpc_method="SayHelloToMany",grpc_service="helloworld.Greeter",grpc_type="bidi_stream"} 4`,
+		`grpc_server_stream_msg_sent_sum{grpc_method="SayHelloToMany",grpc_service="helloworld.Greeter",grpc_type="bidi_stream"} 3`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(body, e) {
+			t.Errorf("metrics must contain [%s], but got\n%s", e, body)
+		}
+	}
+}
+
+func TestMetrics_HealthHandler(t *testing.T) {
+	sut := NewMetrics(nil, nil)
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		sut.HealthHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+		return rec
+	}
+
+	t.Run("状態を確認していない間は正常とする", func(t *testing.T) {
+		if rec := get(); rec.Code != http.StatusOK {
+			t.Errorf("expected %d, but got %d", http.StatusOK, rec.Code)
+		}
+	})
+
+	t.Run("利用できないリソースがある場合は 503 とする", func(t *testing.T) {
+		sut.OnHealthChanged(common.Health{}, common.Health{
+			Healthy: false,
+			Resources: []common.ResourceHealth{
+				{Name: "log", Healthy: false, Error: "log file is not writable"},
+				{Name: "stub", Healthy: true},
+			},
+		})
+		rec := get()
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected %d, but got %d", http.StatusServiceUnavailable, rec.Code)
+		}
+		if body := rec.Body.String(); !strings.Contains(body, `{"name":"log","healthy":false,"error":"log file is not writable"}`) {
+			t.Errorf("body must contain state of log, but got %s", body)
+		}
+
+		body := scrape(t, sut)
+		for _, e := range []string{`resource_healthy{resource="log"} 0`, `resource_healthy{resource="stub"} 1`} {
+			if !strings.Contains(body, e) {
+				t.Errorf("metrics must contain %s, but got %s", e, body)
+			}
+		}
+	})
+}
+
+func TestLifecycleObserver(t *testing.T) {
+	m := NewMetrics(nil, nil)
+	sut := NewLifecycleObserver(m)
+	sut.AfterInitialize(NewMetrics(nil, nil), 1500*time.Millisecond, nil)
+	sut.AfterFinalize(NewMetrics(nil, nil), 250*time.Millisecond, errors.New("failed"))
+
+	body := scrape(t, m)
+	expected := []string{
+		`resource_lifecycle_seconds{phase="initialize",resource="metrics"} 1.5`,
+		`resource_lifecycle_seconds{phase="finalize",resource="metrics"} 0.25`,
+		`resource_lifecycle_failures_total{phase="finalize",resource="metrics"} 1`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(body, e) {
+			t.Errorf("metrics must contain %s, but got %s", e, body)
+		}
+	}
+	if strings.Contains(body, `resource_lifecycle_failures_total{phase="initialize"`) {
+		t.Errorf("successful initialization must not be counted as failure, but got %s", body)
+	}
+}
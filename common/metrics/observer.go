@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/kiririmode/grpc-sandbox/common"
+)
+
+// LifecycleObserver は、ResourceManager による各リソースの初期化処理・終了処理に要した時間と失敗の数を
+// メトリクスとして記録する common.LifecycleObserver
+type LifecycleObserver struct {
+	metrics *Metrics
+}
+
+// NewLifecycleObserver は m にメトリクスを記録する LifecycleObserver を返却する
+func NewLifecycleObserver(m *Metrics) *LifecycleObserver {
+	return &LifecycleObserver{metrics: m}
+}
+
+// BeforeInitialize は何もしない
+func (o *LifecycleObserver) BeforeInitialize(r common.Resource) {}
+
+// AfterInitialize は r の初期化処理に要した時間と、失敗した場合はその数を記録する
+func (o *LifecycleObserver) AfterInitialize(r common.Resource, d time.Duration, err error) {
+	o.record(r, "initialize", d, err)
+}
+
+// BeforeFinalize は何もしない
+func (o *LifecycleObserver) BeforeFinalize(r common.Resource) {}
+
+// AfterFinalize は r の終了処理に要した時間と、失敗した場合はその数を記録する
+func (o *LifecycleObserver) AfterFinalize(r common.Resource, d time.Duration, err error) {
+	o.record(r, "finalize", d, err)
+}
+
+// record は r の phase の処理に要した時間 d と、err が nil でない場合は失敗を記録する
+func (o *LifecycleObserver) record(r common.Resource, phase string, d time.Duration, err error) {
+	o.metrics.lifecycleSeconds.WithLabelValues(r.Name(), phase).Set(d.Seconds())
+	if err != nil {
+		o.metrics.lifecycleFailures.WithLabelValues(r.Name(), phase).Inc()
+	}
+}
@@ -1,6 +1,13 @@
 package common
 
 import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/pkg/errors"
 )
 
@@ -14,9 +21,120 @@ type Resource interface {
 	Finalize() error
 }
 
+// LifecycleListener は、ResourceManager が管理するリソース全体の状態の変化を通知される Resource が実装する Interface
+type LifecycleListener interface {
+	// すべてのリソースの初期化が完了した後に呼び出される
+	OnInitialized()
+	// いずれかのリソースの終了処理を開始する前に呼び出される
+	OnFinalizing()
+}
+
+// Dependent は、初期化の前提となる他のリソースを宣言する Resource が実装する Interface。
+// 依存するリソースより後に初期化され、先に終了処理が行われる
+type Dependent interface {
+	// 依存するリソースの名前 (Name() の値) を返却する
+	Dependencies() []string
+}
+
+// ContextResource は、キャンセルや期限に応じて初期化・終了処理を中断できる Resource が実装する Interface。
+// ResourceManager は Initialize, Finalize の代わりにこれらを呼び出す
+type ContextResource interface {
+	Resource
+	// ctx の期限までに初期化処理を実行する
+	InitializeContext(ctx context.Context) error
+	// ctx の期限までに終了処理を実行する
+	FinalizeContext(ctx context.Context) error
+}
+
+// DurationSource は ResourceManager が制限時間を読み込む設定を表現する Interface (conf.Configuration が実装する)
+type DurationSource interface {
+	GetDuration(key string) time.Duration
+}
+
+// 制限時間の設定項目。0 以下の場合は制限しない
+const (
+	// 初期化処理、終了処理のそれぞれ全体の制限時間
+	lifecycleTimeoutKey = "lifecycle.timeout"
+	// 各リソースの初期化処理、終了処理の制限時間
+	resourceTimeoutKey = "lifecycle.resource_timeout"
+	// lifecycle.resources.<リソース名> で、リソース毎に制限時間を上書きする
+	resourceTimeoutsKey = "lifecycle.resources"
+)
+
+// 制限時間を超過した処理の名前
+const (
+	phaseInitialize = "initialize"
+	phaseFinalize   = "finalize"
+)
+
+// LifecycleObserver は、ResourceManager による各リソースの初期化処理・終了処理を観測する Interface。
+// 互いに依存しないリソースの処理は並行して行うため、各メソッドは並行して呼び出される
+type LifecycleObserver interface {
+	// r の初期化処理の開始前に呼び出される
+	BeforeInitialize(r Resource)
+	// r の初期化処理の完了後 (制限時間の超過を含む) に、要した時間 d と失敗した場合のエラー err とともに呼び出される
+	AfterInitialize(r Resource, d time.Duration, err error)
+	// r の終了処理の開始前に呼び出される
+	BeforeFinalize(r Resource)
+	// r の終了処理の完了後 (制限時間の超過を含む) に、要した時間 d と失敗した場合のエラー err とともに呼び出される
+	AfterFinalize(r Resource, d time.Duration, err error)
+}
+
 // ResourceManager はリソースの初期化・終了処理を管理するマネージャ
 type ResourceManager struct {
 	resources []Resource
+	// 初期化に成功し、まだ終了処理を行っていないリソース (resources の添字)
+	initialized map[int]bool
+	// 制限時間を読み込む設定。nil の場合は制限しない
+	timeouts DurationSource
+	// 各リソースの初期化・終了処理を観測する
+	observers []LifecycleObserver
+	// リソースの状態の定期確認
+	health healthMonitor
+	// Run で実行が失敗した場合に再起動するリソースの名前と、その方針
+	restartPolicies map[string]RestartPolicy
+	// 再起動の待機時に呼び出される関数
+	onRestart func(name string, err error, restarts int, backoff time.Duration)
+	// 複数のリソースの再起動を逐次的に行うためのロック
+	restarting sync.Mutex
+}
+
+// TimeoutError は、リソースの初期化処理または終了処理が制限時間内に完了しなかったことを表現する
+type TimeoutError struct {
+	// 制限時間内に完了しなかったリソースの名前
+	Resource string
+	// 完了しなかった処理 (initialize or finalize)
+	Phase string
+}
+
+// Error は制限時間内に完了しなかったリソースと処理を返却する
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("failed to %s %s: timed out", e.Phase, e.Resource)
+}
+
+// InitializeError は、リソースの初期化の失敗と、それに伴って初期化済みのリソースを終了処理 (ロールバック) した際の失敗を表現する
+type InitializeError struct {
+	// 初期化に失敗したリソースのエラー
+	Errors []error
+	// ロールバックとして行った終了処理のエラー
+	RollbackErrors []error
+}
+
+// Error は初期化とロールバックのエラーメッセージを連結して返却する
+func (e *InitializeError) Error() string {
+	msgs := make([]string, 0, len(e.Errors)+len(e.RollbackErrors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	for _, err := range e.RollbackErrors {
+		msgs = append(msgs, "rollback: "+err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Cause は最初に初期化に失敗したリソースのエラーを返却する
+func (e *InitializeError) Cause() error {
+	return e.Errors[0]
 }
 
 // NewResourceManager は、管理対象として rs を含む新しい ResourceManager を返却する
@@ -32,28 +150,354 @@ func (m *ResourceManager) AddResource(r Resource) *ResourceManager {
 	return m
 }
 
-// Initialize は管理しているリソースを追加された順に初期化する。
-// エラーが起こった場合は、その時点で処理を打ち切る。
+// SetTimeouts は、初期化処理・終了処理の制限時間を config から読み込むよう設定する。
+// lifecycle.timeout は初期化処理、終了処理のそれぞれ全体の制限時間を、
+// lifecycle.resource_timeout は各リソースの制限時間を表し、lifecycle.resources.<リソース名> でリソース毎に上書きできる。
+// 設定値は各リソースの処理を開始する時点で読み込むため、config 自身を管理対象に含めることができる
+func (m *ResourceManager) SetTimeouts(config DurationSource) *ResourceManager {
+	m.timeouts = config
+	return m
+}
+
+// AddObserver は、各リソースの初期化処理・終了処理 (ロールバックと再起動を含む) を観測する LifecycleObserver として o を追加する
+func (m *ResourceManager) AddObserver(o LifecycleObserver) *ResourceManager {
+	m.observers = append(m.observers, o)
+	return m
+}
+
+// Initialize は context.Background() で InitializeContext を呼び出す
 func (m *ResourceManager) Initialize() error {
+	return m.InitializeContext(context.Background())
+}
+
+// InitializeContext は管理しているリソースを、依存するリソースが先になるよう初期化する。
+// 互いに依存しないリソースは並行して初期化し、依存関係が循環している場合や、依存するリソースが存在しない場合はエラーとする。
+// 初期化に失敗した場合や、制限時間内に完了しなかった場合は、その時点で処理を打ち切り、
+// 初期化に成功したリソースのみを逆順に終了処理した上で *InitializeError を返却する。
+// 制限時間を超過したリソースは初期化の完了を待たず、終了処理も行わない。
+// すべてのリソースの初期化が完了すると、LifecycleListener を実装するリソースに通知する。
+func (m *ResourceManager) InitializeContext(ctx context.Context) error {
+	layers, err := m.layers()
+	if err != nil {
+		return err
+	}
+
+	if m.initialized == nil {
+		m.initialized = make(map[int]bool)
+	}
+	start := time.Now()
+	for _, layer := range layers {
+		errs := m.parallelContext(ctx, start, layer, phaseInitialize, initializeResource)
+		for i, err := range errs {
+			if err == nil {
+				m.initialized[layer[i]] = true
+			}
+		}
+		if failed := compact(errs); len(failed) > 0 {
+			// 初期化がキャンセルされた場合も、ロールバックは行う
+			return &InitializeError{Errors: failed, RollbackErrors: m.finalize(context.Background(), layers)}
+		}
+	}
+
 	for _, r := range m.resources {
-		err := r.Initialize()
-		if err != nil {
-			return errors.Wrapf(err, "failed to initialize %s", r.Name())
+		if l, ok := r.(LifecycleListener); ok {
+			l.OnInitialized()
 		}
 	}
 	return nil
 }
 
-// Finalize は管理しているリソースに対し、追加順と逆順に終了処理を行う。
-// エラーが起こった場合も、一通りの終了処理を行う
+// Finalize は context.Background() で FinalizeContext を呼び出す
 func (m *ResourceManager) Finalize() []error {
+	return m.FinalizeContext(context.Background())
+}
+
+// FinalizeContext は初期化済みのリソースに対し、初期化と逆に、依存されるリソースが後になるよう終了処理を行う。
+// 互いに依存しないリソースは並行して終了処理を行い、初期化されていないリソースは終了処理を行わない。
+// 終了処理の開始前に、状態の定期確認を停止し、LifecycleListener を実装するリソースに通知する。
+// エラーが起こった場合や、制限時間内に完了しないリソースがあった場合も、一通りの終了処理を行う
+func (m *ResourceManager) FinalizeContext(ctx context.Context) []error {
+	m.stopHealthCheck()
+	for i, r := range m.resources {
+		if l, ok := r.(LifecycleListener); ok && m.initialized[i] {
+			l.OnFinalizing()
+		}
+	}
+
+	layers, err := m.layers()
+	if err != nil {
+		// 依存関係が不正な場合は、追加順と逆順に終了処理を行う
+		layers = make([][]int, len(m.resources))
+		for i := range m.resources {
+			layers[i] = []int{i}
+		}
+	}
+	return m.finalize(ctx, layers)
+}
+
+// finalize は layers の逆順に、初期化済みのリソースの終了処理を行い、そのエラーを返却する。
+// 制限時間内に完了しなかったリソースは *TimeoutError とし、完了を待たずに次のリソースの終了処理に進む
+func (m *ResourceManager) finalize(ctx context.Context, layers [][]int) []error {
 	errArray := make([]error, 0)
+	start := time.Now()
+	for i := len(layers) - 1; i >= 0; i-- {
+		targets := make([]int, 0, len(layers[i]))
+		for _, j := range layers[i] {
+			if m.initialized[j] {
+				targets = append(targets, j)
+			}
+		}
+		errs := m.parallelContext(ctx, start, targets, phaseFinalize, finalizeResource)
+		errArray = append(errArray, compact(errs)...)
+		for _, j := range targets {
+			delete(m.initialized, j)
+		}
+	}
+	return errArray
+}
 
-	for i := len(m.resources) - 1; i >= 0; i-- {
-		err := m.resources[i].Finalize()
+// initializeResource は、r が ContextResource を実装する場合は ctx で、それ以外の場合は ctx によらず初期化する
+func initializeResource(ctx context.Context, r Resource) error {
+	var err error
+	if cr, ok := r.(ContextResource); ok {
+		err = cr.InitializeContext(ctx)
+	} else {
+		err = r.Initialize()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to initialize %s", r.Name())
+	}
+	return nil
+}
+
+// finalizeResource は、r が ContextResource を実装する場合は ctx で、それ以外の場合は ctx によらず終了処理を行う
+func finalizeResource(ctx context.Context, r Resource) error {
+	if cr, ok := r.(ContextResource); ok {
+		return cr.FinalizeContext(ctx)
+	}
+	return r.Finalize()
+}
+
+// layers は、管理しているリソースの添字を依存関係に従って階層に分けて返却する。
+// 各階層のリソースは、それより前の階層のリソースにのみ依存する
+func (m *ResourceManager) layers() ([][]int, error) {
+	// 名前から、その名前を持つリソースの添字を引けるようにする
+	byName := make(map[string][]int)
+	for i, r := range m.resources {
+		byName[r.Name()] = append(byName[r.Name()], i)
+	}
+
+	// 各リソースが依存するリソースの数と、各リソースに依存するリソース
+	indegrees := make([]int, len(m.resources))
+	dependents := make([][]int, len(m.resources))
+	for i, r := range m.resources {
+		d, ok := r.(Dependent)
+		if !ok {
+			continue
+		}
+		for _, name := range d.Dependencies() {
+			deps, ok := byName[name]
+			if !ok {
+				return nil, errors.Errorf("%s depends on missing resource %s", r.Name(), name)
+			}
+			for _, dep := range deps {
+				if dep == i {
+					return nil, errors.Errorf("%s depends on itself", r.Name())
+				}
+				indegrees[i]++
+				dependents[dep] = append(dependents[dep], i)
+			}
+		}
+	}
+
+	// 依存するリソースがなくなったものから順に、追加順を保って階層に加える
+	layers := make([][]int, 0)
+	current := make([]int, 0)
+	for i, n := range indegrees {
+		if n == 0 {
+			current = append(current, i)
+		}
+	}
+	sorted := 0
+	for len(current) > 0 {
+		next := make([]int, 0)
+		for _, i := range current {
+			for _, j := range dependents[i] {
+				if indegrees[j]--; indegrees[j] == 0 {
+					next = append(next, j)
+				}
+			}
+		}
+		sort.Ints(next)
+		layers = append(layers, current)
+		sorted += len(current)
+		current = next
+	}
+
+	if sorted < len(m.resources) {
+		cyclic := make([]string, 0)
+		for i, n := range indegrees {
+			if n > 0 {
+				cyclic = append(cyclic, m.resources[i].Name())
+			}
+		}
+		return nil, errors.Errorf("dependency cycle detected among %s", strings.Join(cyclic, ", "))
+	}
+	return layers, nil
+}
+
+// parallelContext は、添字が indices であるリソースのそれぞれに対して、制限時間を設定した ctx で fn を並行して実行し、
+// その完了を待って結果を indices の順に返却する。
+// 制限時間は、start から全体の制限時間が経過する時刻と、リソース毎の制限時間のうち早い方とする。
+// 制限時間内に完了しなかった場合は、fn の完了を待たずに、そのリソースの結果を *TimeoutError とする。
+// 初期化が制限時間を超過した後に成功した場合は、そのリソースを終了する。
+// 各リソースの処理の前後には LifecycleObserver に通知する
+func (m *ResourceManager) parallelContext(ctx context.Context, start time.Time, indices []int, phase string, fn func(ctx context.Context, r Resource) error) []error {
+	// 制限時間の設定値は、並行して処理を始める前に読み込んでおく
+	if d := m.timeout(lifecycleTimeoutKey); d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, start.Add(d))
+		defer cancel()
+	}
+	timeouts := make([]time.Duration, len(indices))
+	for i, j := range indices {
+		timeouts[i] = m.resourceTimeout(m.resources[j])
+	}
+
+	return m.parallel(indices, func(i int, r Resource) error {
+		ctx := ctx
+		if timeouts[i] > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeouts[i])
+			defer cancel()
+		}
+
+		var late func(err error)
+		if phase == phaseInitialize {
+			late = func(err error) {
+				if err == nil {
+					m.finalizeLate(r)
+				}
+			}
+		}
+
+		m.notifyBefore(r, phase)
+		begin := time.Now()
+		err := runContext(ctx, r, phase, fn, late)
+		m.notifyAfter(r, phase, time.Since(begin), err)
+		return err
+	})
+}
+
+// finalizeLate は、制限時間を超過した後に初期化が完了したリソースを終了する。
+// このリソースは初期化に失敗したものとして扱われているため、ResourceManager の Finalize の対象にはならない
+func (m *ResourceManager) finalizeLate(r Resource) {
+	ctx := context.Background()
+	if d := m.resourceTimeout(r); d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	m.notifyBefore(r, phaseFinalize)
+	begin := time.Now()
+	err := runContext(ctx, r, phaseFinalize, finalizeResource, nil)
+	m.notifyAfter(r, phaseFinalize, time.Since(begin), err)
+}
+
+// notifyBefore は LifecycleObserver に r の phase の処理の開始を通知する
+func (m *ResourceManager) notifyBefore(r Resource, phase string) {
+	for _, o := range m.observers {
+		if phase == phaseInitialize {
+			o.BeforeInitialize(r)
+		} else {
+			o.BeforeFinalize(r)
+		}
+	}
+}
+
+// notifyAfter は LifecycleObserver に r の phase の処理の完了を通知する
+func (m *ResourceManager) notifyAfter(r Resource, phase string, d time.Duration, err error) {
+	for _, o := range m.observers {
+		if phase == phaseInitialize {
+			o.AfterInitialize(r, d, err)
+		} else {
+			o.AfterFinalize(r, d, err)
+		}
+	}
+}
+
+// runContext は r に対して fn を実行し、その完了か ctx の期限のうち早い方まで待つ。
+// 期限までに完了しない場合は、fn の完了を待たずに *TimeoutError を返却する。
+// late が nil でない場合は、期限の後に完了した fn の結果を渡して late を呼び出す
+func runContext(ctx context.Context, r Resource, phase string, fn func(ctx context.Context, r Resource) error, late func(err error)) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(ctx, r)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// 期限と同時に完了していた場合は、その結果を優先する
+		select {
+		case err = <-done:
+		default:
+			err = errors.Wrapf(ctx.Err(), "failed to %s %s", phase, r.Name())
+			if late != nil {
+				go func() {
+					late(<-done)
+				}()
+			}
+		}
+	}
+	// 期限の超過により中断した場合は、ContextResource が ctx.Err() を返却した場合も含め、リソースを特定できるようにする
+	if err != nil && errors.Cause(err) == context.DeadlineExceeded && ctx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{Resource: r.Name(), Phase: phase}
+	}
+	return err
+}
+
+// timeout は設定項目 key の制限時間を返却する。設定されていない場合は 0 を返却する
+func (m *ResourceManager) timeout(key string) time.Duration {
+	if m.timeouts == nil {
+		return 0
+	}
+	return m.timeouts.GetDuration(key)
+}
+
+// resourceTimeout はリソース r の制限時間を返却する。リソース毎の設定がない場合は、既定の制限時間とする
+func (m *ResourceManager) resourceTimeout(r Resource) time.Duration {
+	if d := m.timeout(resourceTimeoutsKey + "." + r.Name()); d > 0 {
+		return d
+	}
+	return m.timeout(resourceTimeoutKey)
+}
+
+// parallel は、添字が indices であるリソースのそれぞれに対して fn を並行して実行し、その完了を待って結果を indices の順に返却する。
+// fn には indices における位置とリソースを渡す
+func (m *ResourceManager) parallel(indices []int, fn func(i int, r Resource) error) []error {
+	results := make([]error, len(indices))
+	var wg sync.WaitGroup
+	for i, j := range indices {
+		wg.Add(1)
+		go func(i int, r Resource) {
+			defer wg.Done()
+			results[i] = fn(i, r)
+		}(i, m.resources[j])
+	}
+	wg.Wait()
+	return results
+}
+
+// compact は errs のうち nil でないものを返却する
+func compact(errs []error) []error {
+	nonNil := make([]error, 0)
+	for _, err := range errs {
 		if err != nil {
-			errArray = append(errArray, err)
+			nonNil = append(nonNil, err)
 		}
 	}
-	return errArray
+	return nonNil
 }
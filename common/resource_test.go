@@ -1,8 +1,14 @@
 package common
 
 import (
+	"context"
 	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // 正常に初期化・終了処理を行う Resouce
@@ -31,6 +37,15 @@ func (r *failureResource) Name() string {
 	return "failure"
 }
 
+// 初期化処理には成功し、終了処理に失敗する Resource
+type finalizeFailureResource struct {
+	successResouce
+}
+
+func (r *finalizeFailureResource) Finalize() error {
+	return errors.New("failed")
+}
+
 func TestResourceManager_Initialize(t *testing.T) {
 	t.Run("すべての初期化処理が正常に完了すれば、正常終了する", func(t *testing.T) {
 		sut := &ResourceManager{}
@@ -67,9 +82,12 @@ func TestResourceManager_Finalize(t *testing.T) {
 	})
 	t.Run("終了処理が異常終了したものが１つでもあれば異常終了する", func(t *testing.T) {
 		sut := &ResourceManager{}
-		sut.AddResource(&failureResource{}).
+		sut.AddResource(&finalizeFailureResource{}).
 			AddResource(&successResouce{})
 
+		if err := sut.Initialize(); err != nil {
+			t.Fatalf("error should be nil, but got %s", err)
+		}
 		errs := sut.Finalize()
 		if len(errs) == 0 {
 			t.Error("error should be occured, but got success")
@@ -77,12 +95,512 @@ func TestResourceManager_Finalize(t *testing.T) {
 	})
 	t.Run("終了処理が異常終了するリソースがあっても続行する", func(t *testing.T) {
 		sut := &ResourceManager{}
-		sut.AddResource(&failureResource{}).
-			AddResource(&failureResource{})
+		sut.AddResource(&finalizeFailureResource{}).
+			AddResource(&finalizeFailureResource{})
 
+		if err := sut.Initialize(); err != nil {
+			t.Fatalf("error should be nil, but got %s", err)
+		}
 		errs := sut.Finalize()
 		if len(errs) != 2 {
 			t.Errorf("error count must be 2, but got %d", len(errs))
 		}
 	})
+	t.Run("初期化されていないリソースや終了済みのリソースは終了処理を行わない", func(t *testing.T) {
+		sut := &ResourceManager{}
+		sut.AddResource(&finalizeFailureResource{})
+
+		if errs := sut.Finalize(); len(errs) != 0 {
+			t.Errorf("resource not initialized must not be finalized, but got %s", errs)
+		}
+		if err := sut.Initialize(); err != nil {
+			t.Fatalf("error should be nil, but got %s", err)
+		}
+		if errs := sut.Finalize(); len(errs) != 1 {
+			t.Errorf("error count must be 1, but got %d", len(errs))
+		}
+		if errs := sut.Finalize(); len(errs) != 0 {
+			t.Errorf("resource already finalized must not be finalized, but got %s", errs)
+		}
+	})
+}
+
+// ライフサイクルの通知を記録する Resource
+type listenerResource struct {
+	successResouce
+	events []string
+}
+
+func (r *listenerResource) OnInitialized() {
+	r.events = append(r.events, "initialized")
+}
+func (r *listenerResource) OnFinalizing() {
+	r.events = append(r.events, "finalizing")
+}
+
+func TestResourceManager_LifecycleListener(t *testing.T) {
+	t.Run("初期化完了と終了処理開始が通知される", func(t *testing.T) {
+		l := &listenerResource{}
+		sut := &ResourceManager{}
+		sut.AddResource(l).AddResource(&successResouce{})
+
+		if err := sut.Initialize(); err != nil {
+			t.Errorf("error should be nil, but got %s", err)
+		}
+		sut.Finalize()
+
+		expected := []string{"initialized", "finalizing"}
+		if !reflect.DeepEqual(l.events, expected) {
+			t.Errorf("expected %s, but got %s", expected, l.events)
+		}
+	})
+	t.Run("初期化に失敗した場合は初期化完了が通知されない", func(t *testing.T) {
+		l := &listenerResource{}
+		sut := &ResourceManager{}
+		sut.AddResource(l).AddResource(&failureResource{})
+
+		if err := sut.Initialize(); err == nil {
+			t.Error("error should be occured, but got success")
+		}
+		if len(l.events) != 0 {
+			t.Errorf("no event should be notified, but got %s", l.events)
+		}
+	})
+}
+
+// 依存するリソースを宣言し、初期化・終了処理の順序を記録する Resource
+type dependentResource struct {
+	name string
+	deps []string
+	// 初期化・終了処理の順序を記録する
+	mu     *sync.Mutex
+	events *[]string
+	// 初期化処理中のリソースの数と、その最大値
+	running, maxRunning *int32
+	// 初期化処理、終了処理で返却するエラー
+	initErr, finErr error
+}
+
+func (r *dependentResource) record(event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*r.events = append(*r.events, event+" "+r.name)
+}
+func (r *dependentResource) Initialize() error {
+	if r.running != nil {
+		n := atomic.AddInt32(r.running, 1)
+		defer atomic.AddInt32(r.running, -1)
+		for {
+			max := atomic.LoadInt32(r.maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(r.maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if r.initErr != nil {
+		return r.initErr
+	}
+	r.record("initialize")
+	return nil
+}
+func (r *dependentResource) Finalize() error {
+	r.record("finalize")
+	return r.finErr
+}
+func (r *dependentResource) Name() string {
+	return r.name
+}
+func (r *dependentResource) Dependencies() []string {
+	return r.deps
+}
+
+// newDependentResources は、names と deps から、順序を events に記録する dependentResource を作成する
+func newDependentResources(events *[]string, deps map[string][]string, names ...string) []Resource {
+	mu := &sync.Mutex{}
+	rs := make([]Resource, 0, len(names))
+	for _, name := range names {
+		rs = append(rs, &dependentResource{name: name, deps: deps[name], mu: mu, events: events})
+	}
+	return rs
+}
+
+func TestResourceManager_Dependencies(t *testing.T) {
+	deps := map[string][]string{
+		"log":    {"config"},
+		"metric": {"config", "log"},
+		"server": {"log", "metric"},
+	}
+
+	t.Run("依存するリソースの後に初期化し、先に終了処理を行う", func(t *testing.T) {
+		var events []string
+		sut := NewResourceManager(newDependentResources(&events, deps, "server", "metric", "log", "config"))
+		if err := sut.Initialize(); err != nil {
+			t.Fatalf("error should be nil, but got %s", err)
+		}
+		if errs := sut.Finalize(); len(errs) != 0 {
+			t.Fatalf("error should be nil, but got %s", errs)
+		}
+
+		expected := []string{
+			"initialize config", "initialize log", "initialize metric", "initialize server",
+			"finalize server", "finalize metric", "finalize log", "finalize config",
+		}
+		if !reflect.DeepEqual(events, expected) {
+			t.Errorf("expected %s, but got %s", expected, events)
+		}
+	})
+
+	t.Run("互いに依存しないリソースは並行して初期化する", func(t *testing.T) {
+		var events []string
+		var running, maxRunning int32
+		rs := newDependentResources(&events, map[string][]string{"c": {"a", "b"}}, "a", "b", "c")
+		for _, r := range rs {
+			r.(*dependentResource).running, r.(*dependentResource).maxRunning = &running, &maxRunning
+		}
+		if err := NewResourceManager(rs).Initialize(); err != nil {
+			t.Fatalf("error should be nil, but got %s", err)
+		}
+		if maxRunning != 2 {
+			t.Errorf("a and b must be initialized in parallel, but max concurrency is %d", maxRunning)
+		}
+		if events[2] != "initialize c" {
+			t.Errorf("c must be initialized last, but got %s", events)
+		}
+	})
+
+	t.Run("依存関係が不正な場合は初期化しない", func(t *testing.T) {
+		testCases := []struct {
+			name string
+			deps map[string][]string
+		}{
+			{name: "依存するリソースが存在しない", deps: map[string][]string{"a": {"unknown"}}},
+			{name: "自身に依存する", deps: map[string][]string{"a": {"a"}}},
+			{name: "依存関係が循環する", deps: map[string][]string{"a": {"c"}, "b": {"a"}, "c": {"b"}}},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				var events []string
+				sut := NewResourceManager(newDependentResources(&events, tc.deps, "a", "b", "c"))
+				if err := sut.Initialize(); err == nil {
+					t.Error("error should be occured, but got success")
+				}
+				if len(events) != 0 {
+					t.Errorf("no resource should be initialized, but got %s", events)
+				}
+			})
+		}
+	})
+}
+
+func TestResourceManager_Rollback(t *testing.T) {
+	deps := map[string][]string{
+		"log":    {"config"},
+		"metric": {"config"},
+		"server": {"log", "metric"},
+	}
+
+	t.Run("初期化に失敗した場合は、初期化済みのリソースのみを逆順に終了処理する", func(t *testing.T) {
+		var events []string
+		rs := newDependentResources(&events, deps, "config", "log", "metric", "server")
+		rs[2].(*dependentResource).initErr = errors.New("metric failed")
+		rs[0].(*dependentResource).finErr = errors.New("config failed")
+
+		sut := NewResourceManager(rs)
+		err := sut.Initialize()
+		initErr, ok := err.(*InitializeError)
+		if !ok {
+			t.Fatalf("expected *InitializeError, but got %v", err)
+		}
+		if len(initErr.Errors) != 1 || len(initErr.RollbackErrors) != 1 {
+			t.Errorf("expected 1 error and 1 rollback error, but got %s", initErr)
+		}
+		if msg := initErr.Error(); !strings.Contains(msg, "metric failed") || !strings.Contains(msg, "rollback: config failed") {
+			t.Errorf("error must contain both init and rollback failures, but got %s", msg)
+		}
+
+		// metric と並行して初期化された log は終了処理の対象とし、server は初期化も終了処理も行わない
+		expected := []string{"initialize config", "initialize log", "finalize log", "finalize config"}
+		if !reflect.DeepEqual(events, expected) {
+			t.Errorf("expected %s, but got %s", expected, events)
+		}
+		// ロールバックしたリソースは再度終了処理を行わない
+		if errs := sut.Finalize(); len(errs) != 0 || len(events) != len(expected) {
+			t.Errorf("rolled back resources must not be finalized again, but got %s", events)
+		}
+	})
+}
+
+// 制限時間の設定を表現する DurationSource
+type durations map[string]time.Duration
+
+func (d durations) GetDuration(key string) time.Duration {
+	return d[key]
+}
+
+// 初期化処理または終了処理が release が閉じられるまで完了しない Resource
+type hangingResource struct {
+	name                   string
+	hangInit, hangFinalize bool
+	release                chan struct{}
+}
+
+func (r *hangingResource) Initialize() error {
+	if r.hangInit {
+		<-r.release
+	}
+	return nil
+}
+func (r *hangingResource) Finalize() error {
+	if r.hangFinalize {
+		<-r.release
+	}
+	return nil
+}
+func (r *hangingResource) Name() string {
+	return r.name
+}
+
+// ctx の期限まで終了処理を待ち合わせる ContextResource
+type contextResource struct{}
+
+func (r *contextResource) Initialize() error {
+	panic("InitializeContext must be called")
+}
+func (r *contextResource) Finalize() error {
+	panic("FinalizeContext must be called")
+}
+func (r *contextResource) InitializeContext(ctx context.Context) error {
+	return nil
+}
+func (r *contextResource) FinalizeContext(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		return errors.New("ctx has no deadline")
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+func (r *contextResource) Name() string {
+	return "context"
+}
+
+// ctx を無視して初期化を続け、終了されたことを通知する ContextResource
+type slowContextResource struct {
+	release   chan struct{}
+	finalized chan struct{}
+}
+
+func (r *slowContextResource) Initialize() error {
+	panic("InitializeContext must be called")
+}
+func (r *slowContextResource) Finalize() error {
+	panic("FinalizeContext must be called")
+}
+func (r *slowContextResource) InitializeContext(ctx context.Context) error {
+	<-r.release
+	return nil
+}
+func (r *slowContextResource) FinalizeContext(ctx context.Context) error {
+	close(r.finalized)
+	return nil
+}
+func (r *slowContextResource) Name() string {
+	return "slow"
+}
+
+func TestResourceManager_Timeout(t *testing.T) {
+	t.Run("終了処理が制限時間を超過したリソースを報告し、残りのリソースの終了処理を続ける", func(t *testing.T) {
+		var events []string
+		rs := newDependentResources(&events, nil, "config")
+		hanging := &hangingResource{name: "hanging", hangFinalize: true, release: make(chan struct{})}
+		defer close(hanging.release)
+		rs = append(rs, &dependentResource{name: "server", deps: []string{"config", "hanging"}, mu: &sync.Mutex{}, events: &events}, hanging)
+
+		sut := NewResourceManager(rs).SetTimeouts(durations{"lifecycle.resource_timeout": 20 * time.Millisecond})
+		if err := sut.Initialize(); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		errs := sut.Finalize()
+		if len(errs) != 1 {
+			t.Fatalf("expected 1 error, but got %s", errs)
+		}
+		timeoutErr, ok := errs[0].(*TimeoutError)
+		if !ok || timeoutErr.Resource != "hanging" || timeoutErr.Phase != "finalize" {
+			t.Errorf("expected timeout of hanging, but got %v", errs[0])
+		}
+		expected := []string{"initialize config", "initialize server", "finalize server", "finalize config"}
+		if !reflect.DeepEqual(events, expected) {
+			t.Errorf("expected %s, but got %s", expected, events)
+		}
+	})
+
+	t.Run("リソース毎の制限時間を優先する", func(t *testing.T) {
+		hanging := &hangingResource{name: "hanging", hangFinalize: true, release: make(chan struct{})}
+		defer close(hanging.release)
+		sut := NewResourceManager([]Resource{hanging}).SetTimeouts(durations{
+			"lifecycle.resource_timeout":  time.Hour,
+			"lifecycle.resources.hanging": 20 * time.Millisecond,
+		})
+		if err := sut.Initialize(); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if errs := sut.Finalize(); len(errs) != 1 {
+			t.Errorf("expected 1 error, but got %s", errs)
+		}
+	})
+
+	t.Run("全体の制限時間を超過した場合は、残りのリソースも待ち合わせない", func(t *testing.T) {
+		first := &hangingResource{name: "first", hangFinalize: true, release: make(chan struct{})}
+		defer close(first.release)
+		second := &hangingResource{name: "second", hangFinalize: true, release: first.release}
+		sut := NewResourceManager([]Resource{first, second}).SetTimeouts(durations{"lifecycle.timeout": 20 * time.Millisecond})
+		if err := sut.Initialize(); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if errs := sut.Finalize(); len(errs) != 2 {
+			t.Errorf("expected 2 errors, but got %s", errs)
+		}
+	})
+
+	t.Run("ContextResource には期限を設定した ctx を渡す", func(t *testing.T) {
+		r := &contextResource{}
+		sut := NewResourceManager([]Resource{r}).SetTimeouts(durations{"lifecycle.resource_timeout": 20 * time.Millisecond})
+		if err := sut.Initialize(); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		errs := sut.Finalize()
+		if len(errs) != 1 {
+			t.Fatalf("expected 1 error, but got %s", errs)
+		}
+		if _, ok := errs[0].(*TimeoutError); !ok {
+			t.Errorf("expected *TimeoutError, but got %v", errs[0])
+		}
+	})
+
+	t.Run("初期化が制限時間を超過した場合は、ロールバックする", func(t *testing.T) {
+		var events []string
+		rs := newDependentResources(&events, nil, "config")
+		hanging := &hangingResource{name: "hanging", hangInit: true, release: make(chan struct{})}
+		defer close(hanging.release)
+		rs = append(rs, &dependentResource{name: "server", deps: []string{"config", "hanging"}, mu: &sync.Mutex{}, events: &events}, hanging)
+
+		sut := NewResourceManager(rs).SetTimeouts(durations{"lifecycle.resource_timeout": 20 * time.Millisecond})
+		err := sut.Initialize()
+		initErr, ok := err.(*InitializeError)
+		if !ok {
+			t.Fatalf("expected *InitializeError, but got %v", err)
+		}
+		if _, ok := initErr.Cause().(*TimeoutError); !ok {
+			t.Errorf("expected *TimeoutError, but got %v", initErr.Cause())
+		}
+		expected := []string{"initialize config", "finalize config"}
+		if !reflect.DeepEqual(events, expected) {
+			t.Errorf("expected %s, but got %s", expected, events)
+		}
+	})
+
+	t.Run("制限時間を超過した後に初期化が完了したリソースは終了する", func(t *testing.T) {
+		slow := &slowContextResource{release: make(chan struct{}), finalized: make(chan struct{})}
+		sut := NewResourceManager([]Resource{slow}).SetTimeouts(durations{"lifecycle.resource_timeout": 20 * time.Millisecond})
+		err := sut.Initialize()
+		initErr, ok := err.(*InitializeError)
+		if !ok {
+			t.Fatalf("expected *InitializeError, but got %v", err)
+		}
+		if _, ok := initErr.Cause().(*TimeoutError); !ok {
+			t.Errorf("expected *TimeoutError, but got %v", initErr.Cause())
+		}
+
+		close(slow.release)
+		select {
+		case <-slow.finalized:
+		case <-time.After(time.Second):
+			t.Errorf("slow must be finalized after its initialization completes")
+		}
+	})
+
+	t.Run("制限時間を設定しない場合は完了を待つ", func(t *testing.T) {
+		var events []string
+		sut := NewResourceManager(newDependentResources(&events, nil, "config")).SetTimeouts(durations{})
+		if err := sut.Initialize(); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if errs := sut.Finalize(); len(errs) != 0 {
+			t.Errorf("err must be nil, but got %s", errs)
+		}
+	})
+}
+
+// 初期化処理・終了処理の前後の通知を記録する LifecycleObserver
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+	errs   []error
+}
+
+func (o *recordingObserver) record(event string, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, event)
+	if err != nil {
+		o.errs = append(o.errs, err)
+	}
+}
+func (o *recordingObserver) BeforeInitialize(r Resource) {
+	o.record("before initialize "+r.Name(), nil)
+}
+func (o *recordingObserver) AfterInitialize(r Resource, d time.Duration, err error) {
+	o.record("after initialize "+r.Name(), err)
+}
+func (o *recordingObserver) BeforeFinalize(r Resource) {
+	o.record("before finalize "+r.Name(), nil)
+}
+func (o *recordingObserver) AfterFinalize(r Resource, d time.Duration, err error) {
+	o.record("after finalize "+r.Name(), err)
+}
+
+func TestResourceManager_AddObserver(t *testing.T) {
+	t.Run("各リソースの処理の前後に通知する", func(t *testing.T) {
+		var events []string
+		o := &recordingObserver{}
+		rs := newDependentResources(&events, map[string][]string{"log": {"config"}}, "config", "log")
+		rs[1].(*dependentResource).finErr = errors.New("log failed")
+		sut := NewResourceManager(rs).AddObserver(o)
+		if err := sut.Initialize(); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		sut.Finalize()
+
+		expected := []string{
+			"before initialize config", "after initialize config", "before initialize log", "after initialize log",
+			"before finalize log", "after finalize log", "before finalize config", "after finalize config",
+		}
+		if !reflect.DeepEqual(o.events, expected) {
+			t.Errorf("expected %s, but got %s", expected, o.events)
+		}
+		if len(o.errs) != 1 || o.errs[0].Error() != "log failed" {
+			t.Errorf("failure of log must be notified, but got %v", o.errs)
+		}
+	})
+
+	t.Run("制限時間の超過とロールバックも通知する", func(t *testing.T) {
+		o := &recordingObserver{}
+		hanging := &hangingResource{name: "hanging", hangInit: true, release: make(chan struct{})}
+		defer close(hanging.release)
+		sut := NewResourceManager([]Resource{&successResouce{}, hanging}).AddObserver(o).
+			SetTimeouts(durations{"lifecycle.resources.hanging": 10 * time.Millisecond})
+		if err := sut.Initialize(); err == nil {
+			t.Fatal("error should be occured, but got success")
+		}
+
+		if len(o.errs) != 1 {
+			t.Fatalf("expected 1 error, but got %v", o.errs)
+		}
+		if _, ok := o.errs[0].(*TimeoutError); !ok {
+			t.Errorf("expected *TimeoutError, but got %v", o.errs[0])
+		}
+		if last := o.events[len(o.events)-1]; last != "after finalize success" {
+			t.Errorf("rollback must be notified, but got %s", o.events)
+		}
+	})
 }
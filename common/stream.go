@@ -0,0 +1,221 @@
+package common
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// streamVersion はストリームの形式の版数
+	streamVersion = 1
+	// streamChunkSize は 1 つのチャンクに含める平文の最大長
+	streamChunkSize = 64 * 1024
+	// streamPrefixSize は nonce のうち、ストリーム毎にランダムに生成する部分の長さ。
+	// nonce の残りはチャンクの番号 (4 byte) と最終チャンクであるかのフラグ (1 byte) からなる
+	streamPrefixSize = 7
+	// streamFrameHeaderSize は、各チャンクの先頭に付与するフラグ (1 byte) と暗号文の長さ (4 byte) の長さ
+	streamFrameHeaderSize = 5
+
+	// チャンクのフラグ
+	streamChunk      byte = 0
+	streamFinalChunk byte = 1
+)
+
+var (
+	// ErrTruncated は、暗号化されたストリームが最終チャンクの前で途切れていることを表現する
+	ErrTruncated = errors.New("encrypted stream is truncated")
+	// ErrTrailingData は、暗号化されたストリームの最終チャンクの後ろにデータが続いていることを表現する
+	ErrTrailingData = errors.New("unexpected data after final chunk")
+)
+
+// streamNonce は prefix、チャンクの番号 counter、フラグ flag から nonce を作成する。
+// フラグを nonce に含めることで、最終チャンクのフラグの改竄や、途中のチャンクでの切り詰めを検知できる
+func streamNonce(prefix []byte, counter uint32, flag byte) []byte {
+	nonce := make([]byte, streamPrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[streamPrefixSize:], counter)
+	nonce[streamPrefixSize+4] = flag
+	return nonce
+}
+
+// EncryptWriter は、書き込まれた平文をチャンク毎に AES/GCM で暗号化して w に書き込む io.WriteCloser。
+// 全体をメモリに読み込むことなく、大きなファイルを暗号化するために用いる。
+// 最終チャンクを書き込むため、書き込みの完了後は必ず Close を呼び出す必要がある。
+//
+// ストリームの形式は、版数 (1 byte)、nonce の prefix (7 byte) に続けて、
+// フラグ (1 byte)、暗号文の長さ (4 byte)、暗号文と認証タグからなるチャンクを連結したものとなる
+type EncryptWriter struct {
+	w      io.Writer
+	cipher *AesGcmCipher
+	prefix []byte
+	// 次に書き込むチャンクの番号
+	counter uint32
+	// 暗号化されていない平文
+	buf    []byte
+	closed bool
+}
+
+// NewEncryptWriter は、c で暗号化して w に書き込む EncryptWriter を返却する。ストリームの先頭部分はこの時点で w に書き込む
+func NewEncryptWriter(w io.Writer, c *AesGcmCipher) (*EncryptWriter, error) {
+	prefix := make([]byte, streamPrefixSize)
+	if _, err := io.ReadFull(c.random, prefix); err != nil {
+		return nil, errors.Wrap(err, "failed to generate nonce prefix")
+	}
+	if _, err := w.Write(append([]byte{streamVersion}, prefix...)); err != nil {
+		return nil, errors.Wrap(err, "failed to write stream header")
+	}
+	return &EncryptWriter{
+		w:      w,
+		cipher: c,
+		prefix: prefix,
+		buf:    make([]byte, 0, streamChunkSize),
+	}, nil
+}
+
+// Write は p をバッファし、チャンクの長さに達する度に暗号化して書き込む
+func (e *EncryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed EncryptWriter")
+	}
+	written := 0
+	for len(p) > 0 {
+		// 最終チャンクは Close で書き込むため、バッファが埋まっていても次の書き込みまで保持する
+		if len(e.buf) == streamChunkSize {
+			if err := e.flush(streamChunk); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):streamChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close はバッファされた平文を最終チャンクとして暗号化して書き込む。w は Close しない
+func (e *EncryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.flush(streamFinalChunk)
+}
+
+// flush はバッファされた平文を、フラグ flag のチャンクとして暗号化して書き込む
+func (e *EncryptWriter) flush(flag byte) error {
+	if e.counter == ^uint32(0) {
+		return errors.New("too many chunks in encrypted stream")
+	}
+	aead := e.cipher.aead
+	frame := make([]byte, streamFrameHeaderSize, streamFrameHeaderSize+len(e.buf)+aead.Overhead())
+	frame = aead.Seal(frame, streamNonce(e.prefix, e.counter, flag), e.buf, nil)
+	frame[0] = flag
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(frame)-streamFrameHeaderSize))
+
+	if _, err := e.w.Write(frame); err != nil {
+		return errors.Wrap(err, "failed to write encrypted chunk")
+	}
+	e.counter++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// DecryptReader は、EncryptWriter で暗号化されたストリームをチャンク毎に復号化して読み込む io.Reader。
+// チャンクの改竄や並べ替えを検知した場合は *AuthenticationError を、
+// 最終チャンクの前でストリームが途切れている場合は ErrTruncated を返却する
+type DecryptReader struct {
+	r      io.Reader
+	cipher *AesGcmCipher
+	prefix []byte
+	// 次に読み込むチャンクの番号
+	counter uint32
+	// 復号化済みで、まだ読み込まれていない平文
+	buf []byte
+	// 最終チャンクを読み込んだか
+	done bool
+	err  error
+}
+
+// NewDecryptReader は、r から読み込んだストリームを c で復号化する DecryptReader を返却する。
+// ストリームの先頭部分はこの時点で r から読み込む
+func NewDecryptReader(r io.Reader, c *AesGcmCipher) (*DecryptReader, error) {
+	header := make([]byte, 1+streamPrefixSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrTruncated
+		}
+		return nil, errors.Wrap(err, "failed to read stream header")
+	}
+	if header[0] != streamVersion {
+		return nil, errors.Errorf("unsupported stream version [%d]", header[0])
+	}
+	return &DecryptReader{r: r, cipher: c, prefix: header[1:]}, nil
+}
+
+// Read は復号化した平文を p に読み込む。最終チャンクまで読み込んだ場合は io.EOF を返却する
+func (d *DecryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.buf, d.err = d.next()
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// next は次のチャンクを読み込んで復号化する
+func (d *DecryptReader) next() ([]byte, error) {
+	header := make([]byte, streamFrameHeaderSize)
+	if err := readFull(d.r, header); err != nil {
+		return nil, err
+	}
+	flag, size := header[0], binary.BigEndian.Uint32(header[1:])
+	aead := d.cipher.aead
+	if flag != streamChunk && flag != streamFinalChunk {
+		return nil, &AuthenticationError{}
+	}
+	if size < uint32(aead.Overhead()) || size > uint32(streamChunkSize+aead.Overhead()) {
+		return nil, ErrInvalidLength
+	}
+
+	sealed := make([]byte, size)
+	if err := readFull(d.r, sealed); err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(sealed[:0], streamNonce(d.prefix, d.counter, flag), sealed, nil)
+	if err != nil {
+		return nil, &AuthenticationError{}
+	}
+	d.counter++
+
+	if flag == streamFinalChunk {
+		// 最終チャンクの後ろにデータが続く場合は、不正なストリームとして扱う。
+		// 0 byte を返却する Read もあるため、EOF となるまで読み込んで確認する
+		if n, err := io.ReadFull(d.r, make([]byte, 1)); n > 0 {
+			return nil, ErrTrailingData
+		} else if err != io.EOF {
+			return nil, errors.Wrap(err, "failed to read encrypted chunk")
+		}
+		d.done = true
+	}
+	return plain, nil
+}
+
+// readFull は r から b の長さだけ読み込む。途中で EOF となった場合は ErrTruncated を返却する
+func readFull(r io.Reader, b []byte) error {
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return errors.Wrap(err, "failed to read encrypted chunk")
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// encryptStream は plain を sut でストリームとして暗号化する
+func encryptStream(t *testing.T, sut *AesGcmCipher, plain []byte) []byte {
+	var out bytes.Buffer
+	w, err := NewEncryptWriter(&out, sut)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	// 書き込みの単位によらず暗号化できることを確認するため、長さを変えながら書き込む
+	for i := 1; len(plain) > 0; i = i*7 + 1 {
+		n := i % 100000
+		if n > len(plain) {
+			n = len(plain)
+		}
+		if _, err := w.Write(plain[:n]); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		plain = plain[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	return out.Bytes()
+}
+
+// decryptStream は encrypted を sut でストリームとして復号化する
+func decryptStream(sut *AesGcmCipher, encrypted []byte) ([]byte, error) {
+	r, err := NewDecryptReader(bytes.NewReader(encrypted), sut)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// emptyReader は、Read の度に、データを返却せずに 0 byte を返却することを交互に繰り返す io.Reader
+type emptyReader struct {
+	r     io.Reader
+	empty bool
+}
+
+func (r *emptyReader) Read(p []byte) (int, error) {
+	if r.empty = !r.empty; r.empty {
+		return 0, nil
+	}
+	return r.r.Read(p)
+}
+
+// errReader は、r を読み終えた後に err を返却する io.Reader
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		return n, r.err
+	}
+	return n, err
+}
+
+func TestStream(t *testing.T) {
+	sut := newAesGcmCipher(t)
+
+	t.Run("チャンクに分割して暗号化したストリームを復号できる", func(t *testing.T) {
+		for _, size := range []int{0, 1, streamChunkSize - 1, streamChunkSize, streamChunkSize + 1, 3*streamChunkSize + 100} {
+			plain := make([]byte, size)
+			rand.Read(plain)
+
+			encrypted := encryptStream(t, sut, plain)
+			decrypted, err := decryptStream(sut, encrypted)
+			if err != nil {
+				t.Fatalf("err must be nil with size [%d], but got %s", size, err)
+			}
+			if !bytes.Equal(decrypted, plain) {
+				t.Errorf("decrypted stream must equal to plain with size [%d]", size)
+			}
+		}
+	})
+
+	plain := bytes.Repeat([]byte("a"), 2*streamChunkSize+10)
+	encrypted := encryptStream(t, sut, plain)
+	// 2 つ目のチャンクの先頭
+	second := 1 + streamPrefixSize + streamFrameHeaderSize + streamChunkSize + sut.aead.Overhead()
+
+	t.Run("途中で途切れたストリームは ErrTruncated となる", func(t *testing.T) {
+		for _, l := range []int{0, 3, 1 + streamPrefixSize, 1 + streamPrefixSize + 2, second, second + 10, len(encrypted) - 1} {
+			if _, err := decryptStream(sut, encrypted[:l]); err != ErrTruncated {
+				t.Errorf("expected ErrTruncated with length [%d], but got %v", l, err)
+			}
+		}
+	})
+
+	t.Run("改竄や並べ替えを検知する", func(t *testing.T) {
+		// 暗号文の改竄
+		tampered := append([]byte{}, encrypted...)
+		tampered[second+streamFrameHeaderSize] ^= 0x01
+		// 途中のチャンクを最終チャンクに偽装
+		finalized := append([]byte{}, encrypted[:second]...)
+		finalized[1+streamPrefixSize] = streamFinalChunk
+		// 1 つ目のチャンクを削除
+		dropped := append(append([]byte{}, encrypted[:1+streamPrefixSize]...), encrypted[second:]...)
+
+		for name, b := range map[string][]byte{"改竄": tampered, "最終チャンクの偽装": finalized, "チャンクの削除": dropped} {
+			_, err := decryptStream(sut, b)
+			if _, ok := err.(*AuthenticationError); !ok {
+				t.Errorf("%s: expected AuthenticationError, but got %v", name, err)
+			}
+		}
+	})
+
+	t.Run("最終チャンクの後ろにデータが続くストリームはエラーとなる", func(t *testing.T) {
+		trailing := append(append([]byte{}, encrypted...), 0x00)
+		if _, err := decryptStream(sut, trailing); err != ErrTrailingData {
+			t.Errorf("expected ErrTrailingData, but got %v", err)
+		}
+
+		// 0 byte を返却する Read を挟んでも、後ろに続くデータを検知する
+		for _, tc := range []struct {
+			encrypted []byte
+			expected  error
+		}{
+			{encrypted: encrypted, expected: nil},
+			{encrypted: trailing, expected: ErrTrailingData},
+		} {
+			r, err := NewDecryptReader(&emptyReader{r: bytes.NewReader(tc.encrypted)}, sut)
+			if err != nil {
+				t.Fatalf("err must be nil, but got %s", err)
+			}
+			if _, err := ioutil.ReadAll(r); err != tc.expected {
+				t.Errorf("expected %v, but got %v", tc.expected, err)
+			}
+		}
+	})
+
+	t.Run("最終チャンクの後ろの読み込みに失敗した場合はエラーとなる", func(t *testing.T) {
+		r, err := NewDecryptReader(&errReader{r: bytes.NewReader(encrypted), err: io.ErrClosedPipe}, sut)
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Error("read error must be reported")
+		}
+	})
+
+	t.Run("Close 後の書き込みはエラーとなる", func(t *testing.T) {
+		w, _ := NewEncryptWriter(ioutil.Discard, sut)
+		w.Close()
+		if _, err := w.Write([]byte("a")); err == nil {
+			t.Error("write after close must fail")
+		}
+	})
+}
+
+func TestDecryptReaderImplementsReader(t *testing.T) {
+	var _ io.Reader = &DecryptReader{}
+	var _ io.WriteCloser = &EncryptWriter{}
+}
@@ -0,0 +1,177 @@
+package common
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Runnable は、初期化後に処理を継続して実行する Resource (gRPC サーバ等) が実装する Interface
+type Runnable interface {
+	// ctx がキャンセルされるまで処理を実行し、nil を返却する。処理を継続できなくなった場合はエラーを返却する
+	Run(ctx context.Context) error
+}
+
+// RestartPolicy は、ResourceManager.Run で実行が失敗したリソースを再起動する方針を表現する
+type RestartPolicy struct {
+	// 再起動の最大回数。失敗した初期化も 1 回と数える
+	MaxRestarts int
+	// 最初の再起動までの待機時間。再起動の度に 2 倍とする
+	InitialBackoff time.Duration
+	// 再起動までの待機時間の上限。0 以下の場合は上限を設けない
+	MaxBackoff time.Duration
+	// 実行がこの時間以上継続した後に失敗した場合は、再起動の回数と待機時間を最初に戻す。
+	// 0 以下の場合は MaxBackoff とし、いずれも 0 以下の場合は戻さない
+	StablePeriod time.Duration
+}
+
+// backoff は restarts 回目 (0 始まり) の再起動までの待機時間を返却する
+func (p RestartPolicy) backoff(restarts int) time.Duration {
+	d := p.InitialBackoff
+	for i := 0; i < restarts; i++ {
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// stable は、実行が uptime の間継続したことで、再起動の回数を最初に戻すかどうかを返却する
+func (p RestartPolicy) stable(uptime time.Duration) bool {
+	period := p.StablePeriod
+	if period <= 0 {
+		period = p.MaxBackoff
+	}
+	return period > 0 && uptime >= period
+}
+
+// SetRestartPolicy は、ResourceManager.Run で実行が失敗した場合に policy に従って再起動するリソースとして r を設定する
+func (m *ResourceManager) SetRestartPolicy(r Resource, policy RestartPolicy) *ResourceManager {
+	if m.restartPolicies == nil {
+		m.restartPolicies = make(map[string]RestartPolicy)
+	}
+	m.restartPolicies[r.Name()] = policy
+	return m
+}
+
+// OnRestart は、リソースの実行が失敗し、再起動を待機する際に呼び出される関数として fn を設定する。
+// fn には、失敗したリソースの名前、失敗の理由 err、何回目の再起動か、再起動までの待機時間が渡される
+func (m *ResourceManager) OnRestart(fn func(name string, err error, restarts int, backoff time.Duration)) *ResourceManager {
+	m.onRestart = fn
+	return m
+}
+
+// Run は、初期化済みのリソースのうち Runnable を実装するものを並行して実行し、ctx がキャンセルされるか、すべての実行が終了するまで待つ。
+// 実行が失敗したリソースに RestartPolicy が設定されている場合は、他のリソースの実行を継続したまま、
+// そのリソースの終了処理を行い、待機時間の後に初期化し直して再度実行する (状態の定期確認は再起動の間停止する)。
+// RestartPolicy が設定されていない場合や、再起動の回数が上限に達した場合は、他のリソースの実行も停止させ、そのエラーを返却する。
+// Initialize の完了後に呼び出す必要があり、FinalizeContext は Run の終了後に呼び出す必要がある
+func (m *ResourceManager) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	runnables := make([]int, 0)
+	for i, r := range m.resources {
+		if _, ok := r.(Runnable); ok && m.initialized[i] {
+			runnables = append(runnables, i)
+		}
+	}
+	errs := m.parallel(runnables, func(i int, r Resource) error {
+		err := m.supervise(ctx, runnables[i])
+		if err != nil {
+			cancel()
+		}
+		return err
+	})
+	if failed := compact(errs); len(failed) > 0 {
+		return failed[0]
+	}
+	return nil
+}
+
+// supervise は、添字が i のリソースを実行し、実行が失敗した場合は RestartPolicy に従って再起動する
+func (m *ResourceManager) supervise(ctx context.Context, i int) error {
+	r := m.resources[i]
+	policy, restartable := m.restartPolicies[r.Name()]
+	restarts := 0
+	for {
+		started := time.Now()
+		err := r.(Runnable).Run(ctx)
+		if err == nil {
+			return nil
+		}
+		if !restartable || ctx.Err() != nil {
+			return errors.Wrapf(err, "failed to run %s", r.Name())
+		}
+		// 安定して実行できていた場合は、新たな障害として最初から再起動する
+		if policy.stable(time.Since(started)) {
+			restarts = 0
+		}
+
+		// 再起動に成功するまで、終了処理、待機、初期化を繰り返す
+		for err != nil {
+			if restarts >= policy.MaxRestarts {
+				return errors.Wrapf(err, "failed to run %s after %d restarts", r.Name(), restarts)
+			}
+			m.stopResource(i)
+
+			backoff := policy.backoff(restarts)
+			restarts++
+			if m.onRestart != nil {
+				m.onRestart(r.Name(), err, restarts, backoff)
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+			err = m.startResource(i)
+		}
+	}
+}
+
+// stopResource は、初期化済みであれば、添字が i のリソースの終了処理を行う。
+// 終了処理のエラーは、続く初期化で改めて検出されるため無視する
+func (m *ResourceManager) stopResource(i int) {
+	m.restarting.Lock()
+	defer m.restarting.Unlock()
+	if !m.initialized[i] {
+		return
+	}
+
+	interval, timeout, monitoring := m.health.interval, m.health.timeout, m.health.stop != nil
+	m.stopHealthCheck()
+	if l, ok := m.resources[i].(LifecycleListener); ok {
+		l.OnFinalizing()
+	}
+	m.finalize(context.Background(), [][]int{{i}})
+	if monitoring {
+		m.StartHealthCheck(interval, timeout)
+	}
+}
+
+// startResource は添字が i のリソースを初期化し、成功した場合は LifecycleListener を実装していれば通知する
+func (m *ResourceManager) startResource(i int) error {
+	m.restarting.Lock()
+	defer m.restarting.Unlock()
+
+	interval, timeout, monitoring := m.health.interval, m.health.timeout, m.health.stop != nil
+	m.stopHealthCheck()
+	if monitoring {
+		defer m.StartHealthCheck(interval, timeout)
+	}
+
+	if err := m.parallelContext(context.Background(), time.Now(), []int{i}, phaseInitialize, initializeResource)[0]; err != nil {
+		return err
+	}
+	m.initialized[i] = true
+	if l, ok := m.resources[i].(LifecycleListener); ok {
+		l.OnInitialized()
+	}
+	return nil
+}
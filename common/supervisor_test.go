@@ -0,0 +1,199 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 実行が failures 回失敗した後、ctx がキャンセルされるまで実行を続ける Runnable
+type runnableResource struct {
+	name     string
+	failures int
+	// 実行が失敗するまでの時間
+	uptime time.Duration
+	mu     sync.Mutex
+	events []string
+	// 実行が失敗せずに開始された時点で close される
+	running chan struct{}
+}
+
+func newRunnableResource(name string, failures int) *runnableResource {
+	return &runnableResource{name: name, failures: failures, running: make(chan struct{})}
+}
+
+func (r *runnableResource) record(event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+func (r *runnableResource) Initialize() error {
+	r.record("initialize")
+	return nil
+}
+func (r *runnableResource) Finalize() error {
+	r.record("finalize")
+	return nil
+}
+func (r *runnableResource) Name() string {
+	return r.name
+}
+func (r *runnableResource) Run(ctx context.Context) error {
+	r.record("run")
+	r.mu.Lock()
+	if r.failures > 0 {
+		r.failures--
+		r.mu.Unlock()
+		time.Sleep(r.uptime)
+		return errors.New("serve failed")
+	}
+	r.mu.Unlock()
+
+	close(r.running)
+	<-ctx.Done()
+	return nil
+}
+
+func TestRestartPolicy_backoff(t *testing.T) {
+	p := RestartPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, e := range expected {
+		if actual := p.backoff(i); actual != e {
+			t.Errorf("restarts %d: expected %s, but got %s", i, e, actual)
+		}
+	}
+}
+
+func TestRestartPolicy_stable(t *testing.T) {
+	for _, tc := range []struct {
+		policy   RestartPolicy
+		uptime   time.Duration
+		expected bool
+	}{
+		{RestartPolicy{StablePeriod: time.Second}, time.Second, true},
+		{RestartPolicy{StablePeriod: time.Second}, time.Second - 1, false},
+		{RestartPolicy{MaxBackoff: time.Second}, time.Second, true},
+		{RestartPolicy{}, time.Hour, false},
+	} {
+		if actual := tc.policy.stable(tc.uptime); actual != tc.expected {
+			t.Errorf("%+v, uptime %s: expected %t, but got %t", tc.policy, tc.uptime, tc.expected, actual)
+		}
+	}
+}
+
+func TestResourceManager_Run(t *testing.T) {
+	policy := RestartPolicy{MaxRestarts: 2, InitialBackoff: time.Millisecond}
+
+	t.Run("実行が失敗したリソースのみを再起動する", func(t *testing.T) {
+		failing, other := newRunnableResource("failing", 2), newRunnableResource("other", 0)
+		var restarts []int
+		sut := NewResourceManager([]Resource{failing, other}).SetRestartPolicy(failing, policy).
+			OnRestart(func(name string, err error, n int, backoff time.Duration) {
+				restarts = append(restarts, n)
+			})
+		if err := sut.Initialize(); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- sut.Run(ctx)
+		}()
+		<-failing.running
+		cancel()
+		if err := <-errCh; err != nil {
+			t.Errorf("err must be nil, but got %s", err)
+		}
+
+		expected := []string{"initialize", "run", "finalize", "initialize", "run", "finalize", "initialize", "run"}
+		if !reflect.DeepEqual(failing.events, expected) {
+			t.Errorf("expected %s, but got %s", expected, failing.events)
+		}
+		if expected := []string{"initialize", "run"}; !reflect.DeepEqual(other.events, expected) {
+			t.Errorf("other resource must keep running, but got %s", other.events)
+		}
+		if expected := []int{1, 2}; !reflect.DeepEqual(restarts, expected) {
+			t.Errorf("expected %v, but got %v", expected, restarts)
+		}
+
+		// 再起動したリソースも終了処理の対象とする
+		if errs := sut.Finalize(); len(errs) != 0 {
+			t.Errorf("err must be nil, but got %s", errs)
+		}
+		if last := failing.events[len(failing.events)-1]; last != "finalize" {
+			t.Errorf("restarted resource must be finalized, but got %s", failing.events)
+		}
+	})
+
+	t.Run("再起動の回数が上限に達した場合は、他のリソースも停止してエラーを返却する", func(t *testing.T) {
+		failing, other := newRunnableResource("failing", 3), newRunnableResource("other", 0)
+		sut := NewResourceManager([]Resource{failing, other}).SetRestartPolicy(failing, policy)
+		if err := sut.Initialize(); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+
+		err := sut.Run(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "failed to run failing after 2 restarts") {
+			t.Errorf("expected restart limit error, but got %v", err)
+		}
+		if errs := sut.Finalize(); len(errs) != 0 {
+			t.Errorf("err must be nil, but got %s", errs)
+		}
+	})
+
+	t.Run("安定して実行できていた場合は、再起動の回数を最初に戻す", func(t *testing.T) {
+		failing := newRunnableResource("failing", 3)
+		failing.uptime = 20 * time.Millisecond
+		var restarts []int
+		var backoffs []time.Duration
+		sut := NewResourceManager([]Resource{failing}).
+			SetRestartPolicy(failing, RestartPolicy{MaxRestarts: 1, InitialBackoff: time.Millisecond, StablePeriod: 10 * time.Millisecond}).
+			OnRestart(func(name string, err error, n int, backoff time.Duration) {
+				restarts = append(restarts, n)
+				backoffs = append(backoffs, backoff)
+			})
+		if err := sut.Initialize(); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- sut.Run(ctx)
+		}()
+		<-failing.running
+		cancel()
+		if err := <-errCh; err != nil {
+			t.Errorf("err must be nil, but got %s", err)
+		}
+		if expected := []int{1, 1, 1}; !reflect.DeepEqual(restarts, expected) {
+			t.Errorf("expected %v, but got %v", expected, restarts)
+		}
+		if expected := []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond}; !reflect.DeepEqual(backoffs, expected) {
+			t.Errorf("expected %v, but got %v", expected, backoffs)
+		}
+		if errs := sut.Finalize(); len(errs) != 0 {
+			t.Errorf("err must be nil, but got %s", errs)
+		}
+	})
+
+	t.Run("再起動の方針がない場合は、再起動せずにエラーを返却する", func(t *testing.T) {
+		failing := newRunnableResource("failing", 1)
+		sut := NewResourceManager([]Resource{failing})
+		if err := sut.Initialize(); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+
+		if err := sut.Run(context.Background()); err == nil {
+			t.Error("error should be occured, but got success")
+		}
+		if expected := []string{"initialize", "run"}; !reflect.DeepEqual(failing.events, expected) {
+			t.Errorf("expected %s, but got %s", expected, failing.events)
+		}
+	})
+}
@@ -0,0 +1,125 @@
+package router
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiririmode/grpc-sandbox/common/conf"
+	"github.com/kiririmode/grpc-sandbox/common/log"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// accessLogger は 1 つの RPC につき 1 件のアクセスログを出力する Interceptor を提供する
+type accessLogger struct {
+	log *log.Log
+
+	mu sync.RWMutex
+	// アクセスログを出力しないメソッド (ex. /helloworld.Greeter/SayHello)
+	excludeMethods map[string]bool
+	// アクセスログに出力するリクエストメタデータのキー
+	metadataKeys []string
+}
+
+// newAccessLogger は log.access.* の設定に基いた accessLogger を返却する。
+// log.access.enabled が false の場合は nil を返却する
+func newAccessLogger(c *conf.Configuration, l *log.Log) *accessLogger {
+	if !c.GetBool("log.access.enabled") {
+		return nil
+	}
+
+	a := &accessLogger{log: l}
+	a.configure(c)
+	return a
+}
+
+// configure は log.access.exclude_methods と log.access.metadata_keys の設定を反映する
+func (a *accessLogger) configure(c *conf.Configuration) {
+	excludes := make(map[string]bool)
+	for _, m := range c.GetStringSlice("log.access.exclude_methods") {
+		excludes[m] = true
+	}
+	keys := c.GetStringSlice("log.access.metadata_keys")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.excludeMethods, a.metadataKeys = excludes, keys
+}
+
+// excluded は method のアクセスログを出力しないかを返却する
+func (a *accessLogger) excluded(method string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.excludeMethods[method]
+}
+
+// UnaryServerInterceptor は Unary RPC のアクセスログを出力する Interceptor を返却する
+func (a *accessLogger) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if a.excluded(info.FullMethod) {
+			return handler(ctx, req)
+		}
+
+		start := time.Now()
+		res, err := handler(ctx, req)
+
+		a.write(ctx, info.FullMethod, start, err, logrus.Fields{
+			"request_size":  messageSize(req),
+			"response_size": messageSize(res),
+		})
+		return res, err
+	}
+}
+
+// StreamServerInterceptor は Streaming RPC のアクセスログを出力する Interceptor を返却する。
+// ストリームの終了時に、送受信したメッセージの数とバイト数を含めて 1 件出力する
+func (a *accessLogger) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if a.excluded(info.FullMethod) {
+			return handler(srv, ss)
+		}
+
+		start := time.Now()
+		stream := &countingServerStream{ServerStream: ss}
+		err := handler(srv, stream)
+
+		a.write(ss.Context(), info.FullMethod, start, err, logrus.Fields{
+			"request_size":      stream.receivedBytes,
+			"response_size":     stream.sentBytes,
+			"request_messages":  stream.receivedMessages,
+			"response_messages": stream.sentMessages,
+		})
+		return err
+	}
+}
+
+// write は RPC の結果をアクセスログとして出力する
+func (a *accessLogger) write(ctx context.Context, method string, start time.Time, err error, fields logrus.Fields) {
+	fields["method"] = method
+	fields["code"] = status.Code(err).String()
+	fields["latency_ms"] = float64(time.Since(start)) / float64(time.Millisecond)
+
+	if p, ok := peer.FromContext(ctx); ok {
+		fields["peer"] = p.Addr.String()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		a.mu.RLock()
+		keys := a.metadataKeys
+		a.mu.RUnlock()
+		for _, key := range keys {
+			if values := md.Get(key); len(values) > 0 {
+				fields["md."+key] = strings.Join(values, ",")
+			}
+		}
+	}
+	if err != nil {
+		fields["error"] = status.Convert(err).Message()
+	}
+
+	a.log.Logger.WithFields(fields).Info("access")
+}
@@ -0,0 +1,273 @@
+package fault
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/kiririmode/grpc-sandbox/common/conf"
+	"github.com/pkg/errors"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// ErrorRuleConfig は fault.errors に記述するエラー注入ルールの設定を表現する
+type ErrorRuleConfig struct {
+	Matcher `mapstructure:",squash"`
+	// 返却するステータスコード (ex. DEADLINE_EXCEEDED, Unavailable)
+	Code string `mapstructure:"code"`
+	// 返却するエラーメッセージ
+	Message string `mapstructure:"message"`
+	// 返却するエラーの詳細
+	Details DetailsConfig `mapstructure:"details"`
+	// 条件を満たす RPC のうち、エラーを返却する割合 (%)。0 より大きく 100 以下とし、省略した場合は常に返却する
+	Percentage *float64 `mapstructure:"percentage"`
+	// 条件を満たす RPC のうち、最初の First 件にのみエラーを返却する。0 の場合は件数を制限しない
+	First int64 `mapstructure:"first"`
+}
+
+// DetailsConfig は google.rpc.Status の details に含めるエラーの詳細を表現する
+type DetailsConfig struct {
+	RetryInfo *struct {
+		RetryDelay time.Duration `mapstructure:"retry_delay"`
+	} `mapstructure:"retry_info"`
+	DebugInfo *struct {
+		StackEntries []string `mapstructure:"stack_entries"`
+		Detail       string   `mapstructure:"detail"`
+	} `mapstructure:"debug_info"`
+	QuotaFailure *struct {
+		Violations []struct {
+			Subject     string `mapstructure:"subject"`
+			Description string `mapstructure:"description"`
+		} `mapstructure:"violations"`
+	} `mapstructure:"quota_failure"`
+	BadRequest *struct {
+		FieldViolations []struct {
+			Field       string `mapstructure:"field"`
+			Description string `mapstructure:"description"`
+		} `mapstructure:"field_violations"`
+	} `mapstructure:"bad_request"`
+	LocalizedMessage *struct {
+		Locale  string `mapstructure:"locale"`
+		Message string `mapstructure:"message"`
+	} `mapstructure:"localized_message"`
+}
+
+// messages はエラーの詳細を protobuf のメッセージとして返却する
+func (d *DetailsConfig) messages() []proto.Message {
+	msgs := make([]proto.Message, 0)
+	if d.RetryInfo != nil {
+		msgs = append(msgs, &errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(d.RetryInfo.RetryDelay)})
+	}
+	if d.DebugInfo != nil {
+		msgs = append(msgs, &errdetails.DebugInfo{StackEntries: d.DebugInfo.StackEntries, Detail: d.DebugInfo.Detail})
+	}
+	if d.QuotaFailure != nil {
+		qf := &errdetails.QuotaFailure{}
+		for _, v := range d.QuotaFailure.Violations {
+			qf.Violations = append(qf.Violations, &errdetails.QuotaFailure_Violation{Subject: v.Subject, Description: v.Description})
+		}
+		msgs = append(msgs, qf)
+	}
+	if d.BadRequest != nil {
+		br := &errdetails.BadRequest{}
+		for _, v := range d.BadRequest.FieldViolations {
+			br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{Field: v.Field, Description: v.Description})
+		}
+		msgs = append(msgs, br)
+	}
+	if d.LocalizedMessage != nil {
+		msgs = append(msgs, &errdetails.LocalizedMessage{Locale: d.LocalizedMessage.Locale, Message: d.LocalizedMessage.Message})
+	}
+	return msgs
+}
+
+// ParseCode は gRPC のステータスコードの名前 (ex. DEADLINE_EXCEEDED, DeadlineExceeded) または数値を codes.Code に変換する
+func ParseCode(s string) (codes.Code, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < int(codes.OK) || n > int(codes.Unauthenticated) {
+			return codes.Unknown, errors.Errorf("illegal status code [%s]", s)
+		}
+		return codes.Code(n), nil
+	}
+
+	// proto の定義上の名前は CANCELLED だが、codes.Canceled の名前は Canceled である
+	if strings.EqualFold(s, "CANCELLED") {
+		return codes.Canceled, nil
+	}
+	name := strings.Replace(s, "_", "", -1)
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if strings.EqualFold(name, c.String()) {
+			return c, nil
+		}
+	}
+	return codes.Unknown, errors.Errorf("illegal status code [%s]", s)
+}
+
+// errorRule は設定から作成した、実行時に用いるエラー注入ルール
+type errorRule struct {
+	matcher    Matcher
+	status     *status.Status
+	percentage float64
+	first      int64
+	// 条件を満たした RPC の件数
+	matched int64
+}
+
+// newErrorRule は設定 c からエラー注入ルールを作成する
+func newErrorRule(c ErrorRuleConfig) (*errorRule, error) {
+	if err := c.Matcher.Validate(); err != nil {
+		return nil, err
+	}
+	code, err := ParseCode(c.Code)
+	if err != nil {
+		return nil, err
+	}
+	if code == codes.OK {
+		return nil, errors.Errorf("status code OK can not be injected as an error")
+	}
+	percentage := 100.0
+	if c.Percentage != nil {
+		if percentage = *c.Percentage; percentage <= 0 || percentage > 100 {
+			return nil, errors.Errorf("percentage must be greater than 0 and at most 100, but got [%g]", percentage)
+		}
+	}
+	if c.First < 0 {
+		return nil, errors.Errorf("first must not be negative, but got [%d]", c.First)
+	}
+
+	st := status.New(code, c.Message)
+	if details := c.Details.messages(); len(details) > 0 {
+		if st, err = st.WithDetails(details...); err != nil {
+			return nil, errors.Wrap(err, "failed to attach error details")
+		}
+	}
+	return &errorRule{
+		matcher:    c.Matcher,
+		status:     st,
+		percentage: percentage,
+		first:      c.First,
+	}, nil
+}
+
+// ErrorInjector は設定されたルールに従い、RPC にエラーを注入する
+type ErrorInjector struct {
+	config *conf.Configuration
+	rules  []*errorRule
+	// 0 以上 1 未満の乱数を返却する
+	random func() float64
+}
+
+// NewErrorInjector は、設定 c の fault.errors に記述されたルールに従う ErrorInjector を返却する
+func NewErrorInjector(c *conf.Configuration) *ErrorInjector {
+	return &ErrorInjector{
+		config: c,
+		random: rand.Float64,
+	}
+}
+
+// Name は初期化対象である "error injector" を返却する
+func (e *ErrorInjector) Name() string {
+	return "error injector"
+}
+
+// Dependencies は configuration に依存することを返却する
+func (e *ErrorInjector) Dependencies() []string {
+	return []string{e.config.Name()}
+}
+
+// Initialize は fault.errors からエラー注入ルールを読み込む
+func (e *ErrorInjector) Initialize() error {
+	var configs []ErrorRuleConfig
+	if err := e.config.UnmarshalKey("fault.errors", &configs); err != nil {
+		return err
+	}
+
+	rules := make([]*errorRule, 0, len(configs))
+	for i, c := range configs {
+		r, err := newErrorRule(c)
+		if err != nil {
+			return errors.Wrapf(err, "illegal error rule fault.errors[%d]", i)
+		}
+		rules = append(rules, r)
+	}
+	e.rules = rules
+	return nil
+}
+
+// Finalize は何も実行しない
+func (e *ErrorInjector) Finalize() error {
+	return nil
+}
+
+// inject は RPC に注入するエラーを返却する。エラーを注入しない場合は nil を返却する。
+// 条件を満たす最初のルールのみが評価され、割合・件数の制限によりエラーを返却しない場合もそこで評価を終える。
+// requestOnly が true の場合、リクエストメッセージを条件とするルールのみを評価する
+func (e *ErrorInjector) inject(method string, md metadata.MD, req interface{}, requestOnly bool) error {
+	for _, r := range e.rules {
+		if requestOnly && len(r.matcher.Request) == 0 {
+			continue
+		}
+		if !r.matcher.Match(method, md, req) {
+			continue
+		}
+
+		n := atomic.AddInt64(&r.matched, 1)
+		if r.first > 0 && n > r.first {
+			return nil
+		}
+		if r.percentage < 100 && e.random()*100 >= r.percentage {
+			return nil
+		}
+		return r.status.Err()
+	}
+	return nil
+}
+
+// UnaryServerInterceptor は、ルールの条件を満たす Unary RPC に対し、ハンドラを呼び出さずにエラーを返却する Interceptor を返却する
+func (e *ErrorInjector) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if err := e.inject(info.FullMethod, md, req, false); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor は、Streaming RPC にエラーを注入する Interceptor を返却する。
+// メソッド名とメタデータのみを条件とするルールはストリームの開始時に、
+// リクエストメッセージを条件とするルールはメッセージの受信時に評価され、条件を満たすとその時点でストリームをエラーで終了する
+func (e *ErrorInjector) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		if err := e.inject(info.FullMethod, md, nil, false); err != nil {
+			return err
+		}
+		return handler(srv, &injectedServerStream{ServerStream: ss, injector: e, method: info.FullMethod, md: md})
+	}
+}
+
+// injectedServerStream は、受信したメッセージに対してエラー注入ルールを評価する grpc.ServerStream
+type injectedServerStream struct {
+	grpc.ServerStream
+	injector *ErrorInjector
+	method   string
+	md       metadata.MD
+}
+
+// RecvMsg は m にメッセージを受信し、ルールの条件を満たす場合は注入するエラーを返却する
+func (s *injectedServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.injector.inject(s.method, s.md, m, true)
+}
@@ -0,0 +1,207 @@
+package fault
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/kiririmode/grpc-sandbox/common/conf"
+	"github.com/kiririmode/grpc-sandbox/helloworld"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseCode(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected codes.Code
+	}{
+		{value: "DEADLINE_EXCEEDED", expected: codes.DeadlineExceeded},
+		{value: "DeadlineExceeded", expected: codes.DeadlineExceeded},
+		{value: "unavailable", expected: codes.Unavailable},
+		{value: "CANCELLED", expected: codes.Canceled},
+		{value: "8", expected: codes.ResourceExhausted},
+	}
+	for _, tc := range testCases {
+		actual, err := ParseCode(tc.value)
+		if err != nil {
+			t.Errorf("err must be nil, but got %s", err)
+		}
+		if actual != tc.expected {
+			t.Errorf("expected %s, but got %s", tc.expected, actual)
+		}
+	}
+
+	for _, v := range []string{"hoge", "17", "-1"} {
+		if _, err := ParseCode(v); err == nil {
+			t.Errorf("status code %s is illegal, but no error occured", v)
+		}
+	}
+}
+
+// newErrorInjector は config を設定とする、初期化済みの ErrorInjector を返却する
+func newErrorInjector(t *testing.T, config string) *ErrorInjector {
+	c, err := conf.NewConfigurationFromReader("yaml", strings.NewReader(config))
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	e := NewErrorInjector(c)
+	if err := e.Initialize(); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	return e
+}
+
+func TestErrorInjector_Initialize(t *testing.T) {
+	for _, config := range []string{
+		"fault:\n  errors:\n    - code: hoge\n",
+		"fault:\n  errors:\n    - code: OK\n",
+		"fault:\n  errors:\n    - method: \"[\"\n      code: INTERNAL\n",
+		"fault:\n  errors:\n    - code: INTERNAL\n      percentage: 0\n",
+		"fault:\n  errors:\n    - code: INTERNAL\n      percentage: -10\n",
+		"fault:\n  errors:\n    - code: INTERNAL\n      percentage: 100.5\n",
+		"fault:\n  errors:\n    - code: INTERNAL\n      first: -1\n",
+	} {
+		c, err := conf.NewConfigurationFromReader("yaml", strings.NewReader(config))
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if err := NewErrorInjector(c).Initialize(); err == nil {
+			t.Errorf("illegal rule must be rejected: %s", config)
+		}
+	}
+}
+
+func TestErrorInjector_UnaryServerInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/helloworld.Greeter/SayHello"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &helloworld.HelloReply{}, nil
+	}
+	call := func(e *ErrorInjector, ctx context.Context, name string) error {
+		_, err := e.UnaryServerInterceptor()(ctx, &helloworld.HelloRequest{Name: name}, info, handler)
+		return err
+	}
+
+	t.Run("条件を満たすとステータスコード・メッセージ・詳細を返却する", func(t *testing.T) {
+		sut := newErrorInjector(t, `
+fault:
+  errors:
+    - request:
+        name: error
+      code: UNAVAILABLE
+      message: unavailable
+      details:
+        retry_info:
+          retry_delay: 3s
+`)
+		if err := call(sut, context.Background(), "world"); err != nil {
+			t.Errorf("err must be nil, but got %s", err)
+		}
+
+		st := status.Convert(call(sut, context.Background(), "error"))
+		if st.Code() != codes.Unavailable || st.Message() != "unavailable" {
+			t.Errorf("expected unavailable, but got %s", st.Err())
+		}
+		details := st.Details()
+		if len(details) != 1 {
+			t.Fatalf("expected 1 detail, but got %d", len(details))
+		}
+		if ri, ok := details[0].(*errdetails.RetryInfo); !ok || ri.RetryDelay.Seconds != 3 {
+			t.Errorf("expected retry info with 3s delay, but got %v", details[0])
+		}
+	})
+
+	t.Run("最初の N 件のみエラーを返却する", func(t *testing.T) {
+		sut := newErrorInjector(t, "fault:\n  errors:\n    - code: RESOURCE_EXHAUSTED\n      first: 2\n")
+		expected := []codes.Code{codes.ResourceExhausted, codes.ResourceExhausted, codes.OK, codes.OK}
+		for i, e := range expected {
+			if actual := status.Code(call(sut, context.Background(), "world")); actual != e {
+				t.Errorf("call %d: expected %s, but got %s", i, e, actual)
+			}
+		}
+	})
+
+	t.Run("割合が 100 の場合は常にエラーを返却する", func(t *testing.T) {
+		sut := newErrorInjector(t, "fault:\n  errors:\n    - code: DEADLINE_EXCEEDED\n      percentage: 100\n")
+		sut.random = func() float64 { return 0.999 }
+		if actual := status.Code(call(sut, context.Background(), "world")); actual != codes.DeadlineExceeded {
+			t.Errorf("expected %s, but got %s", codes.DeadlineExceeded, actual)
+		}
+	})
+
+	t.Run("指定した割合でエラーを返却する", func(t *testing.T) {
+		sut := newErrorInjector(t, "fault:\n  errors:\n    - code: DEADLINE_EXCEEDED\n      percentage: 30\n")
+		for _, tc := range []struct {
+			random   float64
+			expected codes.Code
+		}{
+			{random: 0.29, expected: codes.DeadlineExceeded},
+			{random: 0.30, expected: codes.OK},
+		} {
+			sut.random = func() float64 { return tc.random }
+			if actual := status.Code(call(sut, context.Background(), "world")); actual != tc.expected {
+				t.Errorf("random %f: expected %s, but got %s", tc.random, tc.expected, actual)
+			}
+		}
+	})
+
+	t.Run("メタデータを条件にできる", func(t *testing.T) {
+		sut := newErrorInjector(t, "fault:\n  errors:\n    - metadata:\n        x-fault: internal\n      code: INTERNAL\n")
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-fault", "internal"))
+		if actual := status.Code(call(sut, ctx, "world")); actual != codes.Internal {
+			t.Errorf("expected %s, but got %s", codes.Internal, actual)
+		}
+	})
+}
+
+// recvServerStream は msgs を順に受信する grpc.ServerStream
+type recvServerStream struct {
+	grpc.ServerStream
+	msgs []*helloworld.HelloRequest
+}
+
+func (s *recvServerStream) Context() context.Context {
+	return context.Background()
+}
+func (s *recvServerStream) RecvMsg(m interface{}) error {
+	if len(s.msgs) == 0 {
+		return io.EOF
+	}
+	msg := m.(*helloworld.HelloRequest)
+	msg.Reset()
+	proto.Merge(msg, s.msgs[0])
+	s.msgs = s.msgs[1:]
+	return nil
+}
+
+func TestErrorInjector_StreamServerInterceptor(t *testing.T) {
+	sut := newErrorInjector(t, "fault:\n  errors:\n    - request:\n        name: error\n      code: INTERNAL\n")
+	info := &grpc.StreamServerInfo{FullMethod: "/helloworld.Greeter/SayHelloToMany"}
+
+	received := 0
+	handler := func(srv interface{}, ss grpc.ServerStream) error {
+		for {
+			if err := ss.RecvMsg(&helloworld.HelloRequest{}); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			received++
+		}
+	}
+
+	stream := &recvServerStream{msgs: []*helloworld.HelloRequest{{Name: "world"}, {Name: "error"}, {Name: "world"}}}
+	err := sut.StreamServerInterceptor()(nil, stream, info, handler)
+	if status.Code(err) != codes.Internal {
+		t.Errorf("expected %s, but got %s", codes.Internal, status.Code(err))
+	}
+	if received != 1 {
+		t.Errorf("stream must be terminated at 2nd message, but received %d messages", received)
+	}
+}
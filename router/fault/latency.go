@@ -0,0 +1,263 @@
+package fault
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/kiririmode/grpc-sandbox/common/conf"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// LatencyRuleConfig は fault.latencies に記述する遅延注入ルールの設定を表現する。
+// 遅延は Fixed, Uniform, Percentiles のいずれか 1 つで指定する
+type LatencyRuleConfig struct {
+	Matcher `mapstructure:",squash"`
+	// 固定の遅延
+	Fixed time.Duration `mapstructure:"fixed"`
+	// Min 以上 Max 以下の一様分布に従う遅延
+	Uniform *struct {
+		Min time.Duration `mapstructure:"min"`
+		Max time.Duration `mapstructure:"max"`
+	} `mapstructure:"uniform"`
+	// パーセンタイル毎の遅延。各点の間は線形に補間する
+	Percentiles []struct {
+		Percentile float64       `mapstructure:"percentile"`
+		Delay      time.Duration `mapstructure:"delay"`
+	} `mapstructure:"percentiles"`
+	// Streaming RPC の場合に、ストリームの開始時ではなく、メッセージの送信毎に遅延させる
+	PerMessage bool `mapstructure:"per_message"`
+}
+
+// percentilePoint はパーセンタイルとその遅延の組を表現する
+type percentilePoint struct {
+	percentile float64
+	delay      time.Duration
+}
+
+// distribution は遅延の分布を表現する。random は 0 以上 1 未満の乱数を返却する
+type distribution func(random func() float64) time.Duration
+
+// newDistribution は設定 c から遅延の分布を作成する
+func newDistribution(c LatencyRuleConfig) (distribution, error) {
+	specified := 0
+	if c.Fixed > 0 {
+		specified++
+	}
+	if c.Uniform != nil {
+		specified++
+	}
+	if len(c.Percentiles) > 0 {
+		specified++
+	}
+	if specified != 1 {
+		return nil, errors.Errorf("specify exactly one of \"fixed\", \"uniform\" or \"percentiles\"")
+	}
+
+	switch {
+	case c.Fixed > 0:
+		fixed := c.Fixed
+		return func(func() float64) time.Duration {
+			return fixed
+		}, nil
+	case c.Uniform != nil:
+		min, max := c.Uniform.Min, c.Uniform.Max
+		if min < 0 || max < min {
+			return nil, errors.Errorf("illegal uniform range [%s, %s]", min, max)
+		}
+		return func(random func() float64) time.Duration {
+			return min + time.Duration(random()*float64(max-min))
+		}, nil
+	}
+
+	// パーセンタイル 0 の遅延は 0 とする
+	points := []percentilePoint{{percentile: 0, delay: 0}}
+	for _, p := range c.Percentiles {
+		last := points[len(points)-1]
+		if p.Percentile <= last.percentile || p.Percentile > 100 {
+			return nil, errors.Errorf("percentiles must be in ascending order within (0, 100], but got [%g]", p.Percentile)
+		}
+		if p.Delay < last.delay {
+			return nil, errors.Errorf("delays must not decrease as percentile increases, but got [%s] at [%g]", p.Delay, p.Percentile)
+		}
+		points = append(points, percentilePoint{percentile: p.Percentile, delay: p.Delay})
+	}
+	return func(random func() float64) time.Duration {
+		return samplePercentiles(points, random()*100)
+	}, nil
+}
+
+// samplePercentiles はパーセンタイル p における遅延を、points を線形に補間して返却する。
+// p が最大のパーセンタイルを超える場合は、最大のパーセンタイルの遅延を返却する
+func samplePercentiles(points []percentilePoint, p float64) time.Duration {
+	for i := 1; i < len(points); i++ {
+		lower, upper := points[i-1], points[i]
+		if p <= upper.percentile {
+			ratio := (p - lower.percentile) / (upper.percentile - lower.percentile)
+			return lower.delay + time.Duration(ratio*float64(upper.delay-lower.delay))
+		}
+	}
+	return points[len(points)-1].delay
+}
+
+// latencyRule は設定から作成した、実行時に用いる遅延注入ルール
+type latencyRule struct {
+	matcher      Matcher
+	distribution distribution
+	perMessage   bool
+}
+
+// LatencyInjector は設定されたルールに従い、RPC の処理を遅延させる
+type LatencyInjector struct {
+	config *conf.Configuration
+	rules  []*latencyRule
+	// 0 以上 1 未満の乱数を返却する
+	random func() float64
+}
+
+// NewLatencyInjector は、設定 c の fault.latencies に記述されたルールに従う LatencyInjector を返却する
+func NewLatencyInjector(c *conf.Configuration) *LatencyInjector {
+	return &LatencyInjector{
+		config: c,
+		random: rand.Float64,
+	}
+}
+
+// Name は初期化対象である "latency injector" を返却する
+func (l *LatencyInjector) Name() string {
+	return "latency injector"
+}
+
+// Dependencies は configuration に依存することを返却する
+func (l *LatencyInjector) Dependencies() []string {
+	return []string{l.config.Name()}
+}
+
+// Initialize は fault.latencies から遅延注入ルールを読み込む
+func (l *LatencyInjector) Initialize() error {
+	var configs []LatencyRuleConfig
+	if err := l.config.UnmarshalKey("fault.latencies", &configs); err != nil {
+		return err
+	}
+
+	rules := make([]*latencyRule, 0, len(configs))
+	for i, c := range configs {
+		if err := c.Matcher.Validate(); err != nil {
+			return errors.Wrapf(err, "illegal latency rule fault.latencies[%d]", i)
+		}
+		d, err := newDistribution(c)
+		if err != nil {
+			return errors.Wrapf(err, "illegal latency rule fault.latencies[%d]", i)
+		}
+		rules = append(rules, &latencyRule{matcher: c.Matcher, distribution: d, perMessage: c.PerMessage})
+	}
+	l.rules = rules
+	return nil
+}
+
+// Finalize は何も実行しない
+func (l *LatencyInjector) Finalize() error {
+	return nil
+}
+
+// find は条件を満たす最初のルールを返却する。条件を満たすルールがない場合は nil を返却する。
+// requestOnly が true の場合、リクエストメッセージを条件とするルールのみを評価する
+func (l *LatencyInjector) find(method string, md metadata.MD, req interface{}, requestOnly bool) *latencyRule {
+	for _, r := range l.rules {
+		if requestOnly && len(r.matcher.Request) == 0 {
+			continue
+		}
+		if r.matcher.Match(method, md, req) {
+			return r
+		}
+	}
+	return nil
+}
+
+// delay は r の分布に従って遅延させる。r が nil の場合は遅延させない
+func (l *LatencyInjector) delay(ctx context.Context, r *latencyRule) error {
+	if r == nil {
+		return nil
+	}
+	return sleep(ctx, r.distribution(l.random))
+}
+
+// sleep は d だけ処理を停止する。停止中に ctx が終了した場合は、その理由に応じたステータスのエラーを返却する
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+		}
+		return status.Error(codes.Canceled, ctx.Err().Error())
+	}
+}
+
+// UnaryServerInterceptor は、ルールの条件を満たす Unary RPC のハンドラの呼び出しを遅延させる Interceptor を返却する
+func (l *LatencyInjector) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if err := l.delay(ctx, l.find(info.FullMethod, md, req, false)); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor は、Streaming RPC を遅延させる Interceptor を返却する。
+// メソッド名とメタデータのみを条件とするルールはストリームの開始時に評価され、per_message が指定されていれば
+// メッセージの送信毎に、そうでなければストリームの開始時に 1 度だけ遅延させる。
+// リクエストメッセージを条件とするルールはメッセージの受信時に評価され、条件を満たしたメッセージの受信を遅延させる
+func (l *LatencyInjector) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := ss.Context()
+		md, _ := metadata.FromIncomingContext(ctx)
+
+		stream := &delayedServerStream{ServerStream: ss, injector: l, method: info.FullMethod, md: md}
+		r := l.find(info.FullMethod, md, nil, false)
+		if r != nil && r.perMessage {
+			stream.sendRule = r
+		} else if err := l.delay(ctx, r); err != nil {
+			return err
+		}
+		return handler(srv, stream)
+	}
+}
+
+// delayedServerStream は、メッセージの送受信を遅延させる grpc.ServerStream
+type delayedServerStream struct {
+	grpc.ServerStream
+	injector *LatencyInjector
+	method   string
+	md       metadata.MD
+	// メッセージの送信毎に適用するルール
+	sendRule *latencyRule
+}
+
+// SendMsg は遅延させた上で m を送信する
+func (s *delayedServerStream) SendMsg(m interface{}) error {
+	if err := s.injector.delay(s.Context(), s.sendRule); err != nil {
+		return err
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+// RecvMsg は m にメッセージを受信し、ルールの条件を満たす場合は遅延させた上で返却する
+func (s *delayedServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.injector.delay(s.Context(), s.injector.find(s.method, s.md, m, true))
+}
@@ -0,0 +1,142 @@
+package fault
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiririmode/grpc-sandbox/common/conf"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newLatencyInjector は config を設定とする、初期化済みの LatencyInjector を返却する
+func newLatencyInjector(t *testing.T, config string) *LatencyInjector {
+	c, err := conf.NewConfigurationFromReader("yaml", strings.NewReader(config))
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	l := NewLatencyInjector(c)
+	if err := l.Initialize(); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	return l
+}
+
+func TestLatencyInjector_Initialize(t *testing.T) {
+	for _, config := range []string{
+		// 遅延の指定がない
+		"fault:\n  latencies:\n    - method: /helloworld.Greeter/SayHello\n",
+		// 遅延の指定が複数ある
+		"fault:\n  latencies:\n    - fixed: 1s\n      uniform: {min: 1s, max: 2s}\n",
+		// 範囲が逆転している
+		"fault:\n  latencies:\n    - uniform: {min: 2s, max: 1s}\n",
+		// パーセンタイルが昇順でない
+		"fault:\n  latencies:\n    - percentiles: [{percentile: 90, delay: 1s}, {percentile: 50, delay: 2s}]\n",
+	} {
+		c, err := conf.NewConfigurationFromReader("yaml", strings.NewReader(config))
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if err := NewLatencyInjector(c).Initialize(); err == nil {
+			t.Errorf("illegal rule must be rejected: %s", config)
+		}
+	}
+}
+
+func TestLatencyInjector_distribution(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   string
+		random   float64
+		expected time.Duration
+	}{
+		{name: "固定", config: "fixed: 100ms", random: 0.7, expected: 100 * time.Millisecond},
+		{name: "一様分布", config: "uniform: {min: 100ms, max: 200ms}", random: 0.25, expected: 125 * time.Millisecond},
+		{name: "パーセンタイル (補間)", config: "percentiles: [{percentile: 50, delay: 100ms}, {percentile: 100, delay: 200ms}]", random: 0.75, expected: 150 * time.Millisecond},
+		{name: "パーセンタイル (最小)", config: "percentiles: [{percentile: 50, delay: 100ms}, {percentile: 100, delay: 200ms}]", random: 0.25, expected: 50 * time.Millisecond},
+		{name: "パーセンタイル (最大超過)", config: "percentiles: [{percentile: 50, delay: 100ms}, {percentile: 90, delay: 200ms}]", random: 0.95, expected: 200 * time.Millisecond},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sut := newLatencyInjector(t, "fault:\n  latencies:\n    - "+tc.config+"\n")
+			actual := sut.rules[0].distribution(func() float64 { return tc.random })
+			if actual != tc.expected {
+				t.Errorf("expected %s, but got %s", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestLatencyInjector_UnaryServerInterceptor(t *testing.T) {
+	sut := newLatencyInjector(t, "fault:\n  latencies:\n    - method: /helloworld.Greeter/SayHello\n      fixed: 50ms\n")
+	info := &grpc.UnaryServerInfo{FullMethod: "/helloworld.Greeter/SayHello"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return req, nil
+	}
+
+	t.Run("指定した時間だけ遅延する", func(t *testing.T) {
+		start := time.Now()
+		if _, err := sut.UnaryServerInterceptor()(context.Background(), nil, info, handler); err != nil {
+			t.Errorf("err must be nil, but got %s", err)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("handler must be delayed at least 50ms, but got %s", elapsed)
+		}
+	})
+
+	t.Run("デッドラインを超えると DEADLINE_EXCEEDED を返却する", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := sut.UnaryServerInterceptor()(ctx, nil, info, handler)
+		if status.Code(err) != codes.DeadlineExceeded {
+			t.Errorf("expected %s, but got %s", codes.DeadlineExceeded, status.Code(err))
+		}
+		if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+			t.Errorf("delay must be interrupted by deadline, but took %s", elapsed)
+		}
+	})
+}
+
+// sendServerStream は送信したメッセージの数を数える grpc.ServerStream
+type sendServerStream struct {
+	grpc.ServerStream
+	sent int
+}
+
+func (s *sendServerStream) Context() context.Context {
+	return context.Background()
+}
+func (s *sendServerStream) SendMsg(m interface{}) error {
+	s.sent++
+	return nil
+}
+
+func TestLatencyInjector_StreamServerInterceptor(t *testing.T) {
+	sut := newLatencyInjector(t, "fault:\n  latencies:\n    - fixed: 20ms\n      per_message: true\n")
+	info := &grpc.StreamServerInfo{FullMethod: "/helloworld.Greeter/SayHelloToMany"}
+	handler := func(srv interface{}, ss grpc.ServerStream) error {
+		for i := 0; i < 3; i++ {
+			if err := ss.SendMsg(nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	stream := &sendServerStream{}
+	start := time.Now()
+	if err := sut.StreamServerInterceptor()(nil, stream, info, handler); err != nil {
+		t.Errorf("err must be nil, but got %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("each message must be delayed, but took %s for 3 messages", elapsed)
+	}
+	if stream.sent != 3 {
+		t.Errorf("expected 3 messages, but got %d", stream.sent)
+	}
+}
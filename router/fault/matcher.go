@@ -0,0 +1,115 @@
+package fault
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/metadata"
+)
+
+// Matcher は障害の注入やスタブの応答の対象となる RPC の条件を表現する。
+// 設定されたすべての条件を満たす RPC が対象となる
+type Matcher struct {
+	// メソッド名 (ex. /helloworld.Greeter/SayHello)。"/helloworld.Greeter/*" のようにワイルドカードを利用できる。
+	// 省略した場合はすべてのメソッドが対象となる
+	Method string `mapstructure:"method"`
+	// リクエストメタデータのキーと値
+	Metadata map[string]string `mapstructure:"metadata"`
+	// リクエストメッセージのフィールド名 (proto ファイル上の名前) と値。
+	// ネストしたフィールドは "." で区切って指定する
+	Request map[string]string `mapstructure:"request"`
+}
+
+// Validate は条件の記述が正しいかを検証する
+func (m *Matcher) Validate() error {
+	if m.Method == "" {
+		return nil
+	}
+	if _, err := path.Match(m.Method, ""); err != nil {
+		return errors.Wrapf(err, "illegal method pattern [%s]", m.Method)
+	}
+	return nil
+}
+
+// Match は、メソッド名 method、リクエストメタデータ md、リクエストメッセージ req を持つ RPC が条件を満たすかを返却する。
+// req が nil の場合 (ストリームの開始時等)、リクエストメッセージに対する条件を持つ Matcher は条件を満たさない
+func (m *Matcher) Match(method string, md metadata.MD, req interface{}) bool {
+	if m.Method != "" {
+		if ok, _ := path.Match(m.Method, method); !ok {
+			return false
+		}
+	}
+
+	for k, v := range m.Metadata {
+		if !contains(md.Get(k), v) {
+			return false
+		}
+	}
+
+	if len(m.Request) == 0 {
+		return true
+	}
+	fields, ok := toFields(req)
+	if !ok {
+		return false
+	}
+	for k, v := range m.Request {
+		actual, ok := lookup(fields, k)
+		if !ok || actual != v {
+			return false
+		}
+	}
+	return true
+}
+
+// contains は values に v が含まれるかを返却する
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// toFields は protobuf のメッセージ req を、JSON 表現を経由してフィールド名と値の map に変換する
+func toFields(req interface{}) (map[string]interface{}, bool) {
+	msg, ok := req.(proto.Message)
+	if !ok || msg == nil {
+		return nil, false
+	}
+
+	m := &jsonpb.Marshaler{OrigName: true, EmitDefaults: true}
+	s, err := m.MarshalToString(msg)
+	if err != nil {
+		return nil, false
+	}
+	// 数値を丸めずに比較できるよう、json.Number として扱う
+	fields := make(map[string]interface{})
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil {
+		return nil, false
+	}
+	return fields, true
+}
+
+// lookup は fields から "." 区切りの名前 name を持つフィールドの値を文字列として返却する
+func lookup(fields map[string]interface{}, name string) (string, bool) {
+	var v interface{} = fields
+	for _, key := range strings.Split(name, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if v, ok = m[key]; !ok {
+			return "", false
+		}
+	}
+	return fmt.Sprint(v), true
+}
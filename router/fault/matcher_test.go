@@ -0,0 +1,42 @@
+package fault
+
+import (
+	"testing"
+
+	"github.com/kiririmode/grpc-sandbox/helloworld"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestMatcher_Match(t *testing.T) {
+	method := "/helloworld.Greeter/SayHello"
+	md := metadata.Pairs("x-fault", "unavailable")
+	req := &helloworld.HelloRequest{Name: "error"}
+
+	testCases := []struct {
+		name     string
+		matcher  Matcher
+		req      interface{}
+		expected bool
+	}{
+		{name: "条件なし", matcher: Matcher{}, req: req, expected: true},
+		{name: "メソッド名が一致", matcher: Matcher{Method: method}, req: req, expected: true},
+		{name: "メソッド名がワイルドカードで一致", matcher: Matcher{Method: "/helloworld.Greeter/*"}, req: req, expected: true},
+		{name: "メソッド名が不一致", matcher: Matcher{Method: "/helloworld.Greeter/SayHelloToMany"}, req: req, expected: false},
+		{name: "メタデータが一致", matcher: Matcher{Metadata: map[string]string{"x-fault": "unavailable"}}, req: req, expected: true},
+		{name: "メタデータが不一致", matcher: Matcher{Metadata: map[string]string{"x-fault": "internal"}}, req: req, expected: false},
+		{name: "メタデータが存在しない", matcher: Matcher{Metadata: map[string]string{"x-other": "unavailable"}}, req: req, expected: false},
+		{name: "フィールドが一致", matcher: Matcher{Request: map[string]string{"name": "error"}}, req: req, expected: true},
+		{name: "フィールドが不一致", matcher: Matcher{Request: map[string]string{"name": "world"}}, req: req, expected: false},
+		{name: "フィールドが存在しない", matcher: Matcher{Request: map[string]string{"name.first": "error"}}, req: req, expected: false},
+		{name: "リクエストがない", matcher: Matcher{Request: map[string]string{"name": "error"}}, req: nil, expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := tc.matcher.Match(method, md, tc.req)
+			if actual != tc.expected {
+				t.Errorf("expected %t, but got %t", tc.expected, actual)
+			}
+		})
+	}
+}
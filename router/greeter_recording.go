@@ -0,0 +1,137 @@
+package router
+
+import (
+	"context"
+	"io"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/kiririmode/grpc-sandbox/helloworld"
+	"github.com/kiririmode/grpc-sandbox/router/fault"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// sayHelloMethod は SayHello のメソッド名
+	sayHelloMethod = "/helloworld.Greeter/SayHello"
+	// sayHelloToManyMethod は SayHelloToMany のメソッド名
+	sayHelloToManyMethod = "/helloworld.Greeter/SayHelloToMany"
+)
+
+// recordingGreeter は、delegate に処理を委譲し、そのリクエストと応答を記録する GreeterServer
+type recordingGreeter struct {
+	delegate helloworld.GreeterServer
+	recorder *Recorder
+}
+
+// SayHello は delegate の SayHello を呼び出し、そのリクエストと応答を記録する
+func (g *recordingGreeter) SayHello(ctx context.Context, req *helloworld.HelloRequest) (*helloworld.HelloReply, error) {
+	reply, err := g.delegate.SayHello(ctx, req)
+
+	var msg proto.Message
+	if reply != nil {
+		msg = reply
+	}
+	g.recorder.record(ctx, sayHelloMethod, req, msg, err)
+	return reply, err
+}
+
+// SayHelloToMany は delegate の SayHelloToMany を呼び出し、受信したメッセージとその直後に送信したメッセージを記録する
+func (g *recordingGreeter) SayHelloToMany(stream helloworld.Greeter_SayHelloToManyServer) error {
+	rs := &recordingGreeterStream{Greeter_SayHelloToManyServer: stream, recorder: g.recorder}
+	err := g.delegate.SayHelloToMany(rs)
+	if err != nil {
+		g.recorder.record(stream.Context(), sayHelloToManyMethod, rs.lastRequest(), nil, err)
+	}
+	return err
+}
+
+// recordingGreeterStream は送受信したメッセージを記録する Greeter_SayHelloToManyServer
+type recordingGreeterStream struct {
+	helloworld.Greeter_SayHelloToManyServer
+	recorder *Recorder
+	// 直前に受信したメッセージ
+	last *helloworld.HelloRequest
+}
+
+// lastRequest は直前に受信したメッセージを返却する。受信していない場合は nil を返却する
+func (s *recordingGreeterStream) lastRequest() proto.Message {
+	if s.last == nil {
+		return nil
+	}
+	return s.last
+}
+
+// Recv はメッセージを受信する
+func (s *recordingGreeterStream) Recv() (*helloworld.HelloRequest, error) {
+	req, err := s.Greeter_SayHelloToManyServer.Recv()
+	if err == nil {
+		s.last = req
+	}
+	return req, err
+}
+
+// Send は reply を送信し、直前に受信したメッセージと組にして記録する
+func (s *recordingGreeterStream) Send(reply *helloworld.HelloReply) error {
+	err := s.Greeter_SayHelloToManyServer.Send(reply)
+	if err == nil {
+		s.recorder.record(s.Context(), sayHelloToManyMethod, s.lastRequest(), reply, nil)
+	}
+	return err
+}
+
+// replayingGreeter は記録された応答を返却する GreeterServer
+type replayingGreeter struct {
+	recorder *Recorder
+}
+
+// replay は method へのリクエスト req に対して記録された応答を reply に復元する。
+// 記録されたステータスコードが OK でない場合は、そのエラーを返却する
+func (g *replayingGreeter) replay(ctx context.Context, method string, req proto.Message, reply proto.Message) error {
+	rec, ok := g.recorder.lookup(ctx, method, req)
+	if !ok {
+		return status.Errorf(codes.NotFound, "no recorded reply for %s", method)
+	}
+
+	code, err := fault.ParseCode(rec.Code)
+	if err != nil {
+		return status.Errorf(codes.Internal, "illegal recorded status: %s", err)
+	}
+	if code != codes.OK {
+		return status.Error(code, rec.Message)
+	}
+	if err := unmarshalReply(rec, reply); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// SayHello は記録された応答を返却する
+func (g *replayingGreeter) SayHello(ctx context.Context, req *helloworld.HelloRequest) (*helloworld.HelloReply, error) {
+	reply := &helloworld.HelloReply{}
+	if err := g.replay(ctx, sayHelloMethod, req, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// SayHelloToMany は、受信したメッセージ毎に記録された応答を返却する
+func (g *replayingGreeter) SayHelloToMany(stream helloworld.Greeter_SayHelloToManyServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		reply := &helloworld.HelloReply{}
+		if err := g.replay(stream.Context(), sayHelloToManyMethod, req, reply); err != nil {
+			return err
+		}
+		if err := stream.Send(reply); err != nil {
+			return err
+		}
+	}
+}
@@ -5,81 +5,329 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strings"
+	"time"
 
+	"github.com/kiririmode/grpc-sandbox/common"
 	"github.com/kiririmode/grpc-sandbox/common/conf"
 	"github.com/kiririmode/grpc-sandbox/common/log"
 	"github.com/kiririmode/grpc-sandbox/helloworld"
+	"github.com/kiririmode/grpc-sandbox/router/stub"
 	"github.com/pkg/errors"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
-	"google.golang.org/grpc/status"
 )
 
+// defaultShutdownTimeout は server.shutdown_timeout が未設定の場合に
+// Graceful Shutdown の完了を待つ時間
+const defaultShutdownTimeout = 30 * time.Second
+
 // GrpcServer は gRPC サーバそのものを表現する
 type GrpcServer struct {
-	server   *grpc.Server
-	config   *conf.Configuration
-	log      *log.Log
-	Listener net.Listener
+	server *grpc.Server
+	// grpc.Server 作成時に追加で指定するオプション
+	options []grpc.ServerOption
+	// アクセスログの後に、登録順に適用される Interceptor
+	unaryInterceptors  []grpc.UnaryServerInterceptor
+	streamInterceptors []grpc.StreamServerInterceptor
+	config             *conf.Configuration
+	log                *log.Log
+	// server.listeners の各アドレスを待ち受ける Listener
+	Listeners []net.Listener
+	// grpc.health.v1.Health サービス
+	health *healthService
+	// リクエストと応答の記録・再生を行う。nil の場合は記録も再生も行わない
+	recorder *Recorder
+	// grpc.Server に登録されていないサービスへの RPC を処理する。nil の場合は UNIMPLEMENTED となる
+	stub *stub.Stub
+	// 設定の再読み込みの購読
+	subscriptions []*conf.Subscription
+	// DependsOn で追加した、依存するリソースの名前
+	dependencies []string
+	// Run により Listeners の管理が grpc.Server に移ったかどうか
+	served bool
 }
 
-// NewGrpcServer は新たな gRPC サーバのインスタンスを返却する
-func NewGrpcServer(server *grpc.Server, conf *conf.Configuration, logger *log.Log) *GrpcServer {
+// NewGrpcServer は新たな gRPC サーバのインスタンスを返却する。
+// grpc.Server は設定を元に Initialize で作成され、opts はその際に追加で指定される
+func NewGrpcServer(conf *conf.Configuration, logger *log.Log, opts ...grpc.ServerOption) *GrpcServer {
 	return &GrpcServer{
-		server: server,
-		config: conf,
-		log:    logger,
+		options: opts,
+		config:  conf,
+		log:     logger,
 	}
 }
 
+// AddUnaryInterceptor は Unary RPC に適用する Interceptor として i を追加する。
+// Initialize より前に呼び出す必要がある
+func (s *GrpcServer) AddUnaryInterceptor(i grpc.UnaryServerInterceptor) *GrpcServer {
+	s.unaryInterceptors = append(s.unaryInterceptors, i)
+	return s
+}
+
+// AddStreamInterceptor は Streaming RPC に適用する Interceptor として i を追加する。
+// Initialize より前に呼び出す必要がある
+func (s *GrpcServer) AddStreamInterceptor(i grpc.StreamServerInterceptor) *GrpcServer {
+	s.streamInterceptors = append(s.streamInterceptors, i)
+	return s
+}
+
+// SetRecorder は、Greeter サービスのリクエストと応答の記録・再生に用いる Recorder として r を設定する。
+// Initialize より前に呼び出す必要があり、GrpcServer は r に依存する
+func (s *GrpcServer) SetRecorder(r *Recorder) *GrpcServer {
+	s.recorder = r
+	return s
+}
+
+// SetStub は、設定から読み込んだサービスへの RPC を処理する Stub として st を設定する。
+// Initialize より前に呼び出す必要があり、GrpcServer は st に依存する
+func (s *GrpcServer) SetStub(st *stub.Stub) *GrpcServer {
+	s.stub = st
+	return s
+}
+
+// DependsOn は、GrpcServer が依存するリソースとして rs を追加する。
+// Interceptor を提供するリソースのように、GrpcServer より先に初期化され、後に終了処理が行われる必要があるリソースを指定する
+func (s *GrpcServer) DependsOn(rs ...common.Resource) *GrpcServer {
+	for _, r := range rs {
+		s.dependencies = append(s.dependencies, r.Name())
+	}
+	return s
+}
+
 // Name は、固定で "grpc server" を返却する
 func (s *GrpcServer) Name() string {
 	return "grpc server"
 }
 
-// Initialize は gRPC サーバの初期化処理として、TCP ポートを Listenし、
-// Service の登録と Reflection の有効化を行う
+// Dependencies は configuration、log、設定された Recorder と Stub、および DependsOn で追加したリソースに依存することを返却する
+func (s *GrpcServer) Dependencies() []string {
+	deps := append([]string{s.config.Name(), s.log.Name()}, s.dependencies...)
+	if s.recorder != nil {
+		deps = append(deps, s.recorder.Name())
+	}
+	if s.stub != nil {
+		deps = append(deps, s.stub.Name())
+	}
+	return deps
+}
+
+// Initialize は gRPC サーバの初期化処理として、grpc.Server を作成して server.listeners の各アドレス (未設定の場合は server.port) を Listen し、
+// Service の登録と Reflection、Health Check の有効化を行う。Stub が設定されている場合は、そのサービスも対象とする。
+// Health Check の状態は、すべてのリソースの初期化が完了するまで NOT_SERVING となる
 func (s *GrpcServer) Initialize() error {
-	port := s.config.GetInt("server.port")
+	s.health = newHealthService()
+	opts, err := s.serverOptions()
+	if err != nil {
+		return err
+	}
+	s.server = grpc.NewServer(opts...)
 
-	s.log.Logger.Infof("listening to tcp port %d", port)
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	configs, err := listenerConfigs(s.config)
 	if err != nil {
-		return errors.Wrapf(err, "failed to listen port %d", port)
+		s.Finalize()
+		return err
+	}
+	for _, lc := range configs {
+		s.log.Logger.Infof("listening to %s %s", lc.Network, lc.Address)
+		listener, err := listen(lc)
+		if err != nil {
+			// 初期化に失敗したリソースは終了処理が行われないため、設定の再読み込みの購読の解除と、
+			// 既に待ち受けを開始した Listener の close をここで行う
+			s.Finalize()
+			return err
+		}
+		s.Listeners = append(s.Listeners, listener)
 	}
-	s.Listener = listener
 
-	helloworld.RegisterGreeterServer(s.server, s)
-	reflection.Register(s.server)
+	helloworld.RegisterGreeterServer(s.server, s.greeter())
+	if s.stub != nil {
+		registerReflection(s.server, s.stub.Files())
+		s.health.register(s.server, s.stub.Services()...)
+	} else {
+		reflection.Register(s.server)
+		s.health.register(s.server)
+	}
 
 	return nil
 }
 
-// Finalize は終了処理として open したポートの close を行う
-func (s *GrpcServer) Finalize() error {
-	err := s.Listener.Close()
+// greeter は、Recorder のモードに応じて Greeter サービスとして登録する GreeterServer を返却する
+func (s *GrpcServer) greeter() helloworld.GreeterServer {
+	if s.recorder == nil {
+		return s
+	}
+	switch s.recorder.Mode() {
+	case RecordingRecord:
+		return &recordingGreeter{delegate: s, recorder: s.recorder}
+	case RecordingReplay:
+		return &replayingGreeter{recorder: s.recorder}
+	}
+	return s
+}
+
+// OnInitialized は、すべてのリソースの初期化が完了したため、Health Check の状態を SERVING にする
+func (s *GrpcServer) OnInitialized() {
+	s.health.serve()
+}
+
+// OnFinalizing は、終了処理が開始されるため、Health Check の状態を NOT_SERVING にする
+func (s *GrpcServer) OnFinalizing() {
+	if s.health != nil {
+		s.health.stop()
+	}
+}
+
+// OnHealthChanged は、いずれかのリソースが利用できない間、Health Check の状態を NOT_SERVING にする。
+// 終了処理の開始後は、状態を SERVING に戻さない
+func (s *GrpcServer) OnHealthChanged(prev, current common.Health) {
+	if current.Healthy {
+		s.health.serve()
+	} else {
+		s.health.degrade()
+	}
+}
+
+// serverOptions は設定を元に grpc.Server の作成に用いるオプションを返却する
+func (s *GrpcServer) serverOptions() ([]grpc.ServerOption, error) {
+	opts := make([]grpc.ServerOption, 0, len(s.options)+3)
+
+	tlsConfig, err := newTLSConfig(s.config, s.log)
 	if err != nil {
-		return errors.Wrap(err, "failed to close listener")
+		return nil, errors.Wrap(err, "failed to configure TLS")
 	}
-	return nil
+	if tlsConfig != nil {
+		s.log.Logger.Infof("TLS enabled (client auth: %s)", s.config.GetString("server.tls.client_auth"))
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	// アクセスログは他の Interceptor の処理時間も含めて記録するため、最も外側に配置する
+	unary := make([]grpc.UnaryServerInterceptor, 0, len(s.unaryInterceptors)+1)
+	stream := make([]grpc.StreamServerInterceptor, 0, len(s.streamInterceptors)+2)
+	if a := newAccessLogger(s.config, s.log); a != nil {
+		unary = append(unary, a.UnaryServerInterceptor())
+		stream = append(stream, a.StreamServerInterceptor())
+		// 出力対象のメソッドとメタデータは、設定の再読み込み時に反映する
+		s.subscriptions = append(s.subscriptions, s.config.Subscribe("log.access", func(e *conf.ChangeEvent) {
+			a.configure(s.config)
+		}))
+	}
+	s.subscriptions = append(s.subscriptions, s.config.Subscribe("server", func(e *conf.ChangeEvent) {
+		if e.Changed("server.port") || e.Changed("server.listeners") || e.Changed("server.tls") {
+			s.log.Logger.Warn("changes of server.port, server.listeners and server.tls are applied after restart")
+		}
+	}))
+	unary = append(unary, s.unaryInterceptors...)
+	stream = append(stream, s.streamInterceptors...)
+	// Health Check の Watch は GracefulStop を妨げないよう、停止時に終了させる
+	stream = append(stream, s.health.StreamServerInterceptor())
+
+	if len(unary) > 0 {
+		opts = append(opts, grpc.UnaryInterceptor(chainUnaryInterceptors(unary)))
+	}
+	opts = append(opts, grpc.StreamInterceptor(chainStreamInterceptors(stream)))
+
+	if s.stub != nil {
+		opts = append(opts, grpc.UnknownServiceHandler(s.stub.Handler))
+	}
+
+	return append(opts, s.options...), nil
 }
 
-// Serve はポートの Listener を起動し、gRPC API のリクエストを処理できる状態にする
-func (s *GrpcServer) Serve() error {
-	if err := s.server.Serve(s.Listener); err != nil {
-		return errors.Errorf("failed to serve: %v", err)
+// Finalize は終了処理として、設定の再読み込みの購読を解除し、open したポートの close を行う。
+// Run 済みの場合、ポートは grpc.Server が管理しているため、サーバの停止により close する
+func (s *GrpcServer) Finalize() error {
+	for _, sub := range s.subscriptions {
+		sub.Unsubscribe()
+	}
+	s.subscriptions = nil
+
+	if s.served {
+		s.server.Stop()
+		s.served, s.Listeners = false, nil
+		return nil
+	}
+	// 初期化の途中で失敗した場合は、待ち受けを開始した Listener のみを close する
+	var errs []string
+	for _, l := range s.Listeners {
+		if err := l.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	s.Listeners = nil
+	if len(errs) > 0 {
+		return errors.Errorf("failed to close listeners: %s", strings.Join(errs, "; "))
 	}
 	return nil
 }
 
-// SayHello は挨拶をする
-func (s *GrpcServer) SayHello(ctx context.Context, req *helloworld.HelloRequest) (*helloworld.HelloReply, error) {
-	if req.Name == "error" {
-		return nil, status.Error(codes.Internal, "Internal Error")
+// Run は各 Listener で並行して gRPC API のリクエストを処理し、ctx がキャンセルされるまで待つ。
+// ctx がキャンセルされた場合は Shutdown によりサーバを停止して nil を返却する。
+// いずれかの Listener でリクエストの処理が失敗した場合は、サーバを停止して他の Listener の処理も終了させ、エラーを返却する
+func (s *GrpcServer) Run(ctx context.Context) error {
+	s.served = true
+	errCh := make(chan error, len(s.Listeners))
+	for _, l := range s.Listeners {
+		go func(l net.Listener) {
+			// Serve の開始前にサーバが停止された場合の ErrServerStopped は、停止による終了として扱う
+			if err := s.server.Serve(l); err != nil && err != grpc.ErrServerStopped {
+				errCh <- errors.Errorf("failed to serve %s %s: %v", l.Addr().Network(), l.Addr(), err)
+				return
+			}
+			errCh <- nil
+		}(l)
+	}
+
+	var err error
+	received := 0
+	select {
+	case err = <-errCh:
+		// いずれかの Listener の処理が終了した場合は、他の Listener の処理も終了させる
+		received++
+		s.server.Stop()
+	case <-ctx.Done():
+		s.Shutdown()
+	}
+	// GracefulStop, Stop のいずれの場合も、各 Listener の Serve は nil を返却する
+	for ; received < len(s.Listeners); received++ {
+		if e := <-errCh; err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Shutdown は Health Check の状態を NOT_SERVING とし、処理中の RPC (ストリームを含む) の完了を待ってからサーバを停止する。
+// server.shutdown_timeout で指定した時間内に完了しない場合は、処理中の RPC を切断して強制的に停止する
+func (s *GrpcServer) Shutdown() {
+	s.health.stop()
+
+	timeout := s.config.GetDuration("server.shutdown_timeout")
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.log.Logger.Info("graceful shutdown completed")
+	case <-time.After(timeout):
+		s.log.Logger.Warnf("graceful shutdown did not complete in %s, forcing stop", timeout)
+		s.server.Stop()
+		<-done
 	}
+}
 
+// SayHello は挨拶をする。
+// エラーを返却させる場合は fault.errors にルールを設定する
+func (s *GrpcServer) SayHello(ctx context.Context, req *helloworld.HelloRequest) (*helloworld.HelloReply, error) {
 	// retrieve metadata
 	md, _ := metadata.FromIncomingContext(ctx)
 	postscripts := md.Get("postscript")
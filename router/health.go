@@ -0,0 +1,115 @@
+package router
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// healthWatchMethod は Health サービスの Watch メソッド名
+const healthWatchMethod = "/grpc.health.v1.Health/Watch"
+
+// healthService は grpc.health.v1.Health サービスを提供し、
+// サーバ全体 ("") と登録された各サービスの状態を管理する
+type healthService struct {
+	server *health.Server
+	// 状態を管理するサービス名
+	services []string
+	// 終了処理の開始時に close され、実行中の Watch を終了させる
+	stopping chan struct{}
+	// serve, degrade と stop を排他し、stop の後に状態を変更しないようにする
+	mu      sync.Mutex
+	stopped bool
+}
+
+// newHealthService は新しい healthService を返却する
+func newHealthService() *healthService {
+	return &healthService{
+		server:   health.NewServer(),
+		stopping: make(chan struct{}),
+	}
+}
+
+// register は s に Health サービスを登録する。状態は s に登録されたサービスに加えて services についても管理する。
+// Health サービスを含めたすべてのサービスは、初期状態として NOT_SERVING となる
+func (h *healthService) register(s *grpc.Server, services ...string) {
+	healthpb.RegisterHealthServer(s, h.server)
+
+	h.services = []string{""}
+	for name := range s.GetServiceInfo() {
+		h.services = append(h.services, name)
+	}
+	h.services = append(h.services, services...)
+	h.setStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+}
+
+// serve はすべてのサービスの状態を SERVING にする。stop の後は NOT_SERVING のままとする
+func (h *healthService) serve() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.stopped {
+		h.setStatus(healthpb.HealthCheckResponse_SERVING)
+	}
+}
+
+// degrade は、リソースが利用できない間、すべてのサービスの状態を NOT_SERVING にする。stop の後は何もしない
+func (h *healthService) degrade() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.stopped {
+		h.setStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+}
+
+// stop はすべてのサービスの状態を NOT_SERVING にし、実行中の Watch を終了させる。
+// 終了していない Watch があると GracefulStop が完了しないため、サーバの停止前に呼び出す必要がある
+func (h *healthService) stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.setStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+	if !h.stopped {
+		h.stopped = true
+		close(h.stopping)
+	}
+}
+
+// setStatus はすべてのサービスの状態を st にする
+func (h *healthService) setStatus(st healthpb.HealthCheckResponse_ServingStatus) {
+	for _, name := range h.services {
+		h.server.SetServingStatus(name, st)
+	}
+}
+
+// StreamServerInterceptor は、stop が呼び出された時点で Watch のコンテキストをキャンセルする Interceptor を返却する
+func (h *healthService) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if info.FullMethod != healthWatchMethod {
+			return handler(srv, ss)
+		}
+
+		ctx, cancel := context.WithCancel(ss.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-h.stopping:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		return handler(srv, &contextServerStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// contextServerStream は Context を差し替えた grpc.ServerStream
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context はストリームのコンテキストを返却する
+func (s *contextServerStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,77 @@
+package router
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestHealthService(t *testing.T) {
+	check := func(t *testing.T, h *healthService, service string) healthpb.HealthCheckResponse_ServingStatus {
+		res, err := h.server.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		return res.Status
+	}
+
+	sut := newHealthService()
+	sut.register(grpc.NewServer())
+
+	// 初期化完了前、初期化完了後、リソースの異常とその回復、終了処理開始後の順に状態が遷移し、終了処理開始後は SERVING に戻らない
+	expectations := []struct {
+		transit  func()
+		expected healthpb.HealthCheckResponse_ServingStatus
+	}{
+		{transit: func() {}, expected: healthpb.HealthCheckResponse_NOT_SERVING},
+		{transit: sut.serve, expected: healthpb.HealthCheckResponse_SERVING},
+		{transit: sut.degrade, expected: healthpb.HealthCheckResponse_NOT_SERVING},
+		{transit: sut.serve, expected: healthpb.HealthCheckResponse_SERVING},
+		{transit: sut.stop, expected: healthpb.HealthCheckResponse_NOT_SERVING},
+		{transit: sut.serve, expected: healthpb.HealthCheckResponse_NOT_SERVING},
+		{transit: sut.degrade, expected: healthpb.HealthCheckResponse_NOT_SERVING},
+		{transit: sut.serve, expected: healthpb.HealthCheckResponse_NOT_SERVING},
+	}
+	for _, e := range expectations {
+		e.transit()
+		for _, service := range []string{"", "grpc.health.v1.Health"} {
+			if actual := check(t, sut, service); actual != e.expected {
+				t.Errorf("service [%s]: expected %s, but got %s", service, e.expected, actual)
+			}
+		}
+	}
+}
+
+// watchStream は Watch の呼び出しに用いる grpc.ServerStream
+type watchStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *watchStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestHealthService_StreamServerInterceptor(t *testing.T) {
+	sut := newHealthService()
+	info := &grpc.StreamServerInfo{FullMethod: healthWatchMethod}
+	handler := func(srv interface{}, ss grpc.ServerStream) error {
+		<-ss.Context().Done()
+		return nil
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- sut.StreamServerInterceptor()(nil, &watchStream{ctx: context.Background()}, info, handler)
+	}()
+	sut.stop()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("watch must be finished by stop")
+	}
+}
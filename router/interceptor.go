@@ -0,0 +1,78 @@
+package router
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+// chainUnaryInterceptors は interceptors を先頭から順に適用する 1 つの UnaryServerInterceptor を返却する。
+// 先頭の Interceptor が最も外側で実行される
+func chainUnaryInterceptors(interceptors []grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, h := interceptors[i], next
+			next = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, h)
+			}
+		}
+		return next(ctx, req)
+	}
+}
+
+// chainStreamInterceptors は interceptors を先頭から順に適用する 1 つの StreamServerInterceptor を返却する。
+// 先頭の Interceptor が最も外側で実行される
+func chainStreamInterceptors(interceptors []grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, h := interceptors[i], next
+			next = func(srv interface{}, ss grpc.ServerStream) error {
+				return interceptor(srv, ss, info, h)
+			}
+		}
+		return next(srv, ss)
+	}
+}
+
+// messageSize は msg を protobuf でシリアライズした場合のバイト数を返却する。
+// msg が protobuf のメッセージでない場合は 0 を返却する
+func messageSize(msg interface{}) int {
+	m, ok := msg.(proto.Message)
+	if !ok {
+		return 0
+	}
+	return proto.Size(m)
+}
+
+// countingServerStream は送受信したメッセージの数とバイト数を数える grpc.ServerStream
+type countingServerStream struct {
+	grpc.ServerStream
+	sentMessages     int64
+	sentBytes        int64
+	receivedMessages int64
+	receivedBytes    int64
+}
+
+// SendMsg は m を送信し、送信したメッセージ数とバイト数を加算する
+func (s *countingServerStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		atomic.AddInt64(&s.sentMessages, 1)
+		atomic.AddInt64(&s.sentBytes, int64(messageSize(m)))
+	}
+	return err
+}
+
+// RecvMsg は m にメッセージを受信し、受信したメッセージ数とバイト数を加算する
+func (s *countingServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		atomic.AddInt64(&s.receivedMessages, 1)
+		atomic.AddInt64(&s.receivedBytes, int64(messageSize(m)))
+	}
+	return err
+}
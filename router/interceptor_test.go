@@ -0,0 +1,119 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kiririmode/grpc-sandbox/common/conf"
+	"github.com/kiririmode/grpc-sandbox/common/log"
+	"github.com/kiririmode/grpc-sandbox/helloworld"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestChainUnaryInterceptors(t *testing.T) {
+	calls := make([]string, 0)
+	interceptor := func(name string) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			calls = append(calls, name+":before")
+			res, err := handler(ctx, req)
+			calls = append(calls, name+":after")
+			return res, err
+		}
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls = append(calls, "handler")
+		return req, nil
+	}
+
+	sut := chainUnaryInterceptors([]grpc.UnaryServerInterceptor{interceptor("first"), interceptor("second")})
+	res, err := sut(context.Background(), "req", &grpc.UnaryServerInfo{}, handler)
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err)
+	}
+	if res != "req" {
+		t.Errorf("expected req, but got %s", res)
+	}
+
+	expected := []string{"first:before", "second:before", "handler", "second:after", "first:after"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected %s, but got %s", expected, calls)
+	}
+}
+
+func TestAccessLogger(t *testing.T) {
+	newLogger := func(t *testing.T, config string) (*accessLogger, *bytes.Buffer) {
+		c, err := conf.NewConfigurationFromReader("yaml", strings.NewReader(config))
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		buf := &bytes.Buffer{}
+		l := &log.Log{Logger: logrus.New()}
+		l.Logger.SetOutput(buf)
+		l.Logger.SetFormatter(&logrus.JSONFormatter{})
+		return newAccessLogger(c, l), buf
+	}
+
+	t.Run("無効化されていれば Interceptor を作成しない", func(t *testing.T) {
+		a, _ := newLogger(t, "log:\n  access:\n    enabled: false\n")
+		if a != nil {
+			t.Error("access logger must be nil")
+		}
+	})
+
+	t.Run("メソッド・ステータスコード・メタデータを出力する", func(t *testing.T) {
+		a, buf := newLogger(t, "log:\n  access:\n    enabled: true\n    metadata_keys: [postscript]\n")
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("postscript", "bye", "secret", "xxx"))
+		info := &grpc.UnaryServerInfo{FullMethod: "/helloworld.Greeter/SayHello"}
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, status.Error(codes.Unavailable, "unavailable")
+		}
+
+		_, err := a.UnaryServerInterceptor()(ctx, &helloworld.HelloRequest{Name: "world"}, info, handler)
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("expected %s, but got %s", codes.Unavailable, status.Code(err))
+		}
+
+		entry := make(map[string]interface{})
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		expected := map[string]interface{}{
+			"method":        "/helloworld.Greeter/SayHello",
+			"code":          "Unavailable",
+			"md.postscript": "bye",
+			"request_size":  float64(7),
+			"response_size": float64(0),
+		}
+		for k, v := range expected {
+			if entry[k] != v {
+				t.Errorf("%s: expected %v, but got %v", k, v, entry[k])
+			}
+		}
+		if _, ok := entry["md.secret"]; ok {
+			t.Error("metadata not listed in metadata_keys must not be logged")
+		}
+	})
+
+	t.Run("除外したメソッドは出力しない", func(t *testing.T) {
+		a, buf := newLogger(t, "log:\n  access:\n    enabled: true\n    exclude_methods: [/helloworld.Greeter/SayHello]\n")
+		info := &grpc.UnaryServerInfo{FullMethod: "/helloworld.Greeter/SayHello"}
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return req, nil
+		}
+
+		if _, err := a.UnaryServerInterceptor()(context.Background(), nil, info, handler); err != nil {
+			t.Errorf("err must be nil, but got %s", err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("access log must not be written, but got %s", buf.String())
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/kiririmode/grpc-sandbox/common/conf"
+	"github.com/pkg/errors"
+)
+
+// ListenerConfig は、server.listeners に記述する gRPC サーバの待ち受けアドレスの設定を表現する
+type ListenerConfig struct {
+	// tcp, tcp4, tcp6 or unix (省略した場合は tcp)
+	Network string `mapstructure:"network"`
+	// tcp の場合は "ホスト:ポート" (ホストを省略した場合はすべてのインタフェース)、unix の場合はソケットファイルのパス
+	Address string `mapstructure:"address"`
+}
+
+// listenerConfigs は server.listeners から待ち受けアドレスの設定を読み込む。
+// server.listeners が記述されていない場合は、server.port のすべてのインタフェースを TCP で待ち受ける
+func listenerConfigs(c *conf.Configuration) ([]ListenerConfig, error) {
+	var configs []ListenerConfig
+	if err := c.UnmarshalKey("server.listeners", &configs); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal [server.listeners]")
+	}
+	if len(configs) == 0 {
+		return []ListenerConfig{{Network: "tcp", Address: fmt.Sprintf(":%d", c.GetInt("server.port"))}}, nil
+	}
+
+	for i := range configs {
+		if configs[i].Network == "" {
+			configs[i].Network = "tcp"
+		}
+		switch configs[i].Network {
+		case "tcp", "tcp4", "tcp6", "unix":
+		default:
+			return nil, errors.Errorf("illegal network [%s] in server.listeners[%d], specify \"tcp\", \"tcp4\", \"tcp6\" or \"unix\"", configs[i].Network, i)
+		}
+		if configs[i].Address == "" {
+			return nil, errors.Errorf("address of server.listeners[%d] is missing", i)
+		}
+	}
+	return configs, nil
+}
+
+// listen は lc のアドレスを待ち受ける Listener を返却する。
+// Unix ドメインソケットの場合、前回の異常終了で残ったソケットファイルは削除してから待ち受ける
+func listen(lc ListenerConfig) (net.Listener, error) {
+	if lc.Network == "unix" {
+		if err := removeStaleSocket(lc.Address); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen(lc.Network, lc.Address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen %s %s", lc.Network, lc.Address)
+	}
+	return l, nil
+}
+
+// removeStaleSocket は、path のソケットファイルが待ち受けられていない場合に削除する。
+// 他のプロセスが待ち受けているソケットファイルは削除せず、エラーを返却する
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return errors.Errorf("failed to listen unix %s: address already in use", path)
+	}
+	if !isConnectionRefused(err) {
+		return errors.Wrapf(err, "failed to check socket %s", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return errors.Wrapf(err, "failed to remove stale socket %s", path)
+	}
+	return nil
+}
+
+// isConnectionRefused は、err が接続を拒否されたことによるエラーかどうかを返却する
+func isConnectionRefused(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	sysErr, ok := opErr.Err.(*os.SyscallError)
+	return ok && sysErr.Err == syscall.ECONNREFUSED
+}
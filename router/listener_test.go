@@ -0,0 +1,203 @@
+package router
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiririmode/grpc-sandbox/common/conf"
+	"github.com/kiririmode/grpc-sandbox/common/log"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestListenerConfigs(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   string
+		expected []ListenerConfig
+	}{
+		{
+			name:     "listeners を指定しない場合は server.port を待ち受ける",
+			config:   "server:\n  port: 10000\n",
+			expected: []ListenerConfig{{Network: "tcp", Address: ":10000"}},
+		},
+		{
+			name: "listeners に記述したアドレスを待ち受ける",
+			config: `server:
+  port: 10000
+  listeners:
+    - address: 127.0.0.1:10002
+    - network: unix
+      address: /tmp/stubserver.sock
+`,
+			expected: []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:10002"}, {Network: "unix", Address: "/tmp/stubserver.sock"}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := conf.NewConfigurationFromReader("yaml", strings.NewReader(tc.config))
+			if err != nil {
+				t.Fatalf("err must be nil, but got %s", err)
+			}
+			actual, err := listenerConfigs(c)
+			if err != nil {
+				t.Fatalf("err must be nil, but got %s", err)
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("expected %v, but got %v", tc.expected, actual)
+			}
+		})
+	}
+
+	t.Run("不正な設定はエラーとする", func(t *testing.T) {
+		for _, config := range []string{
+			"server:\n  listeners:\n    - network: udp\n      address: :10000\n",
+			"server:\n  listeners:\n    - network: unix\n",
+		} {
+			c, err := conf.NewConfigurationFromReader("yaml", strings.NewReader(config))
+			if err != nil {
+				t.Fatalf("err must be nil, but got %s", err)
+			}
+			if _, err := listenerConfigs(c); err == nil {
+				t.Errorf("error should be occured, but got success: %s", config)
+			}
+		}
+	})
+}
+
+func TestListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listener")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("異常終了で残ったソケットファイルを削除して待ち受ける", func(t *testing.T) {
+		path := filepath.Join(dir, "stale.sock")
+		stale, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		// close 時にソケットファイルを削除しないことで、異常終了した状態を再現する
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		stale.Close()
+
+		l, err := listen(ListenerConfig{Network: "unix", Address: path})
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		l.Close()
+	})
+
+	t.Run("他のプロセスが待ち受けているソケットファイルは削除しない", func(t *testing.T) {
+		path := filepath.Join(dir, "live.sock")
+		live, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		defer live.Close()
+		go func() {
+			for {
+				conn, err := live.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+
+		if _, err := listen(ListenerConfig{Network: "unix", Address: path}); err == nil || !strings.Contains(err.Error(), "address already in use") {
+			t.Errorf("expected address already in use, but got %v", err)
+		}
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatalf("live socket must not be removed, but got %s", err)
+		}
+		conn.Close()
+	})
+
+	t.Run("ソケットでないファイルは削除しない", func(t *testing.T) {
+		path := filepath.Join(dir, "regular")
+		if err := ioutil.WriteFile(path, []byte("data"), 0600); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if _, err := listen(ListenerConfig{Network: "unix", Address: path}); err == nil {
+			t.Error("error should be occured, but got success")
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("regular file must not be removed, but got %s", err)
+		}
+	})
+}
+
+func TestGrpcServer_multipleListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listener")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "server.sock")
+
+	config := `server:
+  shutdown_timeout: 1s
+  listeners:
+    - address: 127.0.0.1:0
+    - network: unix
+      address: ` + socket + "\n"
+	c, err := conf.NewConfigurationFromReader("yaml", strings.NewReader(config))
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	logger := &log.Log{Logger: logrus.New()}
+	logger.Logger.SetOutput(ioutil.Discard)
+
+	sut := NewGrpcServer(c, logger)
+	if err := sut.Initialize(); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	sut.OnInitialized()
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- sut.Run(ctx)
+	}()
+
+	// すべての Listener で RPC を処理する
+	for _, l := range sut.Listeners {
+		network := l.Addr().Network()
+		conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure(), grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout(network, addr, timeout)
+		}))
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		res, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+		conn.Close()
+		if err != nil {
+			t.Fatalf("%s: err must be nil, but got %s", network, err)
+		}
+		if res.Status != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("%s: expected SERVING, but got %s", network, res.Status)
+		}
+	}
+
+	// 停止時はすべての Listener を close し、ソケットファイルも削除する
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Errorf("err must be nil, but got %s", err)
+	}
+	if err := sut.Finalize(); err != nil {
+		t.Errorf("err must be nil, but got %s", err)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("socket file must be removed, but got %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/kiririmode/grpc-sandbox/common/conf"
+	"github.com/kiririmode/grpc-sandbox/common/log"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// RecordingOff は記録も再生も行わないモード
+	RecordingOff = "off"
+	// RecordingRecord はリクエストと応答を記録するモード
+	RecordingRecord = "record"
+	// RecordingReplay は記録した応答を再生するモード
+	RecordingReplay = "replay"
+)
+
+// redactedMetadata は、recording.redact_metadata で指定したキーのメタデータの値に代えて記録する文字列
+const redactedMetadata = "REDACTED"
+
+// defaultRedactMetadata は、recording.redact_metadata が未設定の場合に値を伏せるメタデータのキー
+var defaultRedactMetadata = []string{"authorization", "proxy-authorization", "cookie", "set-cookie", "x-api-key"}
+
+// Record は 1 件のリクエストとその応答の記録を表現する。
+// Streaming RPC の場合は、受信したメッセージと、その直後に送信したメッセージの組を 1 件として記録する
+type Record struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	// リクエストのメタデータ。recording.redact_metadata で指定したキーの値は伏せる
+	Metadata map[string][]string `json:"metadata,omitempty"`
+	Request  json.RawMessage     `json:"request,omitempty"`
+	Reply    json.RawMessage     `json:"reply,omitempty"`
+	// 応答のステータスコード (ex. OK, Internal) とメッセージ
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// Recorder は recording.* の設定に従い、リクエストと応答を JSON Lines 形式のファイルに追記し、
+// また記録した応答を再生する。
+// 記録と再生は Greeter サービスの実装を置き換えて行うため、Interceptor が注入したエラーは記録せず、再生時にも Interceptor は適用される。
+// また、応答のヘッダ (ex. postscript) は記録せず、再生時にも送信しない
+type Recorder struct {
+	config *conf.Configuration
+	log    *log.Log
+	// RecordingOff, RecordingRecord, RecordingReplay のいずれか
+	mode string
+	// 再生時に、リクエストに加えて一致を確認するメタデータのキー
+	matchMetadata []string
+	// 記録時に値を伏せるメタデータのキー (小文字)
+	redactMetadata map[string]bool
+
+	mu   sync.Mutex
+	file *os.File
+	// 再生する記録 (キーは key で作成する)
+	records map[string][]*Record
+	// 再生した回数
+	replayed map[string]int
+}
+
+// NewRecorder は、設定 c に基いた新しい Recorder を返却する
+func NewRecorder(c *conf.Configuration, logger *log.Log) *Recorder {
+	return &Recorder{
+		config: c,
+		log:    logger,
+		mode:   RecordingOff,
+	}
+}
+
+// Name は初期化対象である "recorder" を返却する
+func (r *Recorder) Name() string {
+	return "recorder"
+}
+
+// Dependencies は configuration と log に依存することを返却する
+func (r *Recorder) Dependencies() []string {
+	return []string{r.config.Name(), r.log.Name()}
+}
+
+// Initialize は recording.mode に応じて、記録先のファイルを追記モードで開く、あるいは記録を読み込む。
+// 記録先のファイルには認証情報が含まれ得るため、所有者のみが読み書きできるように作成する。
+// YAML で引用符なしの off は false と解釈されるため、false も off として扱う
+func (r *Recorder) Initialize() error {
+	mode := strings.ToLower(r.config.GetString("recording.mode"))
+	file := r.config.GetString("recording.file")
+	r.matchMetadata = r.config.GetStringSlice("recording.match_metadata")
+	redact := r.config.GetStringSlice("recording.redact_metadata")
+	if len(redact) == 0 {
+		redact = defaultRedactMetadata
+	}
+	r.redactMetadata = make(map[string]bool, len(redact))
+	for _, k := range redact {
+		r.redactMetadata[strings.ToLower(k)] = true
+	}
+	// 値を伏せたメタデータは再生時に一致しないため、照合には用いることができない
+	for _, k := range r.matchMetadata {
+		if r.redactMetadata[strings.ToLower(k)] {
+			return errors.Errorf("metadata [%s] in \"recording.match_metadata\" is redacted by \"recording.redact_metadata\"", k)
+		}
+	}
+
+	switch mode {
+	case "", "false", RecordingOff:
+		r.mode = RecordingOff
+		return nil
+	case RecordingRecord:
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return errors.Wrapf(err, "failed to open recording file %s", file)
+		}
+		r.file = f
+	case RecordingReplay:
+		if err := r.load(file); err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("illegal recording mode [%s], specify \"off\", \"record\" or \"replay\" with \"recording.mode\" key", mode)
+	}
+
+	r.mode = mode
+	r.log.Logger.Infof("recording mode: %s (file: %s)", mode, file)
+	return nil
+}
+
+// load は file から記録を読み込む
+func (r *Recorder) load(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open recording file %s", file)
+	}
+	defer f.Close()
+
+	r.records = make(map[string][]*Record)
+	r.replayed = make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		rec := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			return errors.Wrapf(err, "illegal record at %s:%d", file, line)
+		}
+		k, err := r.key(rec.Method, rec.Metadata, rec.Request)
+		if err != nil {
+			return errors.Wrapf(err, "illegal record at %s:%d", file, line)
+		}
+		r.records[k] = append(r.records[k], rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "failed to read recording file %s", file)
+	}
+	return nil
+}
+
+// Finalize は終了処理として、記録先のファイルを close する
+func (r *Recorder) Finalize() error {
+	if r.file == nil {
+		return nil
+	}
+	if err := r.file.Close(); err != nil {
+		return errors.Wrap(err, "failed to close recording file")
+	}
+	return nil
+}
+
+// Mode は現在のモードを返却する
+func (r *Recorder) Mode() string {
+	return r.mode
+}
+
+// record は、ctx のメタデータを持つメソッド method へのリクエスト req と、その応答 reply, err を記録する。
+// authorization などの認証情報を記録しないよう、recording.redact_metadata で指定したキーのメタデータは値を伏せて記録する。
+// 記録に失敗した場合はログに出力する
+func (r *Recorder) record(ctx context.Context, method string, req, reply proto.Message, err error) {
+	rec := &Record{
+		Time:   time.Now(),
+		Method: method,
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		rec.Metadata = make(map[string][]string, len(md))
+		for k, v := range md {
+			if r.redactMetadata[k] {
+				v = []string{redactedMetadata}
+			}
+			rec.Metadata[k] = v
+		}
+	}
+	st := status.Convert(err)
+	rec.Code, rec.Message = st.Code().String(), st.Message()
+
+	var e error
+	if rec.Request, e = marshalMessage(req); e == nil {
+		rec.Reply, e = marshalMessage(reply)
+	}
+	if e != nil {
+		r.log.Logger.Errorf("failed to record %s: %s", method, e)
+		return
+	}
+
+	line, e := json.Marshal(rec)
+	if e != nil {
+		r.log.Logger.Errorf("failed to record %s: %s", method, e)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, e := r.file.Write(append(line, '\n')); e != nil {
+		r.log.Logger.Errorf("failed to record %s: %s", method, e)
+	}
+}
+
+// lookup は、ctx のメタデータを持つメソッド method へのリクエスト req に対して記録された応答を返却する。
+// 同じリクエストに対して複数の記録がある場合は記録された順に返却し、最後の記録は繰り返し返却する
+func (r *Recorder) lookup(ctx context.Context, method string, req proto.Message) (*Record, bool) {
+	raw, err := marshalMessage(req)
+	if err != nil {
+		return nil, false
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	k, err := r.key(method, md, raw)
+	if err != nil {
+		return nil, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	recs, ok := r.records[k]
+	if !ok {
+		return nil, false
+	}
+	i := r.replayed[k]
+	if i < len(recs)-1 {
+		r.replayed[k]++
+	}
+	return recs[i], true
+}
+
+// key は、再生時にリクエストを照合するためのキーを返却する。
+// キーはメソッド名、recording.match_metadata で指定したメタデータの値、正規化したリクエストから作成する
+func (r *Recorder) key(method string, md map[string][]string, request json.RawMessage) (string, error) {
+	parts := []string{method}
+	for _, k := range r.matchMetadata {
+		parts = append(parts, k+"="+strings.Join(md[strings.ToLower(k)], ","))
+	}
+
+	// フィールドの順序に依存しないよう、map を経由して正規化する
+	canonical := []byte("{}")
+	if len(request) > 0 {
+		var v interface{}
+		if err := json.Unmarshal(request, &v); err != nil {
+			return "", errors.Wrap(err, "illegal request")
+		}
+		var err error
+		if canonical, err = json.Marshal(v); err != nil {
+			return "", errors.Wrap(err, "illegal request")
+		}
+	}
+	return strings.Join(append(parts, string(canonical)), "\x00"), nil
+}
+
+// marshalMessage は msg を JSON に変換する。msg が nil の場合は nil を返却する
+func marshalMessage(msg proto.Message) (json.RawMessage, error) {
+	if msg == nil {
+		return nil, nil
+	}
+	m := &jsonpb.Marshaler{OrigName: true}
+	s, err := m.MarshalToString(msg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal message")
+	}
+	return json.RawMessage(s), nil
+}
+
+// unmarshalReply は記録された応答を msg に復元する
+func unmarshalReply(rec *Record, msg proto.Message) error {
+	if len(rec.Reply) == 0 {
+		return nil
+	}
+	if err := jsonpb.UnmarshalString(string(rec.Reply), msg); err != nil {
+		return errors.Wrapf(err, "failed to unmarshal recorded reply of %s", rec.Method)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kiririmode/grpc-sandbox/common/conf"
+	"github.com/kiririmode/grpc-sandbox/common/log"
+	"github.com/kiririmode/grpc-sandbox/helloworld"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newRecorder は、mode と file を設定とする、初期化済みの Recorder を返却する
+func newRecorder(t *testing.T, mode, file string, matchMetadata ...string) *Recorder {
+	config := fmt.Sprintf("recording:\n  mode: %s\n  file: %s\n  match_metadata: [%s]\n", mode, file, strings.Join(matchMetadata, ", "))
+	c, err := conf.NewConfigurationFromReader("yaml", strings.NewReader(config))
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	l := &log.Log{Logger: logrus.New()}
+	l.Logger.SetOutput(ioutil.Discard)
+
+	r := NewRecorder(c, l)
+	if err := r.Initialize(); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	return r
+}
+
+// echoGreeter は名前に応じた応答を返却する GreeterServer
+type echoGreeter struct {
+	helloworld.GreeterServer
+}
+
+func (g *echoGreeter) SayHello(ctx context.Context, req *helloworld.HelloRequest) (*helloworld.HelloReply, error) {
+	if req.Name == "error" {
+		return nil, status.Error(codes.Unavailable, "unavailable")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	return &helloworld.HelloReply{Message: "Hello " + req.Name + strings.Join(md["postscript"], "")}, nil
+}
+
+func TestRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recording")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "recorded.jsonl")
+
+	recorder := newRecorder(t, RecordingRecord, file)
+	sut := &recordingGreeter{delegate: &echoGreeter{}, recorder: recorder}
+	for _, tc := range []struct {
+		name       string
+		postscript string
+	}{
+		{name: "world", postscript: "!"},
+		{name: "world", postscript: "?"},
+		{name: "error"},
+	} {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("postscript", tc.postscript, "authorization", "Bearer secret"))
+		sut.SayHello(ctx, &helloworld.HelloRequest{Name: tc.name})
+	}
+	if err := recorder.Finalize(); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+
+	t.Run("メタデータを記録し、認証情報の値は伏せ、所有者のみが読み書きできるファイルに記録する", func(t *testing.T) {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("expected 0600, but got %o", info.Mode().Perm())
+		}
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if strings.Contains(string(b), "secret") {
+			t.Errorf("authorization must be redacted, but got %s", b)
+		}
+		for _, expected := range []string{`"authorization":["REDACTED"]`, `"postscript":["!"]`} {
+			if !strings.Contains(string(b), expected) {
+				t.Errorf("expected %s to be recorded, but got %s", expected, b)
+			}
+		}
+	})
+
+	t.Run("記録した順に応答を再生し、最後の応答を繰り返す", func(t *testing.T) {
+		replayer := &replayingGreeter{recorder: newRecorder(t, RecordingReplay, file)}
+		for _, expected := range []string{"Hello world!", "Hello world?", "Hello world?"} {
+			reply, err := replayer.SayHello(context.Background(), &helloworld.HelloRequest{Name: "world"})
+			if err != nil {
+				t.Fatalf("err must be nil, but got %s", err)
+			}
+			if reply.Message != expected {
+				t.Errorf("expected %s, but got %s", expected, reply.Message)
+			}
+		}
+	})
+
+	t.Run("メタデータを照合する", func(t *testing.T) {
+		replayer := &replayingGreeter{recorder: newRecorder(t, RecordingReplay, file, "postscript")}
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("postscript", "?"))
+		reply, err := replayer.SayHello(ctx, &helloworld.HelloRequest{Name: "world"})
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if reply.Message != "Hello world?" {
+			t.Errorf("expected Hello world?, but got %s", reply.Message)
+		}
+	})
+
+	t.Run("記録したエラーを再生する", func(t *testing.T) {
+		replayer := &replayingGreeter{recorder: newRecorder(t, RecordingReplay, file)}
+		_, err := replayer.SayHello(context.Background(), &helloworld.HelloRequest{Name: "error"})
+		if st := status.Convert(err); st.Code() != codes.Unavailable || st.Message() != "unavailable" {
+			t.Errorf("expected unavailable, but got %s", err)
+		}
+	})
+
+	t.Run("記録がなければ NOT_FOUND を返却する", func(t *testing.T) {
+		replayer := &replayingGreeter{recorder: newRecorder(t, RecordingReplay, file)}
+		_, err := replayer.SayHello(context.Background(), &helloworld.HelloRequest{Name: "nobody"})
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("expected %s, but got %s", codes.NotFound, status.Code(err))
+		}
+	})
+}
+
+func TestRecorder_Initialize(t *testing.T) {
+	t.Run("引用符なしの off や大文字を含むモードを受け付ける", func(t *testing.T) {
+		for _, mode := range []string{"off", "Off", "false", `"off"`, `""`} {
+			if actual := newRecorder(t, mode, "recorded.jsonl").Mode(); actual != RecordingOff {
+				t.Errorf("mode %s: expected %s, but got %s", mode, RecordingOff, actual)
+			}
+		}
+	})
+
+	t.Run("値を伏せるメタデータは照合に用いることができない", func(t *testing.T) {
+		c, err := conf.NewConfigurationFromReader("yaml", strings.NewReader("recording:\n  mode: record\n  match_metadata: [Authorization]\n"))
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		l := &log.Log{Logger: logrus.New()}
+		l.Logger.SetOutput(ioutil.Discard)
+		if err := NewRecorder(c, l).Initialize(); err == nil {
+			t.Error("error should be occured, but got success")
+		}
+	})
+
+	t.Run("不正なモードはエラーとする", func(t *testing.T) {
+		c, err := conf.NewConfigurationFromReader("yaml", strings.NewReader("recording:\n  mode: on\n"))
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		l := &log.Log{Logger: logrus.New()}
+		l.Logger.SetOutput(ioutil.Discard)
+		if err := NewRecorder(c, l).Initialize(); err == nil {
+			t.Error("error should be occured, but got success")
+		}
+	})
+}
@@ -0,0 +1,254 @@
+package router
+
+import (
+	"io"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+)
+
+// reflectionServer は、grpc.Server に登録されたサービスに加えて、
+// スタブとして読み込んだファイルのサービスを公開する grpc.reflection.v1alpha.ServerReflection サービス
+type reflectionServer struct {
+	server *grpc.Server
+	// スタブとして読み込んだファイル
+	files []*desc.FileDescriptor
+}
+
+// registerReflection は、s に登録されたサービスと files のサービスを公開する Reflection サービスを s に登録する
+func registerReflection(s *grpc.Server, files []*desc.FileDescriptor) {
+	rpb.RegisterServerReflectionServer(s, &reflectionServer{server: s, files: files})
+}
+
+// ServerReflectionInfo はリクエストに応じて、サービスの一覧やファイルの定義を返却する
+func (r *reflectionServer) ServerReflectionInfo(stream rpb.ServerReflection_ServerReflectionInfoServer) error {
+	// 同一ストリーム内で送信済みのファイル
+	sent := make(map[string]bool)
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		res := &rpb.ServerReflectionResponse{ValidHost: req.Host, OriginalRequest: req}
+		switch m := req.MessageRequest.(type) {
+		case *rpb.ServerReflectionRequest_FileByFilename:
+			fd, err := r.findFile(m.FileByFilename)
+			setFileResponse(res, fd, err, sent)
+		case *rpb.ServerReflectionRequest_FileContainingSymbol:
+			fd, err := r.findSymbol(m.FileContainingSymbol)
+			setFileResponse(res, fd, err, sent)
+		case *rpb.ServerReflectionRequest_FileContainingExtension:
+			ext := m.FileContainingExtension
+			fd, err := r.findExtension(ext.ContainingType, ext.ExtensionNumber)
+			setFileResponse(res, fd, err, sent)
+		case *rpb.ServerReflectionRequest_AllExtensionNumbersOfType:
+			r.setExtensionNumbersResponse(res, m.AllExtensionNumbersOfType)
+		case *rpb.ServerReflectionRequest_ListServices:
+			r.setListServicesResponse(res)
+		default:
+			return status.Errorf(codes.InvalidArgument, "invalid MessageRequest: %v", req.MessageRequest)
+		}
+
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+	}
+}
+
+// walk は、スタブとして読み込んだファイル、grpc.Server に登録されたサービスのファイルと、
+// それらが依存するファイルのそれぞれに対して、fn が true を返却するまで fn を呼び出す
+func (r *reflectionServer) walk(fn func(fd *desc.FileDescriptor) bool) {
+	files := append([]*desc.FileDescriptor{}, r.files...)
+	for _, info := range r.server.GetServiceInfo() {
+		name, ok := info.Metadata.(string)
+		if !ok {
+			continue
+		}
+		if fd, err := desc.LoadFileDescriptor(name); err == nil {
+			files = append(files, fd)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for len(files) > 0 {
+		fd := files[0]
+		files = files[1:]
+		if seen[fd.GetName()] {
+			continue
+		}
+		seen[fd.GetName()] = true
+		if fn(fd) {
+			return
+		}
+		files = append(files, fd.GetDependencies()...)
+	}
+}
+
+// findFile は name という名前のファイルを返却する
+func (r *reflectionServer) findFile(name string) (*desc.FileDescriptor, error) {
+	var found *desc.FileDescriptor
+	r.walk(func(fd *desc.FileDescriptor) bool {
+		if fd.GetName() == name {
+			found = fd
+		}
+		return found != nil
+	})
+	if found != nil {
+		return found, nil
+	}
+	// サービスを含まないファイルは、登録されたメッセージの定義から探す
+	fd, err := desc.LoadFileDescriptor(name)
+	if err != nil {
+		return nil, errors.Errorf("file %s not found", name)
+	}
+	return fd, nil
+}
+
+// findSymbol は完全修飾名 symbol の要素を定義しているファイルを返却する
+func (r *reflectionServer) findSymbol(symbol string) (*desc.FileDescriptor, error) {
+	var found *desc.FileDescriptor
+	r.walk(func(fd *desc.FileDescriptor) bool {
+		if fd.FindSymbol(symbol) != nil {
+			found = fd
+		}
+		return found != nil
+	})
+	if found == nil {
+		return nil, errors.Errorf("symbol %s not found", symbol)
+	}
+	return found, nil
+}
+
+// findExtension は、メッセージ containingType に対する番号 number の拡張を定義しているファイルを返却する
+func (r *reflectionServer) findExtension(containingType string, number int32) (*desc.FileDescriptor, error) {
+	var found *desc.FileDescriptor
+	r.walk(func(fd *desc.FileDescriptor) bool {
+		for _, ext := range extensions(fd) {
+			if ext.GetOwner().GetFullyQualifiedName() == containingType && ext.GetNumber() == number {
+				found = fd
+			}
+		}
+		return found != nil
+	})
+	if found == nil {
+		return nil, errors.Errorf("extension %d of %s not found", number, containingType)
+	}
+	return found, nil
+}
+
+// extensions は fd で定義されたすべての拡張を返却する
+func extensions(fd *desc.FileDescriptor) []*desc.FieldDescriptor {
+	exts := append([]*desc.FieldDescriptor{}, fd.GetExtensions()...)
+	var nested func(mds []*desc.MessageDescriptor)
+	nested = func(mds []*desc.MessageDescriptor) {
+		for _, md := range mds {
+			exts = append(exts, md.GetNestedExtensions()...)
+			nested(md.GetNestedMessageTypes())
+		}
+	}
+	nested(fd.GetMessageTypes())
+	return exts
+}
+
+// setFileResponse は、応答 res に fd と fd が依存するファイルのうち送信済みでないものを設定する。
+// err が nil でない場合は NOT_FOUND のエラーを設定する
+func setFileResponse(res *rpb.ServerReflectionResponse, fd *desc.FileDescriptor, err error, sent map[string]bool) {
+	if err != nil {
+		setErrorResponse(res, codes.NotFound, err)
+		return
+	}
+
+	var encoded [][]byte
+	var add func(fd *desc.FileDescriptor, force bool) error
+	add = func(fd *desc.FileDescriptor, force bool) error {
+		// 要求されたファイル自体は、送信済みであっても送信する
+		if sent[fd.GetName()] && !force {
+			return nil
+		}
+		b, err := proto.Marshal(fd.AsFileDescriptorProto())
+		if err != nil {
+			return errors.Wrapf(err, "failed to marshal file %s", fd.GetName())
+		}
+		sent[fd.GetName()] = true
+		encoded = append(encoded, b)
+		for _, dep := range fd.GetDependencies() {
+			if err := add(dep, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := add(fd, true); err != nil {
+		setErrorResponse(res, codes.Internal, err)
+		return
+	}
+	res.MessageResponse = &rpb.ServerReflectionResponse_FileDescriptorResponse{
+		FileDescriptorResponse: &rpb.FileDescriptorResponse{FileDescriptorProto: encoded},
+	}
+}
+
+// setExtensionNumbersResponse は、応答 res にメッセージ typeName に対する拡張の番号をすべて設定する
+func (r *reflectionServer) setExtensionNumbersResponse(res *rpb.ServerReflectionResponse, typeName string) {
+	fd, err := r.findSymbol(typeName)
+	if err != nil {
+		setErrorResponse(res, codes.NotFound, err)
+		return
+	}
+	if _, ok := fd.FindSymbol(typeName).(*desc.MessageDescriptor); !ok {
+		setErrorResponse(res, codes.NotFound, errors.Errorf("message %s not found", typeName))
+		return
+	}
+
+	numbers := make([]int32, 0)
+	r.walk(func(fd *desc.FileDescriptor) bool {
+		for _, ext := range extensions(fd) {
+			if ext.GetOwner().GetFullyQualifiedName() == typeName {
+				numbers = append(numbers, ext.GetNumber())
+			}
+		}
+		return false
+	})
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	res.MessageResponse = &rpb.ServerReflectionResponse_AllExtensionNumbersResponse{
+		AllExtensionNumbersResponse: &rpb.ExtensionNumberResponse{BaseTypeName: typeName, ExtensionNumber: numbers},
+	}
+}
+
+// setListServicesResponse は、応答 res に grpc.Server に登録されたサービスとスタブのサービスの名前を設定する
+func (r *reflectionServer) setListServicesResponse(res *rpb.ServerReflectionResponse) {
+	names := make(map[string]bool)
+	for name := range r.server.GetServiceInfo() {
+		names[name] = true
+	}
+	for _, fd := range r.files {
+		for _, sd := range fd.GetServices() {
+			names[sd.GetFullyQualifiedName()] = true
+		}
+	}
+
+	services := make([]*rpb.ServiceResponse, 0, len(names))
+	for name := range names {
+		services = append(services, &rpb.ServiceResponse{Name: name})
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	res.MessageResponse = &rpb.ServerReflectionResponse_ListServicesResponse{
+		ListServicesResponse: &rpb.ListServiceResponse{Service: services},
+	}
+}
+
+// setErrorResponse は、応答 res にステータスコード code のエラー err を設定する
+func setErrorResponse(res *rpb.ServerReflectionResponse, code codes.Code, err error) {
+	res.MessageResponse = &rpb.ServerReflectionResponse_ErrorResponse{
+		ErrorResponse: &rpb.ErrorResponse{ErrorCode: int32(code), ErrorMessage: err.Error()},
+	}
+}
@@ -0,0 +1,103 @@
+package router
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+)
+
+// reflectionStream は requests を順に受信し、送信した応答を記録する ServerReflection_ServerReflectionInfoServer
+type reflectionStream struct {
+	rpb.ServerReflection_ServerReflectionInfoServer
+	requests  []*rpb.ServerReflectionRequest
+	responses []*rpb.ServerReflectionResponse
+}
+
+func (s *reflectionStream) Recv() (*rpb.ServerReflectionRequest, error) {
+	if len(s.requests) == 0 {
+		return nil, io.EOF
+	}
+	req := s.requests[0]
+	s.requests = s.requests[1:]
+	return req, nil
+}
+func (s *reflectionStream) Send(res *rpb.ServerReflectionResponse) error {
+	s.responses = append(s.responses, res)
+	return nil
+}
+
+func TestReflectionServer(t *testing.T) {
+	parser := protoparse.Parser{
+		Accessor: protoparse.FileContentsFromMap(map[string]string{
+			"echo.proto":    `syntax = "proto3"; package echo; import "message.proto"; service Echo { rpc Echo (Message) returns (Message) {} }`,
+			"message.proto": `syntax = "proto3"; package echo; message Message { string message = 1; }`,
+		}),
+	}
+	files, err := parser.ParseFiles("echo.proto")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+
+	s := grpc.NewServer()
+	healthpb.RegisterHealthServer(s, health.NewServer())
+	sut := &reflectionServer{server: s, files: files}
+
+	stream := &reflectionStream{requests: []*rpb.ServerReflectionRequest{
+		{MessageRequest: &rpb.ServerReflectionRequest_ListServices{}},
+		{MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "echo.Echo"}},
+		{MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: "message.proto"}},
+		{MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "grpc.health.v1.Health"}},
+		{MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "echo.Unknown"}},
+	}}
+	if err := sut.ServerReflectionInfo(stream); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	if len(stream.responses) != 5 {
+		t.Fatalf("expected 5 responses, but got %d", len(stream.responses))
+	}
+
+	// fileNames は応答に含まれるファイルの名前を返却する
+	fileNames := func(res *rpb.ServerReflectionResponse) []string {
+		names := make([]string, 0)
+		for _, b := range res.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			fd := &descpb.FileDescriptorProto{}
+			if err := proto.Unmarshal(b, fd); err != nil {
+				t.Fatalf("err must be nil, but got %s", err)
+			}
+			names = append(names, fd.GetName())
+		}
+		return names
+	}
+
+	services := make([]string, 0)
+	for _, service := range stream.responses[0].GetListServicesResponse().GetService() {
+		services = append(services, service.Name)
+	}
+	if expected := []string{"echo.Echo", "grpc.health.v1.Health"}; !reflect.DeepEqual(services, expected) {
+		t.Errorf("expected %s, but got %s", expected, services)
+	}
+
+	// 依存するファイルも含めて返却する
+	if expected, actual := []string{"echo.proto", "message.proto"}, fileNames(stream.responses[1]); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %s, but got %s", expected, actual)
+	}
+	// 要求されたファイルは送信済みであっても返却する
+	if expected, actual := []string{"message.proto"}, fileNames(stream.responses[2]); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %s, but got %s", expected, actual)
+	}
+	if actual := fileNames(stream.responses[3]); len(actual) == 0 || !strings.HasSuffix(actual[0], "health.proto") {
+		t.Errorf("expected health.proto, but got %s", actual)
+	}
+	if stream.responses[4].GetErrorResponse() == nil {
+		t.Error("unknown symbol must result in error response")
+	}
+}
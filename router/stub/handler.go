@@ -0,0 +1,175 @@
+package stub
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Handler は読み込んだサービスへの RPC を処理する。
+// grpc.UnknownServiceHandler として登録し、grpc.Server に登録されていないサービスへの RPC を処理させる。
+// リクエストは定義に従って動的に復号し、条件を満たす最初の応答ルールに従って応答する。
+// Client Streaming RPC の場合は最後のリクエスト、それ以外はリクエスト毎に応答ルールを評価する
+func (s *Stub) Handler(srv interface{}, stream grpc.ServerStream) error {
+	method, ok := grpc.MethodFromServerStream(stream)
+	if !ok {
+		return status.Error(codes.Internal, "failed to get method name from stream")
+	}
+	md, ok := s.methods[method]
+	if !ok {
+		return status.Errorf(codes.Unimplemented, "unknown method %s", method)
+	}
+
+	h := &handler{stub: s, method: method, desc: md, stream: stream}
+	if md.IsClientStreaming() && !md.IsServerStreaming() {
+		return h.handleClientStream()
+	}
+	for {
+		req, err := h.recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := h.reply(req); err != nil {
+			return err
+		}
+		// Unary RPC, Server Streaming RPC はリクエストが 1 件のみ
+		if !md.IsClientStreaming() {
+			return nil
+		}
+	}
+}
+
+// handler は 1 つの RPC の処理を表現する
+type handler struct {
+	stub   *Stub
+	method string
+	desc   *desc.MethodDescriptor
+	stream grpc.ServerStream
+}
+
+// handleClientStream はすべてのリクエストを受信してから、最後のリクエストに対して応答する
+func (h *handler) handleClientStream() error {
+	var last *dynamic.Message
+	for {
+		req, err := h.recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		last = req
+	}
+	if last == nil {
+		last = dynamic.NewMessage(h.desc.GetInputType())
+	}
+	return h.reply(last)
+}
+
+// recv はリクエストを 1 件受信する
+func (h *handler) recv() (*dynamic.Message, error) {
+	req := dynamic.NewMessage(h.desc.GetInputType())
+	if err := h.stream.RecvMsg(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// reply は req に対して、条件を満たす最初の応答ルールに従って応答する
+func (h *handler) reply(req *dynamic.Message) error {
+	md, _ := metadata.FromIncomingContext(h.stream.Context())
+	var r *response
+	for _, rule := range h.stub.rules() {
+		if rule.matcher.Match(h.method, md, req) {
+			r = rule
+			break
+		}
+	}
+	if r == nil {
+		return status.Errorf(codes.Unimplemented, "no stub response matches %s", h.method)
+	}
+
+	data, err := newTemplateData(h.method, md, req)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if r.code != codes.OK {
+		msg, err := r.message.executeString(data)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to render message: %s", err)
+		}
+		return status.Error(r.code, msg)
+	}
+
+	count := 1
+	if h.desc.IsServerStreaming() {
+		count = r.count
+	}
+	for i := 0; i < count; i++ {
+		data.Index = i
+		reply, err := h.render(r, data)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if err := h.stream.SendMsg(reply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// render は data を用いて r の応答メッセージを作成する
+func (h *handler) render(r *response, data *templateData) (*dynamic.Message, error) {
+	body, err := r.body.execute(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to render body")
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to render body")
+	}
+
+	reply := dynamic.NewMessage(h.desc.GetOutputType())
+	if err := reply.UnmarshalJSONPB(&jsonpb.Unmarshaler{}, b); err != nil {
+		return nil, errors.Wrapf(err, "body does not match %s", h.desc.GetOutputType().GetFullyQualifiedName())
+	}
+	return reply, nil
+}
+
+// newTemplateData は、メソッド名 method、リクエストメタデータ md、リクエストメッセージ req からテンプレートに渡すデータを作成する
+func newTemplateData(method string, md metadata.MD, req *dynamic.Message) (*templateData, error) {
+	data := &templateData{
+		Method:   method,
+		Metadata: make(map[string]string, len(md)),
+		Request:  make(map[string]interface{}),
+	}
+	for k, v := range md {
+		if len(v) > 0 {
+			data.Metadata[k] = v[0]
+		}
+	}
+
+	b, err := req.MarshalJSONPB(&jsonpb.Marshaler{OrigName: true, EmitDefaults: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal request")
+	}
+	// 数値を丸めずに出力できるよう、json.Number として扱う
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&data.Request); err != nil {
+		return nil, errors.Wrap(err, "failed to marshal request")
+	}
+	return data, nil
+}
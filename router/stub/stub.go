@@ -0,0 +1,282 @@
+package stub
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/kiririmode/grpc-sandbox/common/conf"
+	"github.com/kiririmode/grpc-sandbox/common/log"
+	"github.com/kiririmode/grpc-sandbox/router/fault"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+)
+
+// ResponseConfig は stub.responses に記述する応答ルールの設定を表現する
+type ResponseConfig struct {
+	fault.Matcher `mapstructure:",squash"`
+	// 返却するステータスコード (ex. OK, NOT_FOUND)。省略した場合は OK となる
+	Code string `mapstructure:"code"`
+	// ステータスコードが OK でない場合に返却するエラーメッセージ (テンプレート)
+	Message string `mapstructure:"message"`
+	// 応答メッセージのフィールド名 (proto ファイル上の名前) と値。文字列の値はテンプレートとして扱う
+	Body map[string]interface{} `mapstructure:"body"`
+	// Server Streaming RPC の場合に、1 件のリクエストに対して送信する応答の数。省略した場合は 1 となる
+	Count int `mapstructure:"count"`
+}
+
+// response は設定から作成した、実行時に用いる応答ルール
+type response struct {
+	matcher fault.Matcher
+	code    codes.Code
+	message *template
+	body    *template
+	count   int
+}
+
+// Stub は設定された FileDescriptorSet や proto ファイルのサービスを、応答ルールに従って提供する
+type Stub struct {
+	config *conf.Configuration
+	log    *log.Log
+	// 読み込んだファイル (依存するファイルを含む)
+	files []*desc.FileDescriptor
+	// メソッド名 (ex. /helloworld.Greeter/SayHello) とその定義
+	methods map[string]*desc.MethodDescriptor
+
+	mu        sync.RWMutex
+	responses []*response
+	// 設定の再読み込みの購読
+	subscriptions []*conf.Subscription
+}
+
+// NewStub は、設定 c の stub.* に従う Stub を返却する
+func NewStub(c *conf.Configuration, logger *log.Log) *Stub {
+	return &Stub{
+		config: c,
+		log:    logger,
+	}
+}
+
+// Name は初期化対象である "stub" を返却する
+func (s *Stub) Name() string {
+	return "stub"
+}
+
+// Dependencies は configuration と log に依存することを返却する
+func (s *Stub) Dependencies() []string {
+	return []string{s.config.Name(), s.log.Name()}
+}
+
+// Initialize は stub.descriptor_sets と stub.proto_files からサービスの定義を、stub.responses から応答ルールを読み込む。
+// 応答ルールは、設定の再読み込み時にも読み込み直す
+func (s *Stub) Initialize() error {
+	files := make(map[string]*desc.FileDescriptor)
+	for _, path := range s.config.GetStringSlice("stub.descriptor_sets") {
+		fds, err := loadDescriptorSet(path)
+		if err != nil {
+			return err
+		}
+		for name, fd := range fds {
+			files[name] = fd
+		}
+	}
+
+	if protoFiles := s.config.GetStringSlice("stub.proto_files"); len(protoFiles) > 0 {
+		parser := protoparse.Parser{ImportPaths: s.config.GetStringSlice("stub.import_paths")}
+		fds, err := parser.ParseFiles(protoFiles...)
+		if err != nil {
+			return errors.Wrap(err, "failed to parse proto files")
+		}
+		for _, fd := range fds {
+			files[fd.GetName()] = fd
+		}
+	}
+
+	if err := s.index(files); err != nil {
+		return err
+	}
+	responses, err := newResponses(s.config)
+	if err != nil {
+		return err
+	}
+	s.setResponses(responses)
+	s.subscribe()
+
+	for _, name := range s.Services() {
+		s.log.Logger.Infof("stub service: %s", name)
+	}
+	return nil
+}
+
+// loadDescriptorSet は path から FileDescriptorSet を読み込む。
+// FileDescriptorSet は依存するファイルを含めて作成されている (protoc の --include_imports を指定する) 必要がある
+func loadDescriptorSet(path string) (map[string]*desc.FileDescriptor, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read descriptor set %s", path)
+	}
+	fds := &descpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(b, fds); err != nil {
+		return nil, errors.Wrapf(err, "illegal descriptor set %s", path)
+	}
+	files, err := desc.CreateFileDescriptorsFromSet(fds)
+	if err != nil {
+		return nil, errors.Wrapf(err, "illegal descriptor set %s", path)
+	}
+	return files, nil
+}
+
+// index は files とその依存するファイルを保持し、定義されたメソッドの索引を作成する
+func (s *Stub) index(files map[string]*desc.FileDescriptor) error {
+	s.files = nil
+	s.methods = make(map[string]*desc.MethodDescriptor)
+
+	seen := make(map[string]bool)
+	var add func(fd *desc.FileDescriptor)
+	add = func(fd *desc.FileDescriptor) {
+		if seen[fd.GetName()] {
+			return
+		}
+		seen[fd.GetName()] = true
+		for _, dep := range fd.GetDependencies() {
+			add(dep)
+		}
+		s.files = append(s.files, fd)
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(files[name])
+	}
+
+	for _, fd := range s.files {
+		for _, sd := range fd.GetServices() {
+			for _, md := range sd.GetMethods() {
+				name := fmt.Sprintf("/%s/%s", sd.GetFullyQualifiedName(), md.GetName())
+				if _, ok := s.methods[name]; ok {
+					return errors.Errorf("method %s is defined more than once", name)
+				}
+				s.methods[name] = md
+			}
+		}
+	}
+	return nil
+}
+
+// newResponses は設定 c の stub.responses から応答ルールを読み込む
+func newResponses(c *conf.Configuration) ([]*response, error) {
+	var configs []ResponseConfig
+	if err := c.UnmarshalKey("stub.responses", &configs); err != nil {
+		return nil, err
+	}
+
+	responses := make([]*response, 0, len(configs))
+	for i, rc := range configs {
+		r, err := newResponse(rc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "illegal response stub.responses[%d]", i)
+		}
+		responses = append(responses, r)
+	}
+	return responses, nil
+}
+
+// setResponses は応答ルールを responses に置き換える
+func (s *Stub) setResponses(responses []*response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses = responses
+}
+
+// rules は現在の応答ルールを返却する
+func (s *Stub) rules() []*response {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.responses
+}
+
+// subscribe は設定の再読み込みを購読し、stub.responses の変更を反映する。
+// サービスの定義の変更は再起動後に反映する
+func (s *Stub) subscribe() {
+	validator := s.config.AddValidator("stub.responses", func(next *conf.Configuration) error {
+		_, err := newResponses(next)
+		return err
+	})
+	onChange := s.config.Subscribe("stub", func(e *conf.ChangeEvent) {
+		if e.Changed("stub.responses") {
+			responses, _ := newResponses(s.config)
+			s.setResponses(responses)
+			s.log.Logger.Infof("stub responses reloaded (%d rules)", len(responses))
+		}
+		if e.Changed("stub.descriptor_sets") || e.Changed("stub.import_paths") || e.Changed("stub.proto_files") {
+			s.log.Logger.Warn("changes of stub services are applied after restart")
+		}
+	})
+	s.subscriptions = []*conf.Subscription{validator, onChange}
+}
+
+// newResponse は設定 c から応答ルールを作成する
+func newResponse(c ResponseConfig) (*response, error) {
+	if err := c.Matcher.Validate(); err != nil {
+		return nil, err
+	}
+
+	code := codes.OK
+	if c.Code != "" {
+		var err error
+		if code, err = fault.ParseCode(c.Code); err != nil {
+			return nil, err
+		}
+	}
+	if c.Count < 0 {
+		return nil, errors.Errorf("count must not be negative, but got [%d]", c.Count)
+	}
+	count := c.Count
+	if count == 0 {
+		count = 1
+	}
+
+	message, err := newTemplate(c.Message)
+	if err != nil {
+		return nil, errors.Wrap(err, "illegal message template")
+	}
+	body, err := newTemplate(c.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "illegal body template")
+	}
+	return &response{matcher: c.Matcher, code: code, message: message, body: body, count: count}, nil
+}
+
+// Finalize は終了処理として、設定の再読み込みの購読を解除する
+func (s *Stub) Finalize() error {
+	for _, sub := range s.subscriptions {
+		sub.Unsubscribe()
+	}
+	s.subscriptions = nil
+	return nil
+}
+
+// Files は読み込んだファイルを、依存されるファイルが先になるよう返却する
+func (s *Stub) Files() []*desc.FileDescriptor {
+	return s.files
+}
+
+// Services は読み込んだサービスの名前 (ex. helloworld.Greeter) を返却する
+func (s *Stub) Services() []string {
+	names := make([]string, 0)
+	for _, fd := range s.files {
+		for _, sd := range fd.GetServices() {
+			names = append(names, sd.GetFullyQualifiedName())
+		}
+	}
+	return names
+}
@@ -0,0 +1,195 @@
+package stub
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/kiririmode/grpc-sandbox/common/conf"
+	"github.com/kiririmode/grpc-sandbox/common/log"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const echoProto = `
+syntax = "proto3";
+package echo;
+service Echo {
+  rpc Echo (EchoRequest) returns (EchoReply) {}
+  rpc EchoMany (EchoRequest) returns (stream EchoReply) {}
+  rpc EchoLast (stream EchoRequest) returns (EchoReply) {}
+}
+message EchoRequest {
+  string message = 1;
+}
+message EchoReply {
+  string message = 1;
+  int32 index = 2;
+}
+`
+
+// newStub は、echoProto を読み込み、responses を応答ルールとする初期化済みの Stub を返却する
+func newStub(t *testing.T, responses string) *Stub {
+	dir, err := ioutil.TempDir("", "stub")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "echo.proto"), []byte(echoProto), 0644); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+
+	config := "stub:\n  import_paths: [" + dir + "]\n  proto_files: [echo.proto]\n  responses:\n" + responses
+	c, err := conf.NewConfigurationFromReader("yaml", strings.NewReader(config))
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	l := &log.Log{Logger: logrus.New()}
+	l.Logger.SetOutput(ioutil.Discard)
+
+	s := NewStub(c, l)
+	if err := s.Initialize(); err != nil {
+		t.Fatalf("err must be nil, but got %s", err)
+	}
+	return s
+}
+
+// transportStream はメソッド名のみを提供する grpc.ServerTransportStream
+type transportStream struct {
+	grpc.ServerTransportStream
+	method string
+}
+
+func (s *transportStream) Method() string {
+	return s.method
+}
+
+// echoServerStream は requests を順に受信し、送信したメッセージを記録する grpc.ServerStream
+type echoServerStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	requests []string
+	replies  []*dynamic.Message
+}
+
+func newEchoServerStream(method string, md metadata.MD, requests ...string) *echoServerStream {
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+	ctx = grpc.NewContextWithServerTransportStream(ctx, &transportStream{method: method})
+	return &echoServerStream{ctx: ctx, requests: requests}
+}
+
+func (s *echoServerStream) Context() context.Context {
+	return s.ctx
+}
+func (s *echoServerStream) RecvMsg(m interface{}) error {
+	if len(s.requests) == 0 {
+		return io.EOF
+	}
+	req := s.requests[0]
+	s.requests = s.requests[1:]
+	return m.(*dynamic.Message).UnmarshalJSON([]byte(req))
+}
+func (s *echoServerStream) SendMsg(m interface{}) error {
+	s.replies = append(s.replies, m.(*dynamic.Message))
+	return nil
+}
+
+func TestStub_Initialize(t *testing.T) {
+	s := newStub(t, "    - method: /echo.Echo/*\n")
+	if services := s.Services(); len(services) != 1 || services[0] != "echo.Echo" {
+		t.Errorf("expected [echo.Echo], but got %s", services)
+	}
+
+	for _, config := range []string{
+		"stub:\n  proto_files: [notfound.proto]\n",
+		"stub:\n  descriptor_sets: [notfound.pb]\n",
+		"stub:\n  responses:\n    - code: hoge\n",
+		"stub:\n  responses:\n    - body:\n        message: \"{{.Request.message\"\n",
+	} {
+		c, err := conf.NewConfigurationFromReader("yaml", strings.NewReader(config))
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if err := NewStub(c, &log.Log{Logger: logrus.New()}).Initialize(); err == nil {
+			t.Errorf("illegal config must be rejected: %s", config)
+		}
+	}
+}
+
+func TestStub_Handler(t *testing.T) {
+	sut := newStub(t, `
+    - request:
+        message: error
+      code: INVALID_ARGUMENT
+      message: "invalid message: {{.Request.message}}"
+    - method: /echo.Echo/EchoMany
+      body:
+        message: "{{.Request.message}}"
+        index: "{{.Index}}"
+      count: 3
+    - method: /echo.Echo/Echo*
+      body:
+        message: "{{.Request.message}}{{.Metadata.postscript}}"
+`)
+
+	t.Run("Unary RPC にテンプレートから作成した応答を返却する", func(t *testing.T) {
+		stream := newEchoServerStream("/echo.Echo/Echo", metadata.Pairs("postscript", "!"), `{"message": "hello"}`)
+		if err := sut.Handler(nil, stream); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if len(stream.replies) != 1 {
+			t.Fatalf("expected 1 reply, but got %d", len(stream.replies))
+		}
+		if actual := stream.replies[0].GetFieldByName("message"); actual != "hello!" {
+			t.Errorf("expected hello!, but got %s", actual)
+		}
+	})
+
+	t.Run("Server Streaming RPC に指定した数の応答を返却する", func(t *testing.T) {
+		stream := newEchoServerStream("/echo.Echo/EchoMany", nil, `{"message": "hello"}`)
+		if err := sut.Handler(nil, stream); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if len(stream.replies) != 3 {
+			t.Fatalf("expected 3 replies, but got %d", len(stream.replies))
+		}
+		for i, reply := range stream.replies {
+			if actual := reply.GetFieldByName("index"); actual != int32(i) {
+				t.Errorf("expected index %d, but got %v", i, actual)
+			}
+		}
+	})
+
+	t.Run("Client Streaming RPC に最後のリクエストに対する応答を返却する", func(t *testing.T) {
+		stream := newEchoServerStream("/echo.Echo/EchoLast", nil, `{"message": "first"}`, `{"message": "last"}`)
+		if err := sut.Handler(nil, stream); err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if len(stream.replies) != 1 || stream.replies[0].GetFieldByName("message") != "last" {
+			t.Errorf("expected reply to last request, but got %v", stream.replies)
+		}
+	})
+
+	t.Run("エラーを返却する", func(t *testing.T) {
+		stream := newEchoServerStream("/echo.Echo/Echo", nil, `{"message": "error"}`)
+		st := status.Convert(sut.Handler(nil, stream))
+		if st.Code() != codes.InvalidArgument || st.Message() != "invalid message: error" {
+			t.Errorf("expected invalid argument, but got %s", st.Err())
+		}
+	})
+
+	t.Run("定義されていないメソッドには UNIMPLEMENTED を返却する", func(t *testing.T) {
+		stream := newEchoServerStream("/echo.Echo/Unknown", nil, `{}`)
+		if actual := status.Code(sut.Handler(nil, stream)); actual != codes.Unimplemented {
+			t.Errorf("expected %s, but got %s", codes.Unimplemented, actual)
+		}
+	})
+}
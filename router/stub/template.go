@@ -0,0 +1,126 @@
+package stub
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	texttemplate "text/template"
+)
+
+// templateData は応答のテンプレートに渡すデータ。
+// テンプレートでは {{.Request.name}} や {{.Metadata.postscript}} のように参照する
+type templateData struct {
+	// メソッド名 (ex. /helloworld.Greeter/SayHello)
+	Method string
+	// リクエストメタデータのキーと (最初の) 値
+	Metadata map[string]string
+	// リクエストメッセージのフィールド名 (proto ファイル上の名前) と値
+	Request map[string]interface{}
+	// 1 件のリクエストに対して送信する応答のうち、何件目 (0 始まり) か
+	Index int
+}
+
+// template は応答のテンプレート。文字列、数値、真偽値、それらのリストと map を値とし、
+// "{{" を含む文字列は text/template のテンプレートとして評価する
+type template struct {
+	value interface{}
+}
+
+// newTemplate は v から新しい template を作成する
+func newTemplate(v interface{}) (*template, error) {
+	compiled, err := compile(v)
+	if err != nil {
+		return nil, err
+	}
+	return &template{value: compiled}, nil
+}
+
+// compile は v に含まれるテンプレートの文字列を解析する。
+// YAML から読み込んだ map[interface{}]interface{} は、JSON に変換できるよう map[string]interface{} に変換する
+func compile(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		if !strings.Contains(v, "{{") {
+			return v, nil
+		}
+		return texttemplate.New("").Option("missingkey=zero").Parse(v)
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			c, err := compile(e)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = c
+		}
+		return m, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			c, err := compile(e)
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(k)] = c
+		}
+		return m, nil
+	case []interface{}:
+		l := make([]interface{}, 0, len(v))
+		for _, e := range v {
+			c, err := compile(e)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, c)
+		}
+		return l, nil
+	}
+	return v, nil
+}
+
+// execute は data を用いてテンプレートを評価した値を返却する
+func (t *template) execute(data *templateData) (interface{}, error) {
+	return render(t.value, data)
+}
+
+// executeString は data を用いてテンプレートを評価した値を文字列として返却する
+func (t *template) executeString(data *templateData) (string, error) {
+	v, err := t.execute(data)
+	if err != nil || v == nil {
+		return "", err
+	}
+	return fmt.Sprint(v), nil
+}
+
+// render は v に含まれるテンプレートを data を用いて評価する
+func render(v interface{}, data *templateData) (interface{}, error) {
+	switch v := v.(type) {
+	case *texttemplate.Template:
+		buf := &bytes.Buffer{}
+		if err := v.Execute(buf, data); err != nil {
+			return nil, err
+		}
+		return buf.String(), nil
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			r, err := render(e, data)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = r
+		}
+		return m, nil
+	case []interface{}:
+		l := make([]interface{}, 0, len(v))
+		for _, e := range v {
+			r, err := render(e, data)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, r)
+		}
+		return l, nil
+	}
+	return v, nil
+}
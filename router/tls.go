@@ -0,0 +1,167 @@
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kiririmode/grpc-sandbox/common/conf"
+	"github.com/kiririmode/grpc-sandbox/common/log"
+	"github.com/pkg/errors"
+)
+
+// parseClientAuth は server.tls.client_auth の設定値を tls.ClientAuthType に変換する。
+// "request" はクライアント証明書を要求し、提示された場合のみ検証する
+func parseClientAuth(v string) (tls.ClientAuthType, error) {
+	switch v {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require-and-verify":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, errors.Errorf("illegal client auth mode [%s], specify \"none\", \"request\" or \"require-and-verify\" with \"server.tls.client_auth\" key", v)
+}
+
+// certificateReloader はサーバ証明書とクライアント認証用の CA 証明書をファイルから読み込み、
+// ファイルが更新された場合は TLS ハンドシェイク時に再読み込みする
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	// ハンドシェイク毎に複製して利用する TLS 設定
+	base *tls.Config
+	log  *log.Log
+
+	mu          sync.Mutex
+	certificate tls.Certificate
+	clientCAs   *x509.CertPool
+	// 読み込み時点での各ファイルの更新日時
+	modTimes map[string]time.Time
+}
+
+// newTLSConfig は server.tls.* の設定を元に、証明書の再読み込みに対応した TLS 設定を返却する。
+// server.tls.cert_file が設定されていない場合は TLS を利用しないものとし、nil を返却する
+func newTLSConfig(c *conf.Configuration, logger *log.Log) (*tls.Config, error) {
+	certFile := c.GetString("server.tls.cert_file")
+	if certFile == "" {
+		return nil, nil
+	}
+
+	clientAuth, err := parseClientAuth(c.GetString("server.tls.client_auth"))
+	if err != nil {
+		return nil, err
+	}
+	caFile := c.GetString("server.tls.client_ca_file")
+	if clientAuth != tls.NoClientCert && caFile == "" {
+		return nil, errors.Errorf("\"server.tls.client_ca_file\" is required when client auth mode is [%s]", c.GetString("server.tls.client_auth"))
+	}
+
+	r := &certificateReloader{
+		certFile: certFile,
+		keyFile:  c.GetString("server.tls.key_file"),
+		caFile:   caFile,
+		base: &tls.Config{
+			ClientAuth: clientAuth,
+			MinVersion: tls.VersionTLS12,
+			NextProtos: []string{"h2"},
+		},
+		log: logger,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		GetConfigForClient: r.getConfigForClient,
+		MinVersion:         tls.VersionTLS12,
+	}, nil
+}
+
+// files は監視対象のファイルを返却する
+func (r *certificateReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.caFile != "" {
+		files = append(files, r.caFile)
+	}
+	return files
+}
+
+// load は証明書ファイルを読み込む。失敗した場合、それまでに読み込んだ証明書は変更しない。
+// 同じ内容のファイルを繰り返し読み込まないよう、更新日時は成否に関わらず記録する
+func (r *certificateReloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return errors.Wrapf(err, "failed to stat %s", f)
+		}
+		modTimes[f] = info.ModTime()
+	}
+	r.mu.Lock()
+	r.modTimes = modTimes
+	r.mu.Unlock()
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load key pair (cert: %s, key: %s)", r.certFile, r.keyFile)
+	}
+
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read client CA file %s", r.caFile)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.Errorf("no valid certificate found in client CA file %s", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.certificate, r.clientCAs = certificate, pool
+	return nil
+}
+
+// modified は前回読み込み時から更新されたファイルがあるかどうかを返却する
+func (r *certificateReloader) modified() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for f, t := range r.modTimes {
+		info, err := os.Stat(f)
+		if err != nil {
+			// ローテーション中でファイルが存在しない場合もあるため、次回に再度確認する
+			continue
+		}
+		if !info.ModTime().Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// getConfigForClient は、必要に応じて証明書を再読み込みした上で、ハンドシェイクに用いる TLS 設定を返却する。
+// 再読み込みに失敗した場合は、エラーをログに出力し、前回読み込んだ証明書を使い続ける
+func (r *certificateReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	if r.modified() {
+		if err := r.load(); err != nil {
+			r.log.Logger.Errorf("failed to reload certificates, keep using previous ones: %s", err)
+		} else {
+			r.log.Logger.Infof("certificates reloaded from %s", r.certFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.base.Clone()
+	c.Certificates = []tls.Certificate{r.certificate}
+	c.ClientCAs = r.clientCAs
+	return c, nil
+}
@@ -0,0 +1,160 @@
+package router
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiririmode/grpc-sandbox/common/conf"
+	"github.com/kiririmode/grpc-sandbox/common/log"
+	"github.com/sirupsen/logrus"
+)
+
+// writeSelfSignedCertificate は自己署名証明書と秘密鍵を PEM 形式で certFile, keyFile に書き出し、
+// 証明書の DER を返却する
+func writeSelfSignedCertificate(t *testing.T, certFile, keyFile string, serial int64) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatalf("failed to write certificate: %s", err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatalf("failed to write key: %s", err)
+	}
+	return der
+}
+
+func TestParseClientAuth(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected tls.ClientAuthType
+	}{
+		{value: "", expected: tls.NoClientCert},
+		{value: "none", expected: tls.NoClientCert},
+		{value: "request", expected: tls.VerifyClientCertIfGiven},
+		{value: "require-and-verify", expected: tls.RequireAndVerifyClientCert},
+	}
+	for _, tc := range testCases {
+		actual, err := parseClientAuth(tc.value)
+		if err != nil {
+			t.Errorf("err must be nil, but got %s", err)
+		}
+		if actual != tc.expected {
+			t.Errorf("expected %d, but got %d", tc.expected, actual)
+		}
+	}
+
+	if _, err := parseClientAuth("hoge"); err == nil {
+		t.Error("client auth mode hoge is not supported, but no error occured")
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	logger := &log.Log{Logger: logrus.New()}
+	logger.Logger.SetOutput(ioutil.Discard)
+
+	t.Run("証明書ファイルが指定されていなければ TLS を利用しない", func(t *testing.T) {
+		c, err := conf.NewConfigurationFromReader("properties", strings.NewReader("server.port=10000"))
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		tlsConfig, err := newTLSConfig(c, logger)
+		if err != nil {
+			t.Errorf("err must be nil, but got %s", err)
+		}
+		if tlsConfig != nil {
+			t.Error("tls config must be nil")
+		}
+	})
+
+	t.Run("クライアント認証を行うには CA 証明書が必要", func(t *testing.T) {
+		config := `server.tls.cert_file=server.crt
+		server.tls.key_file=server.key
+		server.tls.client_auth=require-and-verify`
+		c, err := conf.NewConfigurationFromReader("properties", strings.NewReader(config))
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if _, err := newTLSConfig(c, logger); err == nil {
+			t.Error("client_ca_file is missing, but no error occured")
+		}
+	})
+
+	t.Run("証明書が更新されると再読み込みされる", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "tls")
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+		before := writeSelfSignedCertificate(t, certFile, keyFile, 1)
+
+		config := fmt.Sprintf("server.tls.cert_file=%s\nserver.tls.key_file=%s", certFile, keyFile)
+		c, err := conf.NewConfigurationFromReader("properties", strings.NewReader(config))
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		tlsConfig, err := newTLSConfig(c, logger)
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+
+		actual, err := tlsConfig.GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if !bytes.Equal(actual.Certificates[0].Certificate[0], before) {
+			t.Error("initial certificate is not served")
+		}
+
+		// 証明書を更新し、更新日時を確実に変更する
+		after := writeSelfSignedCertificate(t, certFile, keyFile, 2)
+		future := time.Now().Add(time.Minute)
+		for _, f := range []string{certFile, keyFile} {
+			if err := os.Chtimes(f, future, future); err != nil {
+				t.Fatalf("err must be nil, but got %s", err)
+			}
+		}
+
+		actual, err = tlsConfig.GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err)
+		}
+		if !bytes.Equal(actual.Certificates[0].Certificate[0], after) {
+			t.Error("rotated certificate is not served")
+		}
+	})
+}
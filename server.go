@@ -1,29 +1,128 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
 	"github.com/kiririmode/grpc-sandbox/common"
 	"github.com/kiririmode/grpc-sandbox/common/conf"
 	"github.com/kiririmode/grpc-sandbox/common/log"
+	"github.com/kiririmode/grpc-sandbox/common/metrics"
 	"github.com/kiririmode/grpc-sandbox/router"
-	"google.golang.org/grpc"
+	"github.com/kiririmode/grpc-sandbox/router/fault"
+	"github.com/kiririmode/grpc-sandbox/router/stub"
 )
 
 func main() {
-	s := grpc.NewServer()
+	// 最初の引数がオプションでない場合はサブコマンドとして扱い、省略した場合は serve とする
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	var err error
+	switch cmd {
+	case "serve":
+		serve(args)
+	case "encrypt":
+		err = encrypt(args, os.Stdin, os.Stdout)
+	case "decrypt":
+		err = decrypt(args, os.Stdin, os.Stdout)
+	case "reencrypt":
+		err = reencrypt(args, os.Stdin, os.Stdout)
+	case "genkey":
+		err = genkey(args, os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown subcommand: %s\nUsage: %s [serve|encrypt|decrypt|reencrypt|genkey] [options]\n", cmd, os.Args[0])
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", cmd, err)
+		os.Exit(1)
+	}
+}
+
+// serve は gRPC サーバを起動し、停止されるまで待ち受ける
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Parse(args)
 
 	// リソースの準備
 	config := conf.NewConfiguration("stubserver", "development", []string{"conf"})
 	logr := log.NewLog(config)
-	server := router.NewGrpcServer(s, config, logr)
+	metric := metrics.NewMetrics(config, logr)
+	latencyInjector := fault.NewLatencyInjector(config)
+	errorInjector := fault.NewErrorInjector(config)
+	recorder := router.NewRecorder(config, logr)
+	stubServer := stub.NewStub(config, logr)
+	server := router.NewGrpcServer(config, logr).SetRecorder(recorder).SetStub(stubServer).
+		DependsOn(metric, latencyInjector, errorInjector)
+	// 遅延させた上でエラーを返却できるよう、遅延注入をエラー注入より先に適用する
+	server.AddUnaryInterceptor(metric.UnaryServerInterceptor()).
+		AddStreamInterceptor(metric.StreamServerInterceptor()).
+		AddUnaryInterceptor(latencyInjector.UnaryServerInterceptor()).
+		AddStreamInterceptor(latencyInjector.StreamServerInterceptor()).
+		AddUnaryInterceptor(errorInjector.UnaryServerInterceptor()).
+		AddStreamInterceptor(errorInjector.StreamServerInterceptor())
 
-	// リソースの開始・終了処理
-	rm := common.NewResourceManager([]common.Resource{config, logr, server})
-	rm.Initialize()
-	defer rm.Finalize()
+	// リソースの開始・終了処理。各リソースは依存するリソースの後に初期化され、先に終了する
+	// 各リソースの初期化・終了処理は lifecycle.* の制限時間で打ち切る
+	rm := common.NewResourceManager([]common.Resource{config, logr, metric, latencyInjector, errorInjector, recorder, stubServer, server}).
+		SetTimeouts(config).
+		AddObserver(log.NewLifecycleObserver(logr)).
+		AddObserver(metrics.NewLifecycleObserver(metric))
+	if err := rm.Initialize(); err != nil {
+		// 初期化済みのリソースはロールバックとして終了済みのため、ログではなく標準エラー出力に出力する
+		fmt.Fprintf(os.Stderr, "failed to initialize resources: %s\n", err)
+		os.Exit(1)
+	}
 
 	logr.Logger.Info("initialization succeeds")
-	err := server.Serve()
-	if err != nil {
-		logr.Logger.Fatalf("failed to serve %s", err)
+	// リソースの状態を定期的に確認し、gRPC の Health Check と /health に反映する
+	rm.StartHealthCheck(config.GetDuration("health.interval"), config.GetDuration("health.timeout"))
+
+	// gRPC サーバの実行が失敗した場合は、他のリソースを停止せずに再起動する
+	maxRestarts := config.GetInt("supervisor.max_restarts")
+	rm.SetRestartPolicy(server, common.RestartPolicy{
+		MaxRestarts:    maxRestarts,
+		InitialBackoff: config.GetDuration("supervisor.initial_backoff"),
+		MaxBackoff:     config.GetDuration("supervisor.max_backoff"),
+		StablePeriod:   config.GetDuration("supervisor.stable_period"),
+	}).OnRestart(func(name string, err error, restarts int, backoff time.Duration) {
+		logr.Logger.Warnf("%s failed, restarting in %s (%d/%d): %s", name, backoff, restarts, maxRestarts, err)
+	})
+
+	// SIGTERM または SIGINT を受信するまで実行する
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		select {
+		case sig := <-sigCh:
+			logr.Logger.Infof("received signal [%s], shutting down", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	runErr := rm.Run(ctx)
+	cancel()
+	signal.Stop(sigCh)
+	if runErr != nil {
+		logr.Logger.Errorf("failed to run resources: %s", runErr)
+	}
+
+	// シグナルによる停止の場合も含め、リソースを初期化と逆順に終了する。
+	// ログも終了済みのため、終了処理のエラーは標準エラー出力に出力する
+	for _, err := range rm.Finalize() {
+		fmt.Fprintf(os.Stderr, "failed to finalize resource: %s\n", err)
+	}
+	if runErr != nil {
+		os.Exit(1)
 	}
 }